@@ -1,8 +1,10 @@
 package main
 
 import (
-	"encoding/xml"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"math/rand"
 	"sync"
 	"time"
@@ -26,10 +28,14 @@ type AMQPConfig struct {
 	AutoDelete       bool          `env:"AUTODELETE"`
 	Internal         bool          `env:"INTERNAL"`
 	RoutingKey       string        `env:"ROUTINGKEY"`
+	DeliveryMode     string        `env:"DELIVERYMODE"`
+	MessageId        string        `env:"MESSAGEID"`
 	Retry            string        `env:"RETRY"`
 	RetryDuration    time.Duration `env:"-"`
 	MaxRetry         string        `env:"MAXRETRY"`
 	MaxRetryDuration time.Duration `env:"-"`
+	routes           []RouteConfig `env:"-"`
+	apel             APELConfig    `env:"-"`
 }
 
 func (c *AMQPConfig) Validate() error {
@@ -45,12 +51,75 @@ func (c *AMQPConfig) Validate() error {
 	if err != nil {
 		return fmt.Errorf("error parsing MaxRetry: %s", err)
 	}
+	if _, err := parseRoutingKey(c.RoutingKey); err != nil {
+		return err
+	}
+	switch c.DeliveryMode {
+	case "", "persistent", "transient":
+	default:
+		return fmt.Errorf("unknown DeliveryMode \"%s\"", c.DeliveryMode)
+	}
+	switch c.MessageId {
+	case "", "id", "fingerprint":
+	default:
+		return fmt.Errorf("unknown MessageId \"%s\"", c.MessageId)
+	}
 	return nil
 }
 
+// deliveryMode returns the AMQP delivery mode to publish with. Unless
+// configured otherwise, messages are persistent if the exchange is durable,
+// since otherwise they would be lost if the broker restarts anyway.
+func (c *AMQPConfig) deliveryMode() uint8 {
+	switch c.DeliveryMode {
+	case "persistent":
+		return amqp.Persistent
+	case "transient":
+		return amqp.Transient
+	}
+	if c.Durable {
+		return amqp.Persistent
+	}
+	return amqp.Transient
+}
+
+// defaultTarget returns the target for records that don't match any route.
+func (c *AMQPConfig) defaultTarget() amqpTarget {
+	t := amqpTarget{
+		Exchange:   c.Exchange,
+		RoutingKey: c.RoutingKey,
+		Format:     c.Format,
+	}
+	t.routingKey, _ = parseRoutingKey(c.RoutingKey)
+	return t
+}
+
+// setDefaults sets any unset string options to their value in d.
+func (c *AMQPConfig) setDefaults(d AMQPConfig) {
+	for _, o := range []struct{ v, d *string }{
+		{&c.Host, &d.Host},
+		{&c.Port, &d.Port},
+		{&c.Scheme, &d.Scheme},
+		{&c.User, &d.User},
+		{&c.Password, &d.Password},
+		{&c.Format, &d.Format},
+		{&c.Exchange, &d.Exchange},
+		{&c.ExchangeType, &d.ExchangeType},
+		{&c.Retry, &d.Retry},
+		{&c.MaxRetry, &d.MaxRetry},
+		{&c.MessageId, &d.MessageId},
+	} {
+		if *o.v == "" {
+			*o.v = *o.d
+		}
+	}
+}
+
 type AMQPOutput struct {
 	Config     AMQPConfig
 	URI        string
+	target     amqpTarget
+	routes     []amqpRoute
 	connection *amqp.Connection
 	isBlocked  bool
 	m          sync.Mutex
@@ -61,38 +130,55 @@ func InitAMQP(conf AMQPConfig) (*AMQPOutput, error) {
 		Config: conf,
 		URI: conf.Scheme + "://" + conf.User + ":" + conf.Password + "@" +
 			conf.Host + ":" + conf.Port + "/" + conf.Vhost,
+		target: conf.defaultTarget(),
 	}
+	a.routes = newAMQPRoutes(conf.routes, a.target)
 	if err := a.setup(); err != nil {
 		return nil, err
 	}
-	// declare exchange
+	// declare exchanges
 	ch, err := a.OpenChannel()
 	if err != nil {
 		log.Error(err)
 		return nil, NewAMQPError("error opening channel")
 	}
-	log.WithFields(log.Fields{
-		"name":       a.Config.Exchange,
-		"type":       a.Config.ExchangeType,
-		"durable":    a.Config.Durable,
-		"autoDelete": a.Config.AutoDelete,
-		"internal":   a.Config.Internal,
-	}).Debug("declaring exchange")
-	if err = ch.ExchangeDeclare(a.Config.Exchange,
-		a.Config.ExchangeType,
-		a.Config.Durable,
-		a.Config.AutoDelete,
-		a.Config.Internal,
-		false,
-		nil); err != nil {
-		ch.Close()
-		log.Error(err)
-		return nil, NewAMQPError("error declaring exchange")
+	declared := make(map[string]bool)
+	for _, t := range append([]amqpTarget{a.target}, a.routeTargets()...) {
+		if declared[t.Exchange] {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"name":       t.Exchange,
+			"type":       a.Config.ExchangeType,
+			"durable":    a.Config.Durable,
+			"autoDelete": a.Config.AutoDelete,
+			"internal":   a.Config.Internal,
+		}).Debug("declaring exchange")
+		if err = ch.ExchangeDeclare(t.Exchange,
+			a.Config.ExchangeType,
+			a.Config.Durable,
+			a.Config.AutoDelete,
+			a.Config.Internal,
+			false,
+			nil); err != nil {
+			ch.Close()
+			log.Error(err)
+			return nil, NewAMQPError("error declaring exchange")
+		}
+		declared[t.Exchange] = true
 	}
 	ch.Close()
 	return a, nil
 }
 
+func (a *AMQPOutput) routeTargets() []amqpTarget {
+	var tt []amqpTarget
+	for _, r := range a.routes {
+		tt = append(tt, r.target)
+	}
+	return tt
+}
+
 // backoff computes the next backoff duration, using "Decorrelated Jitter" method.
 // https://www.awsarchitectureblog.com/2015/03/backoff.html
 func backoff(last time.Duration, base time.Duration, max time.Duration) time.Duration {
@@ -181,22 +267,65 @@ func (a *AMQPOutput) OpenChannel() (*amqp.Channel, error) {
 	return a.connection.Channel()
 }
 
+// Close closes the connection to the broker.
+func (a *AMQPOutput) Close() error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.connection == nil {
+		return nil
+	}
+	log.Info("AMQP: closing connection")
+	err := a.connection.Close()
+	a.connection = nil
+	return err
+}
+
 // AMQPWorker manages an AMQP channel, including
 // handling confirms, returns, and the channel or
 // connection being closed.
 type AMQPWorker struct {
 	Channel  *amqp.Channel
 	Config   AMQPConfig
+	Info     BundleInfo
+	target   amqpTarget
+	routes   []amqpRoute
 	confirms chan amqp.Confirmation
 	closing  chan *amqp.Error
 	returns  chan amqp.Return
 	flow     chan bool
 	lastTag  uint64
+	// messages are the published messages, by delivery tag less one, for
+	// matching returns and nacks to records.
+	messages []publishedMessage
+	// published is the number of records published, or batched to be.
+	published int
+	// apelBatches are the records to be published in APEL format that
+	// haven't been yet, by exchange and routing key.
+	apelBatches []*apelBatch
+}
+
+// publishedMessage is a message published by a worker: its id, and the
+// positions of the records in it.
+type publishedMessage struct {
+	id      string
+	records []int
+}
+
+// apelBatch is a batch of records to be published to the same exchange and
+// routing key in one APEL message.
+type apelBatch struct {
+	exchange string
+	key      string
+	records  []gracc.Record
+	// encoded are the records encoded by encodeAPELRecord, and positions
+	// their positions in the order they were published.
+	encoded   [][]byte
+	positions []int
 }
 
 // Initialize and return a new worker. bundleSize is the expected number
-// of records this worker will handle.
-func (a *AMQPOutput) NewWorker(bundleSize int) (*AMQPWorker, error) {
+// of records this worker will handle, and info describes the bundle.
+func (a *AMQPOutput) NewWorker(bundleSize int, info BundleInfo) (Worker, error) {
 	ll := log.WithFields(log.Fields{
 		"where": "AMQPOutput.NewWorker",
 	})
@@ -215,15 +344,21 @@ func (a *AMQPOutput) NewWorker(bundleSize int) (*AMQPWorker, error) {
 	return &AMQPWorker{
 		Channel:  ch,
 		Config:   a.Config,
+		Info:     info,
+		target:   a.target,
+		routes:   a.routes,
 		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, bundleSize)),
 		closing:  ch.NotifyClose(make(chan *amqp.Error, 1)),
 		returns:  ch.NotifyReturn(make(chan amqp.Return, bundleSize)),
 		flow:     ch.NotifyFlow(make(chan bool)),
+		messages: make([]publishedMessage, 0, bundleSize),
 	}, nil
 }
 
 // PublishRecords sends the Record to the AMQP broker. It does not
 // wait for confirmation! Call Wait() to wait for confirms and returns.
+// Records in APEL format are batched, and sent when a batch is full or by
+// Wait.
 func (w *AMQPWorker) PublishRecord(rec gracc.Record) error {
 	ll := log.WithFields(log.Fields{
 		"where": "AMQPWorker.PublishRecord",
@@ -236,42 +371,168 @@ func (w *AMQPWorker) PublishRecord(rec gracc.Record) error {
 		}
 	default:
 	}
+	rf := newRecordFields(rec)
+	t := w.recordTarget(rec, rf)
+	key, err := t.recordRoutingKey(rec, rf)
+	if err != nil {
+		ll.WithFields(log.Fields{
+			"record": rec.Id(),
+			"error":  err,
+		}).Error("error making routing key")
+		return NewRecordError("error making routing key for record")
+	}
+	if t.drop {
+		ll.WithFields(log.Fields{
+			"record": rec.Id(),
+			"type":   rec.Type(),
+		}).Debug("dropping record")
+		w.published++
+		return nil
+	}
+	if t.Format == "apel" {
+		return w.batchAPEL(rec, t.Exchange, key)
+	}
 	// publish record
-	pub := w.makePublishing(rec)
+	pub := w.makePublishing(rec, t.Format)
 	if pub == nil {
 		return NewAMQPError("error making AMQP publishing from Record")
 	}
 	ll.WithFields(log.Fields{
-		"exchange":   w.Config.Exchange,
-		"routingKey": w.Config.RoutingKey,
+		"exchange":   t.Exchange,
+		"routingKey": key,
 		"record":     rec.Id(),
 	}).Debug("publishing record")
+	if err := w.publish(t.Exchange, key, !t.optional, pub, []int{w.published}); err != nil {
+		return err
+	}
+	w.published++
+	return nil
+}
+
+// batchAPEL adds rec to the batch of APEL records for exchange and key, and
+// publishes the batch if it is full. Records that can't be encoded in APEL
+// format, or lack fields that APEL requires, are rejected.
+func (w *AMQPWorker) batchAPEL(rec gracc.Record, exchange, key string) error {
+	enc, err := encodeAPELRecord(rec, w.Config.apel)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"where":  "AMQPWorker.batchAPEL",
+			"record": rec.Id(),
+			"error":  err,
+		}).Error("error encoding record")
+		if _, ok := err.(RejectedError); ok {
+			return err
+		}
+		return NewRecordError(err.Error())
+	}
+	var b *apelBatch
+	for _, ab := range w.apelBatches {
+		if ab.exchange == exchange && ab.key == key {
+			b = ab
+		}
+	}
+	if b == nil {
+		b = &apelBatch{exchange: exchange, key: key}
+		w.apelBatches = append(w.apelBatches, b)
+	}
+	b.records = append(b.records, rec)
+	b.encoded = append(b.encoded, enc)
+	b.positions = append(b.positions, w.published)
+	w.published++
+	if len(b.records) >= apelBatchSize {
+		return w.flushAPEL(b)
+	}
+	return nil
+}
+
+// flushAPEL publishes the records in batch b in one APEL message, and
+// empties it.
+func (w *AMQPWorker) flushAPEL(b *apelBatch) error {
+	if len(b.records) == 0 {
+		return nil
+	}
+	pub := w.publishing(b.records[0])
+	pub.ContentType = "text/plain"
+	pub.Body = apelMessage(b.encoded)
+	if len(b.records) > 1 {
+		// the message id identifies the batch, and the records may be from
+		// different probes
+		pub.MessageId = batchMessageId(b.records, w.Config.MessageId)
+		delete(pub.Headers, "probe")
+	}
+	if err := w.publish(b.exchange, b.key, true, pub, b.positions); err != nil {
+		return err
+	}
+	b.records = nil
+	b.encoded = nil
+	b.positions = nil
+	return nil
+}
+
+// recordMessageId returns the message id of a message containing rec: its
+// record id, or if messageId is "fingerprint" or it has no id, its
+// fingerprint, which lets consumers deduplicate records that differ only in
+// formatting.
+func recordMessageId(rec gracc.Record, messageId string) string {
+	if id := rec.Id(); id != "" && messageId != "fingerprint" {
+		return id
+	}
+	return rec.Fingerprint()
+}
+
+// batchMessageId returns the message id of a message containing recs: a
+// checksum of their message ids (see recordMessageId), so that a batch that
+// is published again has the same id.
+func batchMessageId(recs []gracc.Record, messageId string) string {
+	h := md5.New()
+	for _, rec := range recs {
+		io.WriteString(h, recordMessageId(rec, messageId))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// publish publishes pub, containing the records at positions records, to
+// exchange with routing key. If mandatory is true, the broker returns it if
+// no queue is bound for it.
+func (w *AMQPWorker) publish(exchange, key string, mandatory bool, pub *amqp.Publishing, records []int) error {
+	ll := log.WithFields(log.Fields{
+		"where": "AMQPWorker.publish",
+	})
 	if err := w.Channel.Publish(
-		w.Config.Exchange, // exchange
-		"",                // routing key
-		true,              // mandatory
-		false,             // immediate
+		exchange,  // exchange
+		key,       // routing key
+		mandatory, // mandatory
+		false,     // immediate
 		*pub); err != nil {
 		ll.Error(err)
 		return NewAMQPError("error publishing to channel")
 	}
 	w.lastTag++
+	w.messages = append(w.messages, publishedMessage{id: pub.MessageId, records: records})
 	ll.WithFields(log.Fields{
-		"exchange":   w.Config.Exchange,
-		"routingKey": w.Config.RoutingKey,
-		"record":     rec.Id(),
+		"exchange":   exchange,
+		"routingKey": key,
+		"records":    len(records),
 		"tag":        w.lastTag,
-	}).Debug("record sent")
+	}).Debug("message sent")
 	return nil
 }
 
 // Wait will wait for confirms for all publishings sent so far.
-// It will also listen for returns, and will return an error if
-// a record is returned or if timeout elapses (unless timout<=0).
+// It will also listen for returns. Records that are returned or nacked are
+// reported in a RejectedError, so that they can be handled individually;
+// an AMQPError is returned if the channel is closed or timeout elapses
+// (unless timout<=0).
 func (w *AMQPWorker) Wait(timeout time.Duration) error {
 	ll := log.WithFields(log.Fields{
 		"where": "AMQPWorker.Wait",
 	})
+	for _, b := range w.apelBatches {
+		if err := w.flushAPEL(b); err != nil {
+			return err
+		}
+	}
 	if w.lastTag < 1 {
 		ll.Warning("no records were sent")
 		return nil
@@ -282,7 +543,25 @@ func (w *AMQPWorker) Wait(timeout time.Duration) error {
 	} else {
 		tc = make(<-chan time.Time)
 	}
-	var returns, nacks int
+	var rejected RejectedError
+	// handled are the messages that have been returned or nacked
+	handled := make(map[int]bool)
+	reject := func(m int, reason string) {
+		if m < 0 {
+			// can't tell which records it was for
+			rejected.Records = append(rejected.Records, -1)
+			rejected.Reasons = append(rejected.Reasons, reason)
+			return
+		}
+		if handled[m] {
+			return
+		}
+		handled[m] = true
+		for _, i := range w.messages[m].records {
+			rejected.Records = append(rejected.Records, i)
+			rejected.Reasons = append(rejected.Reasons, reason)
+		}
+	}
 WaitLoop:
 	for {
 		select {
@@ -301,33 +580,47 @@ WaitLoop:
 			return NewAMQPError("channel closed while waiting for confirms")
 		case ret := <-w.returns:
 			ll.WithFields(log.Fields{
-				"code":   ret.ReplyCode,
-				"reason": ret.ReplyText,
+				"code":      ret.ReplyCode,
+				"reason":    ret.ReplyText,
+				"exchange":  ret.Exchange,
+				"key":       ret.RoutingKey,
+				"messageId": ret.MessageId,
 			}).Warning("record returned")
-			returns++
+			reject(w.returnedMessage(ret, handled), fmt.Sprintf("returned by broker: %s (%d)", ret.ReplyText, ret.ReplyCode))
 		case confirm := <-w.confirms:
 			ll.WithFields(log.Fields{
 				"tag": confirm.DeliveryTag,
 				"ack": confirm.Ack,
 			}).Debug("confirm")
 			if !confirm.Ack {
-				nacks++
+				reject(int(confirm.DeliveryTag)-1, "nacked by broker")
 			}
 			if confirm.DeliveryTag >= w.lastTag {
 				break WaitLoop
 			}
 		}
 	}
-	if returns > 0 {
-		return NewAMQPError(fmt.Sprintf("%d records were returned", returns))
-	}
-	if nacks > 0 {
-		return NewAMQPError(fmt.Sprintf("%d records were not successfully sent", nacks))
+	if len(rejected.Records) > 0 {
+		rejected.Message = fmt.Sprintf("%d records were returned or nacked", len(rejected.Records))
+		return rejected
 	}
 	log.Debug("all records sent successfully")
 	return nil
 }
 
+// returnedMessage returns the index of the message that ret is for: the
+// first with the same message id that hasn't already been returned or
+// nacked. Returns are sent before the confirm for the message, so this will
+// be found unless message ids have been reused; if not, -1 is returned.
+func (w *AMQPWorker) returnedMessage(ret amqp.Return, handled map[int]bool) int {
+	for i, m := range w.messages {
+		if m.id == ret.MessageId && !handled[i] {
+			return i
+		}
+	}
+	return -1
+}
+
 // Close closes the AMQP channel and retires the worker.
 // If you want to make sure all records were recieved call Wait() first!
 func (w *AMQPWorker) Close() error {
@@ -335,32 +628,64 @@ func (w *AMQPWorker) Close() error {
 	return w.Channel.Close()
 }
 
-func (w *AMQPWorker) makePublishing(jur gracc.Record) *amqp.Publishing {
+// recordTarget returns the target of the first route that rec matches, or
+// the default target if it doesn't match any.
+func (w *AMQPWorker) recordTarget(rec gracc.Record, rf *recordFields) amqpTarget {
+	for _, r := range w.routes {
+		if r.match(rec, w.Info, rf) {
+			return r.target
+		}
+	}
+	return w.target
+}
+
+// recordProbeName returns the ProbeName of rec, which may be marked as a
+// duplicate.
+func recordProbeName(rec gracc.Record) string {
+	return gracc.ProbeName(unwrapRecord(rec))
+}
+
+// makePublishing encodes jur in format, and sets the message properties
+// that describe the record and where it came from.
+func (w *AMQPWorker) makePublishing(jur gracc.Record, format string) *amqp.Publishing {
 	ll := log.WithFields(log.Fields{
 		"where": "AMQPWorker.makePublishing",
 	})
+	body, contentType, err := encodeRecord(jur, format, "    ")
+	if err != nil {
+		ll.WithFields(log.Fields{
+			"format": format,
+			"error":  err,
+		}).Error("error encoding record")
+		ll.Debugf("%v", jur)
+		return nil
+	}
+	pub := w.publishing(jur)
+	pub.ContentType = contentType
+	pub.Body = body
+	return pub
+}
+
+// publishing returns a publishing without a body, with the message
+// properties that describe jur and where it came from.
+func (w *AMQPWorker) publishing(jur gracc.Record) *amqp.Publishing {
 	var pub amqp.Publishing
-	switch w.Config.Format {
-	case "raw":
-		pub.ContentType = "text/xml"
-		pub.Body = jur.Raw()
-	case "xml":
-		if j, err := xml.Marshal(jur); err != nil {
-			ll.Error("error converting JobUsageRecord to xml")
-			ll.Debugf("%v", jur)
-			return nil
-		} else {
-			pub.ContentType = "text/xml"
-			pub.Body = j
-		}
-	case "json":
-		if j, err := jur.ToJSON("    "); err != nil {
-			ll.Error("error converting JobUsageRecord to json")
-			ll.Debugf("%v", jur)
-			return nil
-		} else {
-			pub.ContentType = "application/json"
-			pub.Body = j
+	pub.DeliveryMode = w.Config.deliveryMode()
+	pub.MessageId = recordMessageId(jur, w.Config.MessageId)
+	pub.Timestamp = w.Info.Received
+	if pub.Timestamp.IsZero() {
+		pub.Timestamp = time.Now()
+	}
+	pub.Type = jur.Type()
+	pub.AppId = "gracc-collector/" + build_ver
+	pub.Headers = amqp.Table{}
+	for k, v := range map[string]string{
+		"from":        w.Info.From,
+		"remote_addr": w.Info.RemoteAddr,
+		"probe":       recordProbeName(jur),
+	} {
+		if v != "" {
+			pub.Headers[k] = v
 		}
 	}
 	return &pub
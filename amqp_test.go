@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+	"github.com/streadway/amqp"
+)
+
+func TestRecordRoutingKey(t *testing.T) {
+	rec, err := gracc.ParseRecordXML([]byte(`<JobUsageRecord xmlns:urwg="http://www.gridforum.org/2003/ur-wg">
+<RecordIdentity urwg:recordId="test:1" urwg:createTime="2016-02-25T02:37:01Z"/>
+<UserIdentity><VOName>osg</VOName></UserIdentity>
+<ProbeName>condor:test.example.com</ProbeName>
+</JobUsageRecord>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, exp := range map[string]string{
+		"":                                     "",
+		"gracc.raw":                            "gracc.raw",
+		"{{.Type}}.{{.ProbeName}}.{{.VOName}}": "JobUsageRecord.condor:test.example.com.osg",
+		"{{.Type}}.{{.SiteName}}":              "JobUsageRecord.",
+		"{{.Id}}":                              "test:1",
+	} {
+		conf := DefaultConfig().AMQP
+		conf.RoutingKey = key
+		if err := conf.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		target := conf.defaultTarget()
+		if k, err := target.recordRoutingKey(rec, newRecordFields(rec)); err != nil {
+			t.Error(err)
+		} else if k != exp {
+			t.Errorf("%s: expected %s, got %s", key, exp, k)
+		}
+	}
+
+	conf := DefaultConfig().AMQP
+	conf.RoutingKey = "{{.Type"
+	if err := conf.Validate(); err == nil {
+		t.Error("expected error for invalid template")
+	}
+}
+
+func TestMakePublishing(t *testing.T) {
+	rec, err := gracc.ParseRecordXML([]byte(`<JobUsageRecord xmlns:urwg="http://www.gridforum.org/2003/ur-wg">
+<RecordIdentity urwg:recordId="test:1" urwg:createTime="2016-02-25T02:37:01Z"/>
+<ProbeName>condor:test.example.com</ProbeName>
+</JobUsageRecord>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := time.Date(2016, 2, 25, 2, 37, 5, 0, time.UTC)
+	w := &AMQPWorker{
+		Config: DefaultConfig().AMQP,
+		Info: BundleInfo{
+			From:       "probe.example.com",
+			RemoteAddr: "192.0.2.1:4321",
+			Received:   received,
+		},
+	}
+	pub := w.makePublishing(rec, "raw")
+	if pub == nil {
+		t.Fatal("expected publishing")
+	}
+	if pub.DeliveryMode != amqp.Transient {
+		t.Errorf("expected transient delivery for non-durable exchange, got %d", pub.DeliveryMode)
+	}
+	if pub.MessageId != "test:1" {
+		t.Errorf("expected MessageId test:1, got %s", pub.MessageId)
+	}
+	if !pub.Timestamp.Equal(received) {
+		t.Errorf("expected Timestamp %s, got %s", received, pub.Timestamp)
+	}
+	if pub.Type != "JobUsageRecord" {
+		t.Errorf("expected Type JobUsageRecord, got %s", pub.Type)
+	}
+	if pub.AppId != "gracc-collector/"+build_ver {
+		t.Errorf("unexpected AppId %s", pub.AppId)
+	}
+	for k, v := range map[string]string{
+		"from":        "probe.example.com",
+		"remote_addr": "192.0.2.1:4321",
+		"probe":       "condor:test.example.com",
+	} {
+		if pub.Headers[k] != v {
+			t.Errorf("expected header %s=%s, got %v", k, v, pub.Headers[k])
+		}
+	}
+
+	w.Config.Durable = true
+	w.Config.MessageId = "fingerprint"
+	pub = w.makePublishing(rec, "raw")
+	if pub.DeliveryMode != amqp.Persistent {
+		t.Errorf("expected persistent delivery for durable exchange, got %d", pub.DeliveryMode)
+	}
+	if pub.MessageId != rec.Fingerprint() {
+		t.Errorf("expected MessageId %s, got %s", rec.Fingerprint(), pub.MessageId)
+	}
+	w.Config.DeliveryMode = "transient"
+	if pub = w.makePublishing(rec, "raw"); pub.DeliveryMode != amqp.Transient {
+		t.Errorf("expected transient delivery, got %d", pub.DeliveryMode)
+	}
+
+	// the properties can be made without encoding the record, e.g. for APEL
+	// batches
+	if p := w.publishing(rec); p.Body != nil || p.MessageId != pub.MessageId || p.Headers["probe"] != pub.Headers["probe"] {
+		t.Errorf("expected properties without a body, got %+v", p)
+	}
+}
+
+func TestReturnedMessage(t *testing.T) {
+	w := &AMQPWorker{messages: []publishedMessage{
+		{id: "a", records: []int{0}},
+		{id: "b", records: []int{1, 2}},
+		{id: "a", records: []int{3}},
+	}}
+	handled := make(map[int]bool)
+	for _, tc := range []struct {
+		id  string
+		exp int
+	}{{"b", 1}, {"a", 0}, {"a", 2}, {"a", -1}, {"c", -1}} {
+		m := w.returnedMessage(amqp.Return{MessageId: tc.id}, handled)
+		if m != tc.exp {
+			t.Errorf("return of %s: expected message %d, got %d", tc.id, tc.exp, m)
+		}
+		if m >= 0 {
+			handled[m] = true
+		}
+	}
+}
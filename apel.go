@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+// apelHeader is the first line of an APEL individual job message.
+const apelHeader = "APEL-individual-job-message: v0.3"
+
+// apelBatchSize is the maximum number of records in an APEL message, as
+// recommended for the APEL SSM.
+const apelBatchSize = 1000
+
+// APELConfig is the benchmark that APEL job records are normalised by, for
+// records that don't report their own ServiceLevel.
+type APELConfig struct {
+	ServiceLevelType string `env:"SERVICELEVELTYPE"`
+	ServiceLevel     string `env:"SERVICELEVEL"`
+}
+
+func (c *APELConfig) Validate() error {
+	switch c.ServiceLevelType {
+	case "":
+		c.ServiceLevelType = "HEPSPEC"
+	case "HEPSPEC", "si2k":
+	default:
+		return fmt.Errorf("unknown APEL ServiceLevelType \"%s\"", c.ServiceLevelType)
+	}
+	if c.ServiceLevel != "" {
+		if v, err := strconv.ParseFloat(c.ServiceLevel, 64); err != nil || v <= 0 {
+			return fmt.Errorf("APEL ServiceLevel must be a positive number, got \"%s\"", c.ServiceLevel)
+		}
+	}
+	return nil
+}
+
+// apelRequired are the fields that every APEL individual job record must
+// have.
+var apelRequired = []string{"Site", "LocalJobId", "StartTime", "EndTime", "ServiceLevelType", "ServiceLevel"}
+
+// apelRecord returns the APEL individual job record for JobUsageRecord rec,
+// as "key: value" pairs in order. Values that rec doesn't have are left out,
+// but a RejectedError is returned if it is missing any that APEL requires.
+// The ServiceLevel is taken from the record's ServiceLevel Resource, with its
+// unit as the ServiceLevelType, or else from conf.
+func apelRecord(rec gracc.Record, conf APELConfig) ([][2]string, error) {
+	jur, ok := unwrapRecord(rec).(*gracc.JobUsageRecord)
+	if !ok {
+		return nil, fmt.Errorf("%s records can't be encoded in APEL format", rec.Type())
+	}
+	f, err := flattenRecord(jur)
+	if err != nil {
+		return nil, err
+	}
+	var r [][2]string
+	add := func(k, v string) {
+		if v = strings.TrimSpace(strings.Replace(v, "\n", " ", -1)); v != "" {
+			r = append(r, [2]string{k, v})
+		}
+	}
+	str := func(k string) string {
+		switch v := f[k].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', 0, 64)
+		}
+		return ""
+	}
+	unix := func(k string) string {
+		t, err := time.Parse(time.RFC3339, str(k))
+		if err != nil {
+			return ""
+		}
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+
+	add("Site", str("SiteName"))
+	add("SubmitHost", str("SubmitHost"))
+	add("MachineName", str("MachineName"))
+	add("Queue", str("Queue"))
+	add("LocalJobId", str("LocalJobId"))
+	add("LocalUserId", str("LocalUserId"))
+	add("GlobalUserName", str("DN"))
+
+	// VOName is either the VO or the FQAN of the user's VOMS proxy, e.g.
+	// /cms/Role=production/Capability=NULL, from which the group and role
+	// are taken.
+	vo := str("ReportableVOName")
+	if fqan := str("VOName"); strings.HasPrefix(fqan, "/") {
+		var group []string
+		var role string
+		for _, p := range strings.Split(fqan, "/")[1:] {
+			if strings.HasPrefix(p, "Role=") {
+				role = p
+			} else if !strings.Contains(p, "=") {
+				group = append(group, p)
+			}
+		}
+		if vo == "" && len(group) > 0 {
+			vo = group[0]
+		}
+		add("FQAN", fqan)
+		add("VO", vo)
+		if len(group) > 0 {
+			add("VOGroup", "/"+strings.Join(group, "/"))
+		}
+		add("VORole", role)
+	} else {
+		if vo == "" {
+			vo = fqan
+		}
+		add("VO", vo)
+	}
+
+	add("WallDuration", str("WallDuration"))
+	add("CpuDuration", str("CpuDuration"))
+	add("Processors", str("Processors"))
+	add("NodeCount", str("NodeCount"))
+	add("StartTime", unix("StartTime"))
+	add("EndTime", unix("EndTime"))
+	if level := str("Resource_ServiceLevel"); level != "" {
+		levelType := str("Resource_ServiceLevel_unit")
+		if levelType == "" {
+			levelType = conf.ServiceLevelType
+		}
+		add("ServiceLevelType", levelType)
+		add("ServiceLevel", level)
+	} else {
+		add("ServiceLevelType", conf.ServiceLevelType)
+		add("ServiceLevel", conf.ServiceLevel)
+	}
+
+	have := make(map[string]bool, len(r))
+	for _, kv := range r {
+		have[kv[0]] = true
+	}
+	var missing []string
+	for _, k := range apelRequired {
+		if !have[k] {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		msg := fmt.Sprintf("record %s is missing %s, required by APEL", jur.Id(), strings.Join(missing, ", "))
+		return nil, RejectedError{Message: msg}
+	}
+	return r, nil
+}
+
+// encodeAPELRecord returns the lines of the APEL individual job record for
+// rec, followed by a "%%" line.
+func encodeAPELRecord(rec gracc.Record, conf APELConfig) ([]byte, error) {
+	r, err := apelRecord(rec, conf)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for _, kv := range r {
+		b.WriteString(kv[0] + ": " + kv[1] + "\n")
+	}
+	b.WriteString("%%\n")
+	return b.Bytes(), nil
+}
+
+// apelMessage returns an APEL individual job message containing records
+// encoded by encodeAPELRecord.
+func apelMessage(records [][]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(apelHeader + "\n")
+	for _, r := range records {
+		b.Write(r)
+	}
+	return b.Bytes()
+}
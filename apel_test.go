@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+// testAPELConfig is the benchmark of a site that reports to APEL.
+var testAPELConfig = APELConfig{ServiceLevelType: "HEPSPEC", ServiceLevel: "10.5"}
+
+// testAPELRecord returns a job record with the fields that APEL requires.
+func testAPELRecord(t *testing.T, id string) *gracc.JobUsageRecord {
+	start := time.Date(2016, 2, 25, 1, 37, 0, 0, time.UTC)
+	jur, err := gracc.NewJobUsageRecordBuilder(id).
+		LocalJobId("1.0").
+		VOName("osg").
+		SiteName("Example").
+		StartTime(start).
+		EndTime(start.Add(time.Hour)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jur
+}
+
+func TestAPELRecord(t *testing.T) {
+	rec, err := gracc.ParseRecordXML([]byte(`<JobUsageRecord xmlns:urwg="http://www.gridforum.org/2003/ur-wg">
+<RecordIdentity urwg:recordId="test:1" urwg:createTime="2016-02-25T02:37:01Z"/>
+<JobIdentity><GlobalJobId>condor.test#1.0#1456367821</GlobalJobId><LocalJobId>1.0</LocalJobId></JobIdentity>
+<UserIdentity><LocalUserId>cmsprod</LocalUserId><VOName>/cms/uscms/Role=production/Capability=NULL</VOName><ReportableVOName>cms</ReportableVOName><DN>/DC=ch/DC=cern/CN=Test User</DN></UserIdentity>
+<WallDuration>PT1H0.5S</WallDuration>
+<CpuDuration urwg:usageType="user">PT50M</CpuDuration>
+<CpuDuration urwg:usageType="system">PT5M</CpuDuration>
+<StartTime>2016-02-25T01:37:00Z</StartTime>
+<EndTime>2016-02-25T02:37:00Z</EndTime>
+<MachineName>ce.example.com</MachineName>
+<SubmitHost>submit.example.com</SubmitHost>
+<Processors urwg:metric="max">8</Processors>
+<NodeCount urwg:metric="max">1</NodeCount>
+<SiteName>Example</SiteName>
+</JobUsageRecord>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := encodeAPELRecord(rec, testAPELConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := apelMessage([][]byte{r, r})
+	rb := `Site: Example
+SubmitHost: submit.example.com
+MachineName: ce.example.com
+LocalJobId: 1.0
+LocalUserId: cmsprod
+GlobalUserName: /DC=ch/DC=cern/CN=Test User
+FQAN: /cms/uscms/Role=production/Capability=NULL
+VO: cms
+VOGroup: /cms/uscms
+VORole: Role=production
+WallDuration: 3600
+CpuDuration: 3300
+Processors: 8
+NodeCount: 1
+StartTime: 1456364220
+EndTime: 1456367820
+ServiceLevelType: HEPSPEC
+ServiceLevel: 10.5
+%%
+`
+	if exp := apelHeader + "\n" + rb + rb; string(b) != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, b)
+	}
+
+	// records without an FQAN
+	kv, err := apelRecord(testAPELRecord(t, "r1"), testAPELConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range kv {
+		if kv[0] == "FQAN" || kv[0] == "VO" && kv[1] != "osg" {
+			t.Errorf("unexpected %s: %s", kv[0], kv[1])
+		}
+	}
+
+	ser, err := gracc.NewStorageElementRecordBuilder("se1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apelRecord(ser, testAPELConfig); err == nil {
+		t.Error("expected error encoding StorageElementRecord in APEL format")
+	}
+}
+
+func TestAPELServiceLevel(t *testing.T) {
+	// the record's own ServiceLevel comes before the configured one
+	jur, err := gracc.NewJobUsageRecordBuilder("r1").
+		LocalJobId("1.0").
+		SiteName("Example").
+		StartTime(time.Unix(0, 0)).
+		EndTime(time.Unix(60, 0)).
+		Field("Resource", "2500", "description", "ServiceLevel", "unit", "si2k").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := apelRecord(jur, testAPELConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := [][2]string{{"ServiceLevelType", "si2k"}, {"ServiceLevel", "2500"}}
+	if got := r[len(r)-2:]; got[0] != exp[0] || got[1] != exp[1] {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+
+	for _, conf := range []APELConfig{
+		{ServiceLevelType: "HEPSPEC", ServiceLevel: "0"},
+		{ServiceLevelType: "HS06", ServiceLevel: "10"},
+	} {
+		if err := conf.Validate(); err == nil {
+			t.Errorf("expected error validating %+v", conf)
+		}
+	}
+}
+
+func TestAPELRequiredFields(t *testing.T) {
+	rec, err := gracc.NewJobUsageRecordBuilder("r1").VOName("osg").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = apelRecord(duplicateRecord{rec}, testAPELConfig)
+	if _, ok := err.(RejectedError); !ok {
+		t.Fatalf("expected RejectedError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "Site, LocalJobId, StartTime, EndTime") {
+		t.Errorf("expected missing fields in error, got %s", err)
+	}
+
+	// without a configured ServiceLevel, records must have their own
+	_, err = apelRecord(testAPELRecord(t, "r2"), DefaultConfig().APEL)
+	if _, ok := err.(RejectedError); !ok || !strings.Contains(err.Error(), "ServiceLevel") {
+		t.Errorf("expected RejectedError for missing ServiceLevel, got %v", err)
+	}
+}
+
+func TestConvertAPEL(t *testing.T) {
+	x, err := gracc.MarshalRecordXML(testAPELRecord(t, "r1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var in bytes.Buffer
+	for i := 0; i < apelBatchSize+1; i++ {
+		in.Write(x)
+	}
+	in.WriteString(`<JobUsageRecord><RecordIdentity recordId="r2"/><SiteName>Example</SiteName></JobUsageRecord>`)
+	in.WriteString(`<StorageElementRecord><UniqueID>se1</UniqueID></StorageElementRecord>`)
+	input := in.String()
+	var stdout, stderr bytes.Buffer
+	if status := runConvert([]string{"-format", "apel", "-servicelevel", "10.5"}, strings.NewReader(input), &stdout, &stderr); status != 1 {
+		t.Errorf("expected status 1, got %d: %s", status, stderr.String())
+	}
+	out := stdout.String()
+	if n := strings.Count(out, apelHeader+"\n"); n != 2 {
+		t.Errorf("expected 2 messages, got %d", n)
+	}
+	if n := strings.Count(out, "%%\n"); n != apelBatchSize+1 {
+		t.Errorf("expected %d records, got %d", apelBatchSize+1, n)
+	}
+	if !strings.Contains(stderr.String(), "converted 1001 of 1003 records, 2 errors") {
+		t.Errorf("expected 2 errors, got %s", stderr.String())
+	}
+
+	// records are rejected without a ServiceLevel
+	stdout.Reset()
+	stderr.Reset()
+	if status := runConvert([]string{"-format", "apel"}, strings.NewReader(input), &stdout, &stderr); status != 1 || stdout.Len() != 0 {
+		t.Errorf("expected status 1 and no records, got %d: %s", status, stdout.String())
+	}
+}
+
+func TestBatchMessageId(t *testing.T) {
+	r1, _ := gracc.NewJobUsageRecordBuilder("r1").Build()
+	r2, _ := gracc.NewJobUsageRecordBuilder("r2").Build()
+	id := batchMessageId([]gracc.Record{r1, r2}, "fingerprint")
+	if id != batchMessageId([]gracc.Record{r1, r2}, "fingerprint") {
+		t.Error("expected the same id for the same batch")
+	}
+	for _, ids := range [][]gracc.Record{{r2, r1}, {r1}} {
+		if batchMessageId(ids, "fingerprint") == id {
+			t.Errorf("expected a different id for batch of %d", len(ids))
+		}
+	}
+	if batchMessageId([]gracc.Record{r1, r2}, "id") == id {
+		t.Error("expected a different id by record ids")
+	}
+}
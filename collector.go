@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
@@ -9,8 +8,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	"unicode/utf8"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/opensciencegrid/gracc-collector/gracc"
@@ -34,10 +33,10 @@ const (
 )
 
 type GraccCollector struct {
-	Config *CollectorConfig
-	Output *AMQPOutput
-	Stats  CollectorStats
-	m      sync.Mutex
+	Config  *CollectorConfig
+	Outputs []*OutputSink
+	Stats   CollectorStats
+	m       sync.Mutex
 
 	Events chan Event
 
@@ -45,6 +44,10 @@ type GraccCollector struct {
 	RecordErrorCountDesc  *prometheus.Desc
 	RequestCountDesc      *prometheus.Desc
 	RequestErrorCountDesc *prometheus.Desc
+	OutputErrorCountDesc  *prometheus.Desc
+
+	Dedup       *Deduper
+	DeadLetters *DeadLetters
 }
 
 // NewCollector initializes and returns a new Gracc collector.
@@ -55,10 +58,47 @@ func NewCollector(conf *CollectorConfig) (*GraccCollector, error) {
 	g.Events = make(chan Event)
 	go g.LogEvents()
 
-	if o, err := InitAMQP(conf.AMQP); err != nil {
-		return nil, err
-	} else {
-		g.Output = o
+	if conf.DeadLetter.Enabled() {
+		var err error
+		if g.DeadLetters, err = NewDeadLetters(conf.DeadLetter, conf.AMQP, conf.TimeoutDuration); err != nil {
+			return nil, err
+		}
+	}
+
+	// dead letters are set up first, so that records that outputs reject
+	// while the spool is forwarding them can be quarantined
+	for _, oc := range conf.OutputConfigs() {
+		log.WithFields(log.Fields{
+			"name":     oc.Name,
+			"type":     oc.Type,
+			"required": oc.Required,
+		}).Info("initializing output")
+		o, err := NewOutput(oc)
+		if err != nil {
+			return nil, err
+		}
+		sink := &OutputSink{
+			Name:     oc.Name,
+			Required: oc.Required,
+			Output:   o,
+		}
+		if conf.Spool.Enabled() {
+			if sink.Spool, err = NewSpool(oc.Name, conf.Spool, o, conf.TimeoutDuration, conf.Generic, g.rejectRecords); err != nil {
+				return nil, err
+			}
+			log.WithFields(log.Fields{
+				"output": oc.Name,
+				"dir":    sink.Spool.Dir,
+			}).Info("initialized spool")
+		}
+		g.Outputs = append(g.Outputs, sink)
+	}
+
+	if conf.Dedup.Enabled() {
+		var err error
+		if g.Dedup, err = NewDeduper(conf.Dedup); err != nil {
+			return nil, err
+		}
 	}
 
 	g.RecordCountDesc = prometheus.NewDesc(
@@ -85,6 +125,12 @@ func NewCollector(conf *CollectorConfig) (*GraccCollector, error) {
 		nil,
 		nil,
 	)
+	g.OutputErrorCountDesc = prometheus.NewDesc(
+		"gracc_output_errors_total",
+		"Number of bundles that could not be sent to an output.",
+		[]string{"output"},
+		nil,
+	)
 
 	return &g, nil
 }
@@ -122,6 +168,18 @@ func (g *GraccCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- g.RecordErrorCountDesc
 	ch <- g.RequestCountDesc
 	ch <- g.RequestErrorCountDesc
+	ch <- g.OutputErrorCountDesc
+	if g.Dedup != nil {
+		g.Dedup.Describe(ch)
+	}
+	if g.DeadLetters != nil {
+		g.DeadLetters.Describe(ch)
+	}
+	for _, o := range g.Outputs {
+		if o.Spool != nil {
+			o.Spool.Describe(ch)
+		}
+	}
 }
 
 func (g *GraccCollector) Collect(ch chan<- prometheus.Metric) {
@@ -147,6 +205,43 @@ func (g *GraccCollector) Collect(ch chan<- prometheus.Metric) {
 		float64(g.Stats.RequestErrors),
 	)
 	g.m.Unlock()
+	if g.Dedup != nil {
+		g.Dedup.Collect(ch)
+	}
+	if g.DeadLetters != nil {
+		g.DeadLetters.Collect(ch)
+	}
+	for _, o := range g.Outputs {
+		ch <- prometheus.MustNewConstMetric(
+			g.OutputErrorCountDesc,
+			prometheus.CounterValue,
+			float64(atomic.LoadUint64(&o.errors)),
+			o.Name,
+		)
+		if o.Spool != nil {
+			o.Spool.Collect(ch)
+		}
+	}
+}
+
+// Close shuts down all outputs, after stopping their spools' forwarders.
+func (g *GraccCollector) Close() {
+	for _, o := range g.Outputs {
+		if o.Spool != nil {
+			o.Spool.Close()
+		}
+		if err := o.Output.Close(); err != nil {
+			log.WithFields(log.Fields{
+				"output": o.Name,
+				"error":  err,
+			}).Error("error closing output")
+		}
+	}
+	if g.DeadLetters != nil {
+		if err := g.DeadLetters.Close(); err != nil {
+			log.WithField("error", err).Error("error closing dead letters")
+		}
+	}
 }
 
 // Request is a wrapper struct for passing around an HTTP request
@@ -158,6 +253,18 @@ type Request struct {
 	start time.Time
 }
 
+// bundleInfo returns a description of the bundle in the request.
+func (req *Request) bundleInfo() BundleInfo {
+	bundlesize, _ := strconv.Atoi(req.r.FormValue("bundlesize"))
+	return BundleInfo{
+		From:       req.r.FormValue("from"),
+		RemoteAddr: req.r.RemoteAddr,
+		Received:   req.start,
+		Command:    req.r.FormValue("command"),
+		BundleSize: bundlesize,
+	}
+}
+
 func (g *GraccCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	g.Events <- GOT_REQUEST
 	req := &Request{
@@ -192,15 +299,18 @@ func (g *GraccCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // handleMultiUpdate handles the typical request from a Gratia probe.
 //
 // Typical fields included in request:
-//     command: update type (typ. "multiupdate")
-//     arg1: record bundle XML
-//     bundlesize: max number of records in bundle
-//     from: the name of the sender
+//
+//	command: update type (typ. "multiupdate")
+//	arg1: record bundle XML
+//	bundlesize: max number of records in bundle
+//	from: the name of the sender
+//
 // Extra:
-//     xmlfiles: number of records already passed to GratiaCore, still to be sent and still in individual xml files (i.e. number of gratia record in the outbox)
-//     tarfiles: number of outstanding tar files
-//     maxpendingfiles: 'current' number of files in a new tar file (i.e. an estimate of the number of individual records per tar file).
-//     backlog: estimated amount of data to be processed by the probe
+//
+//	xmlfiles: number of records already passed to GratiaCore, still to be sent and still in individual xml files (i.e. number of gratia record in the outbox)
+//	tarfiles: number of outstanding tar files
+//	maxpendingfiles: 'current' number of files in a new tar file (i.e. an estimate of the number of individual records per tar file).
+//	backlog: estimated amount of data to be processed by the probe
 func (g *GraccCollector) handleMultiUpdate(req *Request) {
 	if err := g.checkRequiredKeys(req, []string{"arg1", "from"}); err != nil {
 		g.Events <- REQUEST_ERROR
@@ -217,14 +327,12 @@ func (g *GraccCollector) handleMultiUpdate(req *Request) {
 		g.handleError(req, NewRequestError("error unmarshalling xml"))
 		return
 	}
-	updateLogger.WithFields(log.Fields{
-		"UsageRecord":          len(bun.UsageRecords),
-		"JobUsageRecord":       len(bun.JobUsageRecords),
-		"StorageElement":       len(bun.StorageElements),
-		"StorageElementRecord": len(bun.StorageElementRecords),
-		"Other":                len(bun.OtherRecords),
-	}).Debug("processed XML record bundle")
-	if err := g.sendBundle(&bun); err != nil {
+	counts := log.Fields{"Other": len(bun.OtherRecords)}
+	for t, n := range bun.TypeCounts() {
+		counts[t] = n
+	}
+	updateLogger.WithFields(counts).Debug("processed XML record bundle")
+	if err := g.sendBundle(&bun, req.bundleInfo(), nil); err != nil {
 		g.Events <- REQUEST_ERROR
 		updateLogger.WithField("error", err).Error("error sending update")
 		g.handleError(req, err)
@@ -260,19 +368,19 @@ func (g *GraccCollector) handleUpdate(req *Request) {
 		g.handleError(req, NewRequestError("error interpreting bundlesize"))
 		return
 	}
-	bun, err := g.processBundle(req.r.FormValue("arg1"))
+	bun, dls, err := g.processBundle(req.r.FormValue("arg1"))
 	if err != nil {
 		g.Events <- REQUEST_ERROR
 		updateLogger.WithField("error", err).Error("error processing bundle")
 		g.handleError(req, err)
 		return
 	}
-	if n := bun.RecordCount(); n != bundlesize {
+	if n := bun.RecordCount() + len(dls); n != bundlesize {
 		g.Events <- REQUEST_ERROR
 		g.handleError(req, NewRequestError(fmt.Sprintf("number of records in bundle (%d) different than expected (%d)", n, bundlesize)))
 		return
 	}
-	if err := g.sendBundle(bun); err != nil {
+	if err := g.sendBundle(bun, req.bundleInfo(), dls); err != nil {
 		g.Events <- REQUEST_ERROR
 		g.handleError(req, err)
 		return
@@ -290,93 +398,264 @@ func (g *GraccCollector) checkRequiredKeys(req *Request, keys []string) error {
 	return nil
 }
 
-// processBundle parses a replication bundle.
-func (g *GraccCollector) processBundle(bundle string) (*gracc.RecordBundle, error) {
+// processBundle parses a replication bundle, in which a StorageUsageRecords
+// document is split into its records. Unless the acceptance policy
+// is strict, records that can't be parsed are returned as dead letters,
+// otherwise the whole bundle is rejected. If generic records are enabled,
+// records of unknown types are parsed as GenericRecords.
+func (g *GraccCollector) processBundle(bundle string) (*gracc.RecordBundle, []DeadLetter, error) {
+	rrs, err := gracc.ScanReplicationBundle(strings.NewReader(bundle), g.Config.StartBufferSize, g.Config.MaxBufferSize)
+	if err != nil {
+		return nil, nil, NewRecordError(fmt.Sprintf("error parsing bundle: %s", err))
+	}
 	var bun gracc.RecordBundle
-	bs := bufio.NewScanner(strings.NewReader(bundle))
-	bs.Buffer(make([]byte, g.Config.StartBufferSize), g.Config.MaxBufferSize)
-	bs.Split(ScanBundle)
-ScannerLoop:
-	for bs.Scan() {
-		tok := bs.Text()
-		switch tok {
-		case "":
-			continue
-		case "replication":
-			parts := make(map[string]string, 3)
-			for _, p := range []string{"rec", "raw", "extra"} {
-				if bs.Scan() {
-					parts[p] = bs.Text()
-				} else {
-					break ScannerLoop
-				}
-			}
-			rec, err := gracc.ParseRecordXML([]byte(parts["rec"]))
-			if err != nil {
+	var dls []DeadLetter
+	for i, rr := range rrs {
+		// a StorageUsageRecords document is replicated as one record
+		xs, err := gracc.SplitRecordXML([]byte(rr.Rec))
+		if err != nil {
+			// the error is reported when it's parsed
+			xs = [][]byte{[]byte(rr.Rec)}
+		}
+		for _, x := range xs {
+			rec, err := g.parseRecord(x)
+			if err != nil && g.Config.AcceptPolicy() != "strict" {
+				g.Events <- GOT_RECORD
+				g.Events <- RECORD_ERROR
+				dls = append(dls, DeadLetter{
+					RawXML: string(x),
+					Error:  err.Error(),
+					Index:  i + 1,
+					Raw:    rr.Raw,
+					Extra:  rr.Extra,
+				})
+				continue
+			} else if err != nil {
 				log.WithFields(log.Fields{
 					"error": err,
-					"rec":   parts["rec"],
-					"raw":   parts["raw"],
-					"extra": parts["extra"],
+					"rec":   string(x),
+					"raw":   rr.Raw,
+					"extra": rr.Extra,
 				}).Error("error processing record XML")
-				return nil, NewRecordError("error processing replicated record")
+				return nil, nil, NewRecordError("error processing replicated record")
 			}
 			bun.AddRecord(rec)
 		}
 	}
-	// check for scanner errors
-	if err := bs.Err(); err != nil {
-		return nil, NewRecordError(fmt.Sprintf("error parsing bundle: %s", err))
-	}
-	return &bun, nil
+	return &bun, dls, nil
 }
 
-// sendBundle publishes the records in RecordBundle bun to AMQP.
-func (g *GraccCollector) sendBundle(bun *gracc.RecordBundle) error {
-	// setup AMQP channel
-	w, err := g.Output.NewWorker(bun.RecordCount())
-	if err != nil {
-		log.Error(err)
-		return err
+// parseRecord parses record XML x into a known record type, or if generic
+// records are enabled, a GenericRecord if it is of another type.
+func (g *GraccCollector) parseRecord(x []byte) (gracc.Record, error) {
+	if g.Config.Generic {
+		return gracc.ParseAnyRecordXML(x)
 	}
-	defer w.Close()
+	return gracc.ParseRecordXML(x)
+}
 
+// sendBundle publishes the records in RecordBundle bun, described by info,
+// to all outputs. Records that were rejected, either before sending (dls)
+// or by an output, are handled according to the acceptance policy, like
+// records in bun that couldn't be unmarshalled. An error is returned only if
+// a required output fails, rejected records couldn't be quarantined, or the
+// policy is strict and bun has invalid records. If generic records are enabled, records of unknown types
+// are published as GenericRecords.
+func (g *GraccCollector) sendBundle(bun *gracc.RecordBundle, info BundleInfo, dls []DeadLetter) error {
+	policy := g.Config.AcceptPolicy()
+	if g.Config.Generic {
+		bun.ParseOtherRecords()
+	}
+	for _, r := range bun.InvalidRecords {
+		g.Events <- GOT_RECORD
+		g.Events <- RECORD_ERROR
+		if policy == "strict" {
+			log.WithFields(log.Fields{
+				"type":  r.XMLName.Local,
+				"error": r.Err,
+			}).Error("error unmarshalling record")
+			return NewRecordError(fmt.Sprintf("error unmarshalling %s: %s", r.XMLName.Local, r.Err))
+		}
+		dls = append(dls, invalidDeadLetter(r))
+	}
 	for _, r := range bun.OtherRecords {
 		g.Events <- GOT_RECORD
 		g.Events <- RECORD_ERROR
-		log.WithField("type", r.XMLName).Warning("bundle contains unrecognized record type; ignoring!")
+		if policy == "strict" {
+			log.WithField("type", r.XMLName).Warning("bundle contains unrecognized record type; ignoring!")
+		} else {
+			dls = append(dls, otherDeadLetter(r))
+		}
 	}
-
-	npub := 0
+	var recs []gracc.Record
 	for rec := range bun.Records() {
 		g.Events <- GOT_RECORD
-		npub += 1
+		recs = append(recs, rec)
+	}
+	var keys []string
+	if g.Dedup != nil {
+		recs, keys = g.Dedup.Filter(recs)
+	}
+
+	errs := make([]error, len(g.Outputs))
+	rejected := make([][]DeadLetter, len(g.Outputs))
+	var wg sync.WaitGroup
+	for i, o := range g.Outputs {
+		if len(recs) == 0 {
+			break
+		}
+		wg.Add(1)
+		go func(i int, o *OutputSink) {
+			defer wg.Done()
+			rejected[i], errs[i] = g.sendToOutput(o, recs, info)
+		}(i, o)
+	}
+	wg.Wait()
+
+	var rerr error
+	for i, o := range g.Outputs {
+		dls = append(dls, rejected[i]...)
+		if errs[i] == nil {
+			continue
+		}
+		atomic.AddUint64(&o.errors, 1)
+		ll := log.WithFields(log.Fields{
+			"output": o.Name,
+			"error":  errs[i],
+		})
+		if o.Required {
+			ll.Error("error sending bundle to required output")
+			if rerr == nil {
+				rerr = errs[i]
+			}
+		} else {
+			ll.Warning("error sending bundle to best-effort output")
+		}
+	}
+	if rerr != nil {
+		return rerr
+	}
+	if err := g.rejectRecords(dls, info); err != nil {
+		return err
+	}
+	if g.Dedup != nil {
+		g.Dedup.Add(keys)
+	}
+	return nil
+}
+
+// rejectRecords quarantines rejected records dls in the dead letters, or
+// logs and drops them, according to the acceptance policy.
+func (g *GraccCollector) rejectRecords(dls []DeadLetter, info BundleInfo) error {
+	if len(dls) == 0 {
+		return nil
+	}
+	if g.Config.AcceptPolicy() == "quarantine-invalid" {
+		if err := g.DeadLetters.Send(dls, info); err != nil {
+			log.WithField("error", err).Error("error sending dead letters")
+			return err
+		}
+		return nil
+	}
+	for _, dl := range dls {
+		log.WithFields(log.Fields{
+			"from":   info.From,
+			"type":   dl.Type,
+			"index":  dl.Index,
+			"output": dl.Output,
+			"error":  dl.Error,
+		}).Warning("skipping invalid record")
+	}
+	return nil
+}
+
+// sendToOutput publishes records recs to output o, and returns any records
+// that the output rejected. If the output is unavailable and the spool is
+// enabled, the bundle is written to the spool instead, to be forwarded once
+// the output returns.
+func (g *GraccCollector) sendToOutput(o *OutputSink, recs []gracc.Record, info BundleInfo) ([]DeadLetter, error) {
+	rejected, err := g.publishBundle(o.Output, recs, info)
+	if isUnavailable(err) && o.Spool != nil {
+		log.WithFields(log.Fields{
+			"output": o.Name,
+			"error":  err,
+		}).Warning("unable to send bundle, spooling")
+		return nil, o.Spool.Store(recs, info)
+	}
+	for i := range rejected {
+		rejected[i].Output = o.Name
+	}
+	return rejected, err
+}
+
+// publishBundle publishes records recs to Output out and waits for
+// confirmation. Unless the acceptance policy is strict, records that the
+// output rejects as invalid are returned, rather than failing the bundle.
+func (g *GraccCollector) publishBundle(out Output, recs []gracc.Record, info BundleInfo) ([]DeadLetter, error) {
+	strict := g.Config.AcceptPolicy() == "strict"
+	w, err := out.NewWorker(len(recs), info)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	var rejected []DeadLetter
+	published := make([]gracc.Record, 0, len(recs))
+	for _, rec := range recs {
 		if err := w.PublishRecord(rec); err != nil {
 			g.Events <- RECORD_ERROR
-			npub -= 1
-			return err
+			switch err.(type) {
+			case RecordError, RejectedError:
+				if !strict {
+					rejected = append(rejected, rejectedDeadLetter(rec, err.Error()))
+					continue
+				}
+			}
+			return nil, err
 		}
+		published = append(published, rec)
 	}
-	if npub > 0 {
+	if len(published) > 0 {
 		// wait for confirms that all records were received and routed
 		if err := w.Wait(g.Config.TimeoutDuration); err != nil {
-			return err
+			rerr, ok := err.(RejectedError)
+			if !ok || strict {
+				return nil, err
+			}
+			for j, i := range rerr.Records {
+				if i < 0 || i >= len(published) {
+					// can't tell which record was rejected
+					return nil, err
+				}
+				g.Events <- RECORD_ERROR
+				rejected = append(rejected, rejectedDeadLetter(published[i], rerr.Reasons[j]))
+			}
 		}
 	}
-	return nil
+	return rejected, nil
+}
+
+// isUnavailable returns true if err indicates that an output is
+// temporarily unable to accept records.
+func isUnavailable(err error) bool {
+	switch err.(type) {
+	case AMQPError, OutputError:
+		return true
+	}
+	return false
 }
 
 func (g *GraccCollector) handleError(req *Request, err error) {
 	var msg string
 	var code int
 	switch err.(type) {
-	case AMQPError:
+	case AMQPError, OutputError, SpoolError:
 		code = 503
 		msg = "Service unavailable right now"
 	case RequestError:
 		code = 400
 		msg = fmt.Sprintf("Error handling request: %s", err)
-	case RecordError:
+	case RecordError, RejectedError:
 		code = 400
 		msg = fmt.Sprintf("Error processing record: %s", err)
 	default:
@@ -401,36 +680,3 @@ func (g *GraccCollector) handleSuccess(req *Request) {
 	}).Info("handled request")
 	fmt.Fprintf(req.w, "OK")
 }
-
-// ScanBundle is a split function for bufio.Scanner that splits the bundle
-// at each pipe/bar character "|" that does not occur in a double-
-// quote delimited string.
-func ScanBundle(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	inString := false
-	escape := false
-	var stringDelim rune
-	for width, i := 0, 0; i < len(data); i += width {
-		var r rune
-		r, width = utf8.DecodeRune(data[i:])
-		switch r {
-		case '|':
-			if !inString {
-				return i + width, data[0:i], nil
-			}
-		case '"':
-			if inString && !escape && r == stringDelim {
-				inString = false
-			} else if !inString {
-				inString = true
-				stringDelim = r
-			}
-		}
-		escape = (r == '\\' && !escape)
-	}
-	// If we're at EOF, we have a final, non-terminated bundle. Return it.
-	if atEOF {
-		return len(data), data, bufio.ErrFinalToken
-	}
-	// Request more data.
-	return 0, nil, nil
-}
@@ -34,6 +34,10 @@ var (
 			Retry:        "1s",
 			MaxRetry:     "10s",
 		},
+		// nothing is bound to the ProbeDetails exchange
+		ProbeDetails: ProbeDetailsConfig{
+			Exchange: "gracc.test.probedetails",
+		},
 		StartBufferSize: 4096,
 		MaxBufferSize:   512 * 1024,
 	}
@@ -165,6 +169,32 @@ func TestMultiUpdate(t *testing.T) {
 	}
 }
 
+func TestProbeDetailsUnbound(t *testing.T) {
+	testURL := "http://" + config.Address + ":" + config.Port + "/rmi"
+	v := url.Values{}
+	v.Set("command", "multiupdate")
+	v.Set("from", "localhost")
+	v.Set("arg1", `<RecordEnvelope>
+<ProbeDetails>
+<ProbeName>condor:test.example.com</ProbeName>
+<Reporter version="1.16.3">condor_meter</Reporter>
+</ProbeDetails>
+<JobUsageRecord>
+<RecordIdentity recordId="test.example.com:1"/>
+<ProbeName>condor:test.example.com</ProbeName>
+</JobUsageRecord>
+</RecordEnvelope>`)
+	resp, err := http.PostForm(testURL, v)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Error(fmt.Errorf("multiupdate with ProbeDetails got response %s", resp.Status))
+		}
+	}
+}
+
 // Load test data
 var (
 	testBundleSize int
@@ -12,14 +12,23 @@ import (
 )
 
 type CollectorConfig struct {
-	Address         string        `env:"GRACC_ADDRESS"`
-	Port            string        `env:"GRACC_PORT"`
-	Timeout         string        `env:"GRACC_TIMEOUT"`
-	TimeoutDuration time.Duration `env:"-"`
-	LogLevel        string        `env:"GRACC_LOGLEVEL"`
-	AMQP            AMQPConfig    `env:"GRACC_AMQP_"`
-	StartBufferSize int           `env:"GRACC_STARTBUFFERSIZE"`
-	MaxBufferSize   int           `env:"GRACC_MAXBUFFERSIZE"`
+	Address         string             `env:"GRACC_ADDRESS"`
+	Port            string             `env:"GRACC_PORT"`
+	Timeout         string             `env:"GRACC_TIMEOUT"`
+	TimeoutDuration time.Duration      `env:"-"`
+	LogLevel        string             `env:"GRACC_LOGLEVEL"`
+	Accept          string             `env:"GRACC_ACCEPT"`
+	Generic         bool               `env:"GRACC_GENERIC"`
+	AMQP            AMQPConfig         `env:"GRACC_AMQP_"`
+	Spool           SpoolConfig        `env:"GRACC_SPOOL_"`
+	Dedup           DedupConfig        `env:"GRACC_DEDUP_"`
+	DeadLetter      DeadLetterConfig   `env:"GRACC_DEADLETTER_"`
+	ProbeDetails    ProbeDetailsConfig `env:"GRACC_PROBEDETAILS_"`
+	APEL            APELConfig         `env:"GRACC_APEL_"`
+	Outputs         []OutputConfig     `env:"-"`
+	Routes          []RouteConfig      `env:"-"`
+	StartBufferSize int                `env:"GRACC_STARTBUFFERSIZE"`
+	MaxBufferSize   int                `env:"GRACC_MAXBUFFERSIZE"`
 }
 
 func DefaultConfig() *CollectorConfig {
@@ -41,9 +50,29 @@ func DefaultConfig() *CollectorConfig {
 			AutoDelete:   true,
 			Internal:     false,
 			RoutingKey:   "",
+			DeliveryMode: "",
+			MessageId:    "id",
 			Retry:        "1s",
 			MaxRetry:     "1h",
 		},
+		Spool: SpoolConfig{
+			Dir:     "",
+			MaxSize: 1024 * 1024 * 1024,
+			MaxAge:  "168h",
+			Retry:   "10s",
+		},
+		ProbeDetails: ProbeDetailsConfig{
+			Exchange: "gracc.probedetails",
+		},
+		APEL: APELConfig{
+			ServiceLevelType: "HEPSPEC",
+		},
+		Dedup: DedupConfig{
+			File:   "",
+			Window: "24h",
+			Key:    "identity",
+			Policy: "drop",
+		},
 		StartBufferSize: 4096,
 		MaxBufferSize:   512 * 1024,
 	}
@@ -61,7 +90,88 @@ func (c *CollectorConfig) Validate() error {
 	if err != nil {
 		return fmt.Errorf("error parsing Timeout: %s", err)
 	}
-	return c.AMQP.Validate()
+	if err := c.AMQP.Validate(); err != nil {
+		return err
+	}
+	for i := range c.Routes {
+		if err := c.Routes[i].Validate(); err != nil {
+			return fmt.Errorf("route %d: %s", i+1, err)
+		}
+	}
+	names := make(map[string]bool, len(c.Outputs))
+	for i := range c.Outputs {
+		if err := c.Outputs[i].Validate(); err != nil {
+			return err
+		}
+		if names[c.Outputs[i].Name] {
+			return fmt.Errorf("duplicate output name \"%s\"", c.Outputs[i].Name)
+		}
+		names[c.Outputs[i].Name] = true
+	}
+	if err := c.Dedup.Validate(); err != nil {
+		return err
+	}
+	if err := c.DeadLetter.Validate(); err != nil {
+		return err
+	}
+	if _, err := parseRoutingKey(c.ProbeDetails.RoutingKey); err != nil {
+		return fmt.Errorf("ProbeDetails: %s", err)
+	}
+	if err := c.APEL.Validate(); err != nil {
+		return err
+	}
+	switch c.Accept {
+	case "", "strict", "skip-invalid":
+	case "quarantine-invalid":
+		if !c.DeadLetter.Enabled() {
+			return fmt.Errorf("quarantine-invalid Accept policy requires a DeadLetter exchange or dir")
+		}
+	default:
+		return fmt.Errorf("unknown Accept policy \"%s\"", c.Accept)
+	}
+	return c.Spool.Validate()
+}
+
+// AcceptPolicy returns the policy for bundles containing invalid records:
+// "strict" rejects the whole bundle, "skip-invalid" drops the invalid records
+// and "quarantine-invalid" sends them to the dead letters. If not set it is
+// quarantine-invalid if dead letters are configured, otherwise strict.
+func (c *CollectorConfig) AcceptPolicy() string {
+	if c.Accept != "" {
+		return c.Accept
+	}
+	if c.DeadLetter.Enabled() {
+		return "quarantine-invalid"
+	}
+	return "strict"
+}
+
+// OutputConfigs returns the configured outputs, with the routes applied
+// to AMQP outputs. If none are configured then the AMQP section is used as
+// the only, required, output. With the dedup route policy, the route for
+// duplicates comes before any others, followed by the route for
+// ProbeDetails.
+func (c *CollectorConfig) OutputConfigs() []OutputConfig {
+	var oc []OutputConfig
+	if len(c.Outputs) > 0 {
+		oc = append(oc, c.Outputs...)
+	} else {
+		oc = []OutputConfig{{
+			Name:     "amqp",
+			Type:     "amqp",
+			Required: true,
+			AMQP:     c.AMQP,
+		}}
+	}
+	routes := append([]RouteConfig{c.ProbeDetails.route()}, c.Routes...)
+	if c.Dedup.Enabled() && c.Dedup.Policy == "route" {
+		routes = append([]RouteConfig{c.Dedup.route()}, routes...)
+	}
+	for i := range oc {
+		oc[i].AMQP.routes = routes
+		oc[i].AMQP.apel = c.APEL
+	}
+	return oc
 }
 
 // ReadConfig reads the configuration from a TOML file.
@@ -2,6 +2,8 @@ package main
 
 import (
 	"testing"
+
+	"github.com/BurntSushi/toml"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -10,3 +12,46 @@ func TestDefaultConfig(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestOutputsConfig(t *testing.T) {
+	conf := DefaultConfig()
+	if oc := conf.OutputConfigs(); len(oc) != 1 || oc[0].Type != "amqp" || !oc[0].Required {
+		t.Errorf("expected AMQP section as only required output, got %v", oc)
+	}
+
+	if _, err := toml.Decode(`
+[[Outputs]]
+name = "primary"
+type = "amqp"
+required = true
+[Outputs.AMQP]
+host = "rabbit1"
+exchange = "gracc.osg.raw"
+
+[[Outputs]]
+name = "secondary"
+type = "amqp"
+[Outputs.AMQP]
+host = "rabbit2"
+`, conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	oc := conf.OutputConfigs()
+	if len(oc) != 2 {
+		t.Fatalf("expected 2 outputs, got %d", len(oc))
+	}
+	if !oc[0].Required || oc[1].Required {
+		t.Errorf("expected only first output to be required")
+	}
+	if oc[1].AMQP.Host != "rabbit2" || oc[1].AMQP.Port != "5672" || oc[1].AMQP.Exchange != "gracc" {
+		t.Errorf("defaults not applied to output AMQP config: %v", oc[1].AMQP)
+	}
+
+	conf.Outputs[1].Name = "primary"
+	if err := conf.Validate(); err == nil {
+		t.Error("expected error for duplicate output name")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+// runConvert implements the convert subcommand, which reads Gratia XML
+// records from files (or stdin) and writes them to stdout in another format,
+// one record per line, or in APEL format, as APEL individual job messages of
+// up to apelBatchSize records. Each input may contain records, RecordEnvelope
+// bundles, a replication bundle, or JSON raw records (as stored in
+// Elasticsearch), which are converted back into records. Errors are reported for each record on
+// stderr, and the exit status is non-zero if there were any. With -schema,
+// it writes the JSON schema of a registered record type instead.
+func runConvert(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	format := fs.String("format", "json", "output format: json, raw, xml, or apel")
+	maxBuffer := fs.Int("maxbuffer", DefaultConfig().MaxBufferSize, "maximum size of a record in a replication bundle")
+	schema := fs.String("schema", "", "write the JSON schema of a registered record type, instead of converting records")
+	apelConf := DefaultConfig().APEL
+	fs.StringVar(&apelConf.ServiceLevelType, "serviceleveltype", apelConf.ServiceLevelType, "APEL ServiceLevelType of records without a ServiceLevel: HEPSPEC or si2k")
+	fs.StringVar(&apelConf.ServiceLevel, "servicelevel", apelConf.ServiceLevel, "APEL ServiceLevel of records without one")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: gracc-collector convert [-format json|raw|xml|apel] [-servicelevel n] [file ...]\n")
+		fmt.Fprintf(stderr, "       gracc-collector convert -schema type\n\n")
+		fmt.Fprintf(stderr, "Reads Gratia XML records, RecordEnvelope bundles, replication bundles, or\n")
+		fmt.Fprintf(stderr, "JSON raw records from files, or stdin if none are given or \"-\", and writes\n")
+		fmt.Fprintf(stderr, "one record per line, or APEL individual job messages.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *schema != "" {
+		b, err := gracc.RecordTypeSchema(*schema)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+			return 1
+		}
+		stdout.Write(b)
+		return 0
+	}
+	switch *format {
+	case "json", "raw", "xml", "apel":
+	default:
+		fmt.Fprintf(stderr, "unknown format \"%s\"\n", *format)
+		return 2
+	}
+	if err := apelConf.Validate(); err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return 2
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	out := bufio.NewWriter(stdout)
+	defer out.Flush()
+	var nrec, nerr int
+	// encoded records to write in the next APEL message
+	var apel [][]byte
+	writeAPEL := func() {
+		if len(apel) == 0 {
+			return
+		}
+		out.Write(apelMessage(apel))
+		apel = nil
+	}
+	for _, name := range files {
+		var data []byte
+		var err error
+		if name == "-" {
+			name = "<stdin>"
+			data, err = ioutil.ReadAll(stdin)
+		} else {
+			data, err = ioutil.ReadFile(name)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %s\n", name, err)
+			nerr++
+			continue
+		}
+		inputs, err := splitConvertInput(data, *maxBuffer)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %s\n", name, err)
+			nerr++
+		}
+		for i, x := range inputs {
+			nrec++
+			if *format == "apel" {
+				var r []byte
+				rec, err := parseConvertRecord(x)
+				if err == nil {
+					r, err = encodeAPELRecord(rec, apelConf)
+				}
+				if err != nil {
+					fmt.Fprintf(stderr, "%s: record %d: %s\n", name, i+1, err)
+					nerr++
+					continue
+				}
+				if apel = append(apel, r); len(apel) == apelBatchSize {
+					writeAPEL()
+				}
+				continue
+			}
+			b, err := convertRecord(x, *format)
+			if err != nil {
+				fmt.Fprintf(stderr, "%s: record %d: %s\n", name, i+1, err)
+				nerr++
+				continue
+			}
+			out.Write(b)
+			out.WriteByte('\n')
+		}
+	}
+	writeAPEL()
+	out.Flush()
+	fmt.Fprintf(stderr, "converted %d of %d records, %d errors\n", nrec-nerr, nrec, nerr)
+	if nerr > 0 {
+		return 1
+	}
+	return 0
+}
+
+// convertRecord parses record XML, or a JSON raw record, x and encodes it in
+// format on one line.
+func convertRecord(x []byte, format string) ([]byte, error) {
+	rec, err := parseConvertRecord(x)
+	if err != nil {
+		return nil, err
+	}
+	b, _, err := encodeRecord(rec, format, "")
+	if err != nil {
+		return nil, err
+	}
+	if format != "json" {
+		b = oneLineXML(b)
+	}
+	return b, nil
+}
+
+// parseConvertRecord parses record XML, or a JSON raw record, x.
+func parseConvertRecord(x []byte) (gracc.Record, error) {
+	if bytes.HasPrefix(x, []byte("{")) {
+		return gracc.RecordFromJSON(x)
+	}
+	return gracc.ParseRecordXML(x)
+}
+
+// splitConvertInput splits data into records. data may be a replication
+// bundle, XML containing records, RecordEnvelope bundles and StorageUsageRecords
+// documents, or a sequence of JSON raw records. If there is an error partway through, the records
+// read so far are returned with it.
+func splitConvertInput(data []byte, maxBuffer int) ([][]byte, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var inputs [][]byte
+		d := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var j json.RawMessage
+			if err := d.Decode(&j); err == io.EOF {
+				break
+			} else if err != nil {
+				return inputs, fmt.Errorf("error parsing JSON: %s", err)
+			}
+			inputs = append(inputs, j)
+		}
+		return inputs, nil
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("replication|")) {
+		rrs, err := gracc.ScanReplicationBundle(bytes.NewReader(data), 4096, maxBuffer)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing replication bundle: %s", err)
+		}
+		var inputs [][]byte
+		for _, rr := range rrs {
+			inputs = appendRecordXML(inputs, []byte(rr.Rec))
+		}
+		return inputs, nil
+	}
+	var inputs [][]byte
+	d := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for {
+		start := d.InputOffset()
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return inputs, fmt.Errorf("error parsing XML: %s", err)
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if depth == 0 && t.Name.Local == "RecordEnvelope" {
+				depth++
+				continue
+			}
+			if err := d.Skip(); err != nil {
+				return inputs, fmt.Errorf("error parsing XML: %s", err)
+			}
+			inputs = appendRecordXML(inputs, data[start:d.InputOffset()])
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return inputs, nil
+}
+
+// appendRecordXML appends the records in record XML x to inputs: x itself,
+// or each of the records in a StorageUsageRecords document (see
+// gracc.SplitRecordXML). If x can't be split, it is appended as is, so that
+// the error is reported when it is parsed.
+func appendRecordXML(inputs [][]byte, x []byte) [][]byte {
+	xs, err := gracc.SplitRecordXML(x)
+	if err != nil {
+		return append(inputs, x)
+	}
+	return append(inputs, xs...)
+}
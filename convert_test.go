@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+// starDoc is an EMI StAR StorageUsageRecords document of two records.
+const starDoc = `<sr:StorageUsageRecords xmlns:sr="http://eu-emi.eu/namespaces/2011/02/storagerecord">
+<sr:StorageUsageRecord><sr:RecordIdentity sr:recordId="sr1"/><sr:StorageSystem>se1</sr:StorageSystem></sr:StorageUsageRecord>
+<sr:StorageUsageRecord><sr:RecordIdentity sr:recordId="sr2"/><sr:StorageSystem>se1</sr:StorageSystem></sr:StorageUsageRecord>
+</sr:StorageUsageRecords>`
+
+func TestConvert(t *testing.T) {
+	for _, ct := range []struct {
+		input  string
+		format string
+		lines  int
+		status int
+	}{
+		{testBundleXML, "json", 11, 0},
+		{testBundle, "json", 15, 0},
+		{testBundle, "raw", 15, 0},
+		{testBundle, "xml", 15, 0},
+		{`<JobUsageRecord><RecordIdentity recordId="r1"/></JobUsageRecord>
+<JobUsageRecord><RecordIdentity recordId="r2"/></JobUsageRecord>
+<Bogus/>`, "json", 2, 1},
+		{`<RecordEnvelope><JobUsageRecord>`, "json", 0, 1},
+		{`{"type":"JobUsageRecord","RecordId":"r1","WallDuration":60}
+{"type":"StorageElementRecord","UniqueID":"u1","TotalSpace":100}`, "xml", 2, 0},
+		{`{"type":"Bogus"}`, "json", 0, 1},
+		{starDoc, "json", 2, 0},
+		{"replication|" + starDoc + "|||", "json", 2, 0},
+		{"<RecordEnvelope>" + starDoc + "</RecordEnvelope>", "json", 2, 0},
+	} {
+		var stdout, stderr bytes.Buffer
+		status := runConvert([]string{"-format", ct.format}, strings.NewReader(ct.input), &stdout, &stderr)
+		if status != ct.status {
+			t.Errorf("expected status %d, got %d: %s", ct.status, status, stderr.String())
+		}
+		lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+		if stdout.Len() == 0 {
+			lines = nil
+		}
+		if len(lines) != ct.lines {
+			t.Errorf("expected %d lines, got %d", ct.lines, len(lines))
+		}
+		if ct.format != "json" {
+			continue
+		}
+		for _, l := range lines {
+			var r map[string]interface{}
+			if err := json.Unmarshal([]byte(l), &r); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestConvertXML(t *testing.T) {
+	for _, ct := range []struct {
+		input  string
+		output string
+	}{
+		{`<JobUsageRecord xmlns:urwg="http://www.gridforum.org/2003/ur-wg"><RecordIdentity urwg:recordId="r1"/><WallDuration>PT1M</WallDuration></JobUsageRecord>`,
+			`<JobUsageRecord xmlns="http://www.gridforum.org/2003/ur-wg" xmlns:urwg="http://www.gridforum.org/2003/ur-wg"><RecordIdentity urwg:recordId="r1"></RecordIdentity><WallDuration>PT1M</WallDuration></JobUsageRecord>`},
+		{`<ur:JobUsageRecord xmlns:ur="http://www.gridforum.org/2003/ur-wg"><ur:RecordIdentity ur:recordId="r2"/></ur:JobUsageRecord>`,
+			`<JobUsageRecord xmlns="http://www.gridforum.org/2003/ur-wg" xmlns:urwg="http://www.gridforum.org/2003/ur-wg"><RecordIdentity urwg:recordId="r2"></RecordIdentity></JobUsageRecord>`},
+	} {
+		var stdout, stderr bytes.Buffer
+		if status := runConvert([]string{"-format", "xml"}, strings.NewReader(ct.input), &stdout, &stderr); status != 0 {
+			t.Fatalf("expected status 0, got %d: %s", status, stderr.String())
+		}
+		if out := strings.TrimSuffix(stdout.String(), "\n"); out != ct.output {
+			t.Errorf("expected %s, got %s", ct.output, out)
+		}
+	}
+}
+
+func TestConvertSchema(t *testing.T) {
+	if _, ok := gracc.LookupRecordType("SchemaTestRecord"); !ok {
+		gracc.RegisterRecordType(gracc.RecordType{
+			Names:  []string{"SchemaTestRecord"},
+			New:    func() gracc.ParsableRecord { return &gracc.GenericRecord{} },
+			Schema: []byte(`{"type": "object"}`),
+		})
+	}
+	var stdout, stderr bytes.Buffer
+	if status := runConvert([]string{"-schema", "SchemaTestRecord"}, strings.NewReader(""), &stdout, &stderr); status != 0 {
+		t.Fatalf("expected status 0, got %d: %s", status, stderr.String())
+	}
+	if stdout.String() != `{"type": "object"}` {
+		t.Errorf("expected schema, got %s", stdout.String())
+	}
+	stdout.Reset()
+	if status := runConvert([]string{"-schema", "Bogus"}, strings.NewReader(""), &stdout, &stderr); status != 1 || stdout.Len() != 0 {
+		t.Errorf("expected status 1 and no output for unknown type, got %d: %s", status, stdout.String())
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opensciencegrid/gracc-collector/gracc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/streadway/amqp"
+)
+
+type DeadLetterConfig struct {
+	Exchange   string `env:"EXCHANGE"`
+	RoutingKey string `env:"ROUTINGKEY"`
+	Dir        string `env:"DIR"`
+}
+
+// Enabled returns true if a dead letter exchange or directory has been
+// configured.
+func (c *DeadLetterConfig) Enabled() bool {
+	return c.Exchange != "" || c.Dir != ""
+}
+
+func (c *DeadLetterConfig) Validate() error {
+	if c.Exchange != "" && c.Dir != "" {
+		return fmt.Errorf("only one of DeadLetter Exchange and Dir may be set")
+	}
+	return nil
+}
+
+// DeadLetter is a record that was rejected, with the reason and the
+// context it was received in.
+type DeadLetter struct {
+	RawXML string
+	Type   string `json:",omitempty"`
+	Error  string
+	// Output is the output that rejected the record, if any.
+	Output     string `json:",omitempty"`
+	From       string
+	RemoteAddr string
+	Received   time.Time
+	// Command is the command of the request the record was received in.
+	Command string
+	// BundleSize is the number of records the sender said were in the bundle.
+	BundleSize int `json:",omitempty"`
+	// Index is the position of the record in the bundle, starting from 1,
+	// if known.
+	Index int `json:",omitempty"`
+	// Raw and Extra are the other parts of a replicated record.
+	Raw   string `json:",omitempty"`
+	Extra string `json:",omitempty"`
+}
+
+// otherDeadLetter returns a dead letter for a record of unrecognized type.
+func otherDeadLetter(r gracc.XMLRecord) DeadLetter {
+	return DeadLetter{
+		RawXML: string(r.Raw()),
+		Type:   r.XMLName.Local,
+		Error:  "unrecognized record type",
+	}
+}
+
+// invalidDeadLetter returns a dead letter for a record that couldn't be
+// unmarshalled.
+func invalidDeadLetter(r gracc.InvalidRecord) DeadLetter {
+	return DeadLetter{
+		RawXML: string(r.Raw()),
+		Type:   r.XMLName.Local,
+		Error:  r.Err.Error(),
+	}
+}
+
+// rejectedDeadLetter returns a dead letter for record rec, which was
+// rejected for reason.
+func rejectedDeadLetter(rec gracc.Record, reason string) DeadLetter {
+	return DeadLetter{
+		RawXML: string(rec.Raw()),
+		Type:   rec.Type(),
+		Error:  reason,
+	}
+}
+
+// DeadLetters publishes rejected records, as JSON, to an AMQP exchange or
+// writes them to files in a directory, so that they can be inspected and
+// possibly fixed and resent, rather than only being logged.
+type DeadLetters struct {
+	Config  DeadLetterConfig
+	Timeout time.Duration
+
+	output *AMQPOutput
+	m      sync.Mutex
+	seq    int
+	count  uint64
+
+	DeadLetterCountDesc *prometheus.Desc
+}
+
+// NewDeadLetters initializes the dead letter destination. The exchange is
+// declared on the broker configured by amqpConf.
+func NewDeadLetters(conf DeadLetterConfig, amqpConf AMQPConfig, timeout time.Duration) (*DeadLetters, error) {
+	d := &DeadLetters{
+		Config:  conf,
+		Timeout: timeout,
+	}
+	d.DeadLetterCountDesc = prometheus.NewDesc(
+		"gracc_dead_letters_total",
+		"Number of rejected records sent to the dead letter exchange or directory.",
+		nil,
+		nil,
+	)
+	if conf.Dir != "" {
+		if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	amqpConf.Exchange = conf.Exchange
+	amqpConf.RoutingKey = ""
+	amqpConf.routes = nil
+	var err error
+	if d.output, err = InitAMQP(amqpConf); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Send sends dead letters dls, filling in the bundle context from info.
+// An error is returned if they could not all be sent, in which case the
+// bundle should be rejected so the sender will retry.
+func (d *DeadLetters) Send(dls []DeadLetter, info BundleInfo) error {
+	if len(dls) == 0 {
+		return nil
+	}
+	bodies := make([][]byte, len(dls))
+	for i := range dls {
+		dls[i].From = info.From
+		dls[i].RemoteAddr = info.RemoteAddr
+		dls[i].Received = info.Received
+		dls[i].Command = info.Command
+		dls[i].BundleSize = info.BundleSize
+		j, err := json.MarshalIndent(dls[i], "", "    ")
+		if err != nil {
+			return NewOutputError(fmt.Sprintf("error encoding dead letter: %s", err))
+		}
+		bodies[i] = j
+		log.WithFields(log.Fields{
+			"from":   info.From,
+			"type":   dls[i].Type,
+			"index":  dls[i].Index,
+			"output": dls[i].Output,
+			"error":  dls[i].Error,
+		}).Warning("sending rejected record to dead letters")
+	}
+	var err error
+	if d.output != nil {
+		err = d.publish(bodies)
+	} else {
+		err = d.write(bodies)
+	}
+	if err != nil {
+		return err
+	}
+	d.m.Lock()
+	d.count += uint64(len(dls))
+	d.m.Unlock()
+	return nil
+}
+
+// publish publishes bodies to the dead letter exchange and waits for
+// confirmation.
+func (d *DeadLetters) publish(bodies [][]byte) error {
+	ll := log.WithField("where", "DeadLetters.publish")
+	ch, err := d.output.OpenChannel()
+	if err != nil {
+		ll.Error(err)
+		return NewAMQPError("error opening dead letter channel")
+	}
+	defer ch.Close()
+	if err := ch.Confirm(false); err != nil {
+		ll.Error(err)
+		return NewAMQPError("dead letter channel could not be put into confirm mode")
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, len(bodies)))
+	now := time.Now()
+	for _, b := range bodies {
+		if err := ch.Publish(d.Config.Exchange, d.Config.RoutingKey, false, false, amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: d.output.Config.deliveryMode(),
+			Timestamp:    now,
+			Type:         "DeadLetter",
+			AppId:        "gracc-collector/" + build_ver,
+			Body:         b,
+		}); err != nil {
+			ll.Error(err)
+			return NewAMQPError("error publishing dead letter")
+		}
+	}
+	var tc <-chan time.Time
+	if d.Timeout > 0 {
+		tc = time.After(d.Timeout)
+	}
+	for range bodies {
+		select {
+		case c, ok := <-confirms:
+			if !ok {
+				return NewAMQPError("dead letter channel closed while waiting for confirms")
+			}
+			if !c.Ack {
+				return NewAMQPError("dead letter was not successfully sent")
+			}
+		case <-tc:
+			return NewAMQPError("timed out while waiting for dead letter confirms")
+		}
+	}
+	return nil
+}
+
+// write writes each of bodies to its own file in the dead letter directory.
+func (d *DeadLetters) write(bodies [][]byte) error {
+	now := time.Now()
+	for _, b := range bodies {
+		d.m.Lock()
+		d.seq++
+		name := filepath.Join(d.Config.Dir, fmt.Sprintf("%020d-%06d.json", now.UnixNano(), d.seq%1000000))
+		d.m.Unlock()
+		if err := writeFileSync(name, b); err != nil {
+			log.WithFields(log.Fields{
+				"file":  name,
+				"error": err,
+			}).Error("error writing dead letter")
+			return NewOutputError("error writing dead letter")
+		}
+	}
+	return nil
+}
+
+// Close closes the connection to the dead letter exchange, if any.
+func (d *DeadLetters) Close() error {
+	if d.output != nil {
+		return d.output.Close()
+	}
+	return nil
+}
+
+func (d *DeadLetters) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.DeadLetterCountDesc
+}
+
+func (d *DeadLetters) Collect(ch chan<- prometheus.Metric) {
+	d.m.Lock()
+	ch <- prometheus.MustNewConstMetric(
+		d.DeadLetterCountDesc,
+		prometheus.CounterValue,
+		float64(d.count),
+	)
+	d.m.Unlock()
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+func TestDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gracc-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := &GraccCollector{
+		Config: DefaultConfig(),
+		Events: make(chan Event),
+	}
+	go func() {
+		for range g.Events {
+		}
+	}()
+	defer close(g.Events)
+
+	bundle := "replication|<JobUsageRecord><RecordIdentity></JobUsageRecord>|<raw/>||" + testBundle
+	if _, _, err := g.processBundle(bundle); err == nil {
+		t.Error("expected error processing bundle without dead letters")
+	}
+
+	g.Config.DeadLetter.Dir = dir
+	if g.DeadLetters, err = NewDeadLetters(g.Config.DeadLetter, AMQPConfig{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	bun, dls, err := g.processBundle(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bun.RecordCount(); n != 15 {
+		t.Errorf("expected 15 good records, got %d", n)
+	}
+	if len(dls) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(dls))
+	}
+	info := BundleInfo{
+		From:       "test",
+		RemoteAddr: "192.0.2.1:4321",
+		Received:   time.Now(),
+		Command:    "update",
+		BundleSize: 16,
+	}
+	if err := g.sendBundle(bun, info, dls); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("expected 1 dead letter file, got %d", len(names))
+	}
+	b, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dl DeadLetter
+	if err := json.Unmarshal(b, &dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.RawXML != "<JobUsageRecord><RecordIdentity></JobUsageRecord>" || dl.Raw != "<raw/>" {
+		t.Errorf("unexpected record in dead letter: %+v", dl)
+	}
+	if dl.Error == "" || dl.From != "test" || dl.RemoteAddr != info.RemoteAddr ||
+		dl.Command != "update" || dl.BundleSize != 16 || dl.Index != 1 {
+		t.Errorf("unexpected context in dead letter: %+v", dl)
+	}
+	if g.DeadLetters.count != 1 {
+		t.Errorf("expected 1 dead letter counted, got %d", g.DeadLetters.count)
+	}
+}
+
+// rejectOutput is an Output that rejects records with id badId when they are
+// published, and the record at position waitReject in Wait.
+type rejectOutput struct {
+	badId      string
+	invalidId  string
+	waitReject int
+	sent       []string
+}
+
+func (o *rejectOutput) NewWorker(bundleSize int, info BundleInfo) (Worker, error) {
+	return &rejectWorker{output: o}, nil
+}
+
+func (o *rejectOutput) Close() error {
+	return nil
+}
+
+type rejectWorker struct {
+	output *rejectOutput
+	recs   []gracc.Record
+}
+
+func (w *rejectWorker) PublishRecord(rec gracc.Record) error {
+	if rec.Id() == w.output.badId {
+		return NewRecordError("bad record")
+	}
+	if rec.Id() == w.output.invalidId {
+		return RejectedError{Message: "invalid record"}
+	}
+	w.recs = append(w.recs, rec)
+	return nil
+}
+
+func (w *rejectWorker) Wait(timeout time.Duration) error {
+	var rerr RejectedError
+	for i, rec := range w.recs {
+		if i == w.output.waitReject {
+			rerr.Records = append(rerr.Records, i)
+			rerr.Reasons = append(rerr.Reasons, "rejected")
+			continue
+		}
+		w.output.sent = append(w.output.sent, rec.Id())
+	}
+	if len(rerr.Records) > 0 {
+		rerr.Message = "rejected"
+		return rerr
+	}
+	return nil
+}
+
+func (w *rejectWorker) Close() error {
+	return nil
+}
+
+func TestAcceptPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gracc-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, policy := range []string{"strict", "skip-invalid", "quarantine-invalid"} {
+		out := &rejectOutput{badId: "fermicloud121.fnal.gov:30586.1", waitReject: 2}
+		g := &GraccCollector{
+			Config:  DefaultConfig(),
+			Events:  make(chan Event),
+			Outputs: []*OutputSink{{Name: "test", Required: true, Output: out}},
+		}
+		go func() {
+			for range g.Events {
+			}
+		}()
+		g.Config.Accept = policy
+		g.Config.DeadLetter.Dir = filepath.Join(dir, policy)
+		if err := g.Config.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if g.DeadLetters, err = NewDeadLetters(g.Config.DeadLetter, AMQPConfig{}, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		bundle := "replication|<JobUsageRecord><RecordIdentity></JobUsageRecord>|||" + testBundle
+		bun, dls, err := g.processBundle(bundle)
+		if policy == "strict" {
+			if err == nil {
+				t.Errorf("%s: expected error processing bundle", policy)
+			}
+			if bun, dls, err = g.processBundle(testBundle); err != nil {
+				t.Fatal(err)
+			}
+			if err := g.sendBundle(bun, BundleInfo{}, dls); err == nil {
+				t.Errorf("%s: expected error sending bundle", policy)
+			} else if _, ok := err.(RecordError); !ok {
+				t.Errorf("%s: expected RecordError, got %T: %s", policy, err, err)
+			}
+			close(g.Events)
+			continue
+		} else if err != nil {
+			t.Fatalf("%s: %s", policy, err)
+		}
+		if err := g.sendBundle(bun, BundleInfo{}, dls); err != nil {
+			t.Errorf("%s: %s", policy, err)
+		}
+		// 15 good records, less one rejected when published and one by Wait
+		if len(out.sent) != 13 {
+			t.Errorf("%s: expected 13 records sent, got %d", policy, len(out.sent))
+		}
+		names, _ := filepath.Glob(filepath.Join(g.Config.DeadLetter.Dir, "*.json"))
+		exp := 0
+		if policy == "quarantine-invalid" {
+			exp = 3
+		}
+		if len(names) != exp {
+			t.Errorf("%s: expected %d dead letters, got %d", policy, exp, len(names))
+		}
+		close(g.Events)
+	}
+}
+
+func TestPublishRejectedRecord(t *testing.T) {
+	for _, policy := range []string{"strict", "skip-invalid"} {
+		out := &rejectOutput{invalidId: "fermicloud121.fnal.gov:30586.1", waitReject: -1}
+		g := &GraccCollector{
+			Config:  DefaultConfig(),
+			Events:  make(chan Event),
+			Outputs: []*OutputSink{{Name: "test", Required: true, Output: out}},
+		}
+		go func() {
+			for range g.Events {
+			}
+		}()
+		g.Config.Accept = policy
+		bun, dls, err := g.processBundle(testBundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = g.sendBundle(bun, BundleInfo{}, dls)
+		close(g.Events)
+		if policy == "strict" {
+			if _, ok := err.(RejectedError); !ok {
+				t.Errorf("%s: expected RejectedError, got %v", policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", policy, err)
+		}
+		if len(out.sent) != 14 {
+			t.Errorf("%s: expected 14 records sent, got %d", policy, len(out.sent))
+		}
+	}
+}
+
+func TestGenericRecords(t *testing.T) {
+	out := &rejectOutput{waitReject: -1}
+	g := &GraccCollector{
+		Config:  DefaultConfig(),
+		Events:  make(chan Event),
+		Outputs: []*OutputSink{{Name: "test", Required: true, Output: out}},
+	}
+	go func() {
+		for range g.Events {
+		}
+	}()
+	defer close(g.Events)
+	g.Config.Accept = "skip-invalid"
+	g.Config.Generic = true
+
+	bundle := "replication|<NewRecord><RecordId>new1</RecordId></NewRecord>|||" +
+		"replication|<JobUsageRecord><RecordIdentity></JobUsageRecord>|||"
+	bun, dls, err := g.processBundle(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dls) != 1 {
+		t.Errorf("expected invalid JobUsageRecord to be rejected, got %d dead letters", len(dls))
+	}
+	if n := bun.TypeCounts()["NewRecord"]; n != 1 {
+		t.Fatalf("expected 1 generic record, got %d", n)
+	}
+	if err := g.sendBundle(bun, BundleInfo{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var env gracc.RecordBundle
+	if err := xml.Unmarshal([]byte("<RecordEnvelope><OtherRecord><UniqueID>new2</UniqueID></OtherRecord></RecordEnvelope>"), &env); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.sendBundle(&env, BundleInfo{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.sent) != 2 || out.sent[0] != "new1" || out.sent[1] != "new2" {
+		t.Errorf("expected generic records new1 and new2 sent, got %v", out.sent)
+	}
+}
+
+func TestReplicatedStorageUsageRecords(t *testing.T) {
+	out := &rejectOutput{waitReject: -1}
+	g := &GraccCollector{
+		Config:  DefaultConfig(),
+		Events:  make(chan Event),
+		Outputs: []*OutputSink{{Name: "test", Required: true, Output: out}},
+	}
+	go func() {
+		for range g.Events {
+		}
+	}()
+	defer close(g.Events)
+	g.Config.Accept = "skip-invalid"
+
+	bundle := "replication|" + starDoc + "|||" +
+		`replication|<sr:StorageUsageRecords xmlns:sr="http://eu-emi.eu/namespaces/2011/02/storagerecord"><sr:StorageUsageRecord><sr:RecordIdentity sr:recordId="sr3"/><sr:FileCount>many</sr:FileCount></sr:StorageUsageRecord></sr:StorageUsageRecords>|||` +
+		`replication|<JobUsageRecord><RecordIdentity recordId="r1"/></JobUsageRecord>|||`
+	bun, dls, err := g.processBundle(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dls) != 1 || dls[0].Index != 2 || !strings.HasPrefix(dls[0].RawXML, "<StorageUsageRecord") {
+		t.Errorf("expected invalid StorageUsageRecord to be rejected, got %+v", dls)
+	}
+	if n := bun.TypeCounts(); n["StorageUsageRecord"] != 2 || n["JobUsageRecord"] != 1 {
+		t.Fatalf("expected 2 StorageUsageRecords and 1 JobUsageRecord, got %v", n)
+	}
+	if err := g.sendBundle(bun, BundleInfo{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.sent) != 3 || out.sent[0] != "sr1" || out.sent[1] != "sr2" || out.sent[2] != "r1" {
+		t.Errorf("expected records sr1, sr2 and r1 sent, got %v", out.sent)
+	}
+}
+
+func TestInvalidRecordInEnvelope(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gracc-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := `<RecordEnvelope>
+<JobUsageRecord><RecordIdentity recordId="r1"/><StartTime>2016-02-25T01:37:00Z</StartTime></JobUsageRecord>
+<JobUsageRecord><RecordIdentity recordId="r2"/><StartTime>yesterday</StartTime></JobUsageRecord>
+<JobUsageRecord><RecordIdentity recordId="r3"/></JobUsageRecord>
+</RecordEnvelope>`
+	for _, policy := range []string{"strict", "quarantine-invalid"} {
+		var bun gracc.RecordBundle
+		if err := xml.Unmarshal([]byte(env), &bun); err != nil {
+			t.Fatalf("%s: expected only the invalid record to fail, got %s", policy, err)
+		}
+		if len(bun.InvalidRecords) != 1 || bun.RecordCount() != 3 {
+			t.Fatalf("%s: expected 1 invalid record of 3, got %d of %d", policy, len(bun.InvalidRecords), bun.RecordCount())
+		}
+
+		out := &memOutput{}
+		g := &GraccCollector{
+			Config:  DefaultConfig(),
+			Events:  make(chan Event),
+			Outputs: []*OutputSink{{Name: "test", Required: true, Output: out}},
+		}
+		go func() {
+			for range g.Events {
+			}
+		}()
+		g.Config.Accept = policy
+		g.Config.DeadLetter.Dir = filepath.Join(dir, policy)
+		if g.DeadLetters, err = NewDeadLetters(g.Config.DeadLetter, AMQPConfig{}, 0); err != nil {
+			t.Fatal(err)
+		}
+		err := g.sendBundle(&bun, BundleInfo{}, nil)
+		close(g.Events)
+		if policy == "strict" {
+			if _, ok := err.(RecordError); !ok {
+				t.Errorf("%s: expected RecordError, got %v", policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", policy, err)
+		}
+		if len(out.recs) != 2 {
+			t.Errorf("%s: expected 2 records sent, got %d", policy, len(out.recs))
+		}
+		names, _ := filepath.Glob(filepath.Join(g.Config.DeadLetter.Dir, "*.json"))
+		if len(names) != 1 {
+			t.Fatalf("%s: expected 1 dead letter, got %d", policy, len(names))
+		}
+		b, err := ioutil.ReadFile(names[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dl DeadLetter
+		if err := json.Unmarshal(b, &dl); err != nil {
+			t.Fatal(err)
+		}
+		if dl.Type != "JobUsageRecord" || dl.RawXML != `<JobUsageRecord><RecordIdentity recordId="r2"/><StartTime>yesterday</StartTime></JobUsageRecord>` {
+			t.Errorf("%s: unexpected dead letter %+v", policy, dl)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opensciencegrid/gracc-collector/gracc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type DedupConfig struct {
+	File           string        `env:"FILE"`
+	Window         string        `env:"WINDOW"`
+	WindowDuration time.Duration `env:"-"`
+	Key            string        `env:"KEY"`
+	Policy         string        `env:"POLICY"`
+	Exchange       string        `env:"EXCHANGE"`
+}
+
+// Enabled returns true if a deduplication file has been configured.
+func (c *DedupConfig) Enabled() bool {
+	return c.File != ""
+}
+
+func (c *DedupConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	var err error
+	c.WindowDuration, err = time.ParseDuration(c.Window)
+	if err != nil {
+		return fmt.Errorf("error parsing Dedup Window: %s", err)
+	}
+	switch c.Key {
+	case "identity", "fingerprint":
+	default:
+		return fmt.Errorf("unknown Dedup Key \"%s\"", c.Key)
+	}
+	switch c.Policy {
+	case "drop", "tag":
+	case "route":
+		if c.Exchange == "" {
+			return fmt.Errorf("Dedup Exchange is required for route policy")
+		}
+	default:
+		return fmt.Errorf("unknown Dedup Policy \"%s\"", c.Policy)
+	}
+	return nil
+}
+
+// route returns the route that sends duplicates to the dedup exchange.
+func (c *DedupConfig) route() RouteConfig {
+	return RouteConfig{
+		Fields:   map[string]string{"Duplicate": "true"},
+		Exchange: c.Exchange,
+	}
+}
+
+// Deduper tracks the fingerprints of records that have been sent within
+// a sliding window, so that records that are resent (e.g. when a probe
+// times out waiting for a response) can be detected.
+//
+// Fingerprints are kept in memory and appended to a log file, with the time
+// they were added, so they persist across restarts. The log is compacted
+// when it has grown to twice the number of live fingerprints.
+type Deduper struct {
+	Config DedupConfig
+
+	m          sync.Mutex
+	seen       map[string]time.Time
+	f          *os.File
+	lines      int
+	duplicates uint64
+
+	DuplicateCountDesc *prometheus.Desc
+}
+
+// NewDeduper loads the fingerprints that are still within the window from
+// the dedup file, and opens it for appending new ones.
+func NewDeduper(conf DedupConfig) (*Deduper, error) {
+	d := &Deduper{
+		Config: conf,
+		seen:   make(map[string]time.Time),
+	}
+	d.DuplicateCountDesc = prometheus.NewDesc(
+		"gracc_duplicate_records_total",
+		"Number of duplicate records detected.",
+		[]string{"policy"},
+		nil,
+	)
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	if err := d.compact(); err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"file":         conf.File,
+		"fingerprints": len(d.seen),
+	}).Info("dedup: loaded fingerprints")
+	return d, nil
+}
+
+// load reads the fingerprints from the dedup file, if it exists.
+func (d *Deduper) load() error {
+	f, err := os.Open(d.Config.File)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	cutoff := time.Now().Add(-d.Config.WindowDuration)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), " ", 2)
+		if len(parts) != 2 {
+			// probably a partial line from a crash
+			continue
+		}
+		sec, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if t := time.Unix(sec, 0); t.After(cutoff) {
+			d.seen[parts[1]] = t
+		}
+	}
+	return s.Err()
+}
+
+// compact expires fingerprints that are outside the window, and rewrites
+// the dedup file with the remainder. Must be called with the lock held.
+func (d *Deduper) compact() error {
+	cutoff := time.Now().Add(-d.Config.WindowDuration)
+	tmp := d.Config.File + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for k, t := range d.seen {
+		if t.Before(cutoff) {
+			delete(d.seen, k)
+			continue
+		}
+		fmt.Fprintf(w, "%d %s\n", t.Unix(), k)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, d.Config.File); err != nil {
+		f.Close()
+		return err
+	}
+	if d.f != nil {
+		d.f.Close()
+	}
+	d.f = f
+	d.lines = len(d.seen)
+	return nil
+}
+
+// Filter checks recs for records that have been seen before, or that
+// appear more than once in recs, and applies the policy to them: with "drop"
+// they are removed, with "tag" or "route" the Duplicate field is set. It
+// returns the records to send, and the fingerprints of the new records,
+// which should be passed to Add once the records have been sent.
+func (d *Deduper) Filter(recs []gracc.Record) ([]gracc.Record, []string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	cutoff := time.Now().Add(-d.Config.WindowDuration)
+	out := make([]gracc.Record, 0, len(recs))
+	var keys []string
+	inBundle := make(map[string]bool, len(recs))
+	for _, rec := range recs {
+		k := d.key(rec)
+		if k == "" {
+			out = append(out, rec)
+			continue
+		}
+		t, seen := d.seen[k]
+		if !(seen && t.After(cutoff)) && !inBundle[k] {
+			inBundle[k] = true
+			keys = append(keys, k)
+			out = append(out, rec)
+			continue
+		}
+		d.duplicates++
+		log.WithFields(log.Fields{
+			"type":   rec.Type(),
+			"record": rec.Id(),
+			"policy": d.Config.Policy,
+		}).Debug("dedup: duplicate record")
+		if d.Config.Policy != "drop" {
+			out = append(out, duplicateRecord{rec})
+		}
+	}
+	return out, keys
+}
+
+// Add records fingerprints keys as seen now.
+func (d *Deduper) Add(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	now := time.Now()
+	w := bufio.NewWriter(d.f)
+	for _, k := range keys {
+		d.seen[k] = now
+		fmt.Fprintf(w, "%d %s\n", now.Unix(), k)
+	}
+	d.lines += len(keys)
+	// Losing fingerprints in a crash only means some duplicates might not be
+	// detected, so don't bother syncing.
+	if err := w.Flush(); err != nil {
+		log.WithField("error", err).Error("dedup: error writing fingerprints")
+	}
+	if d.lines > 2*len(d.seen)+1024 {
+		if err := d.compact(); err != nil {
+			log.WithField("error", err).Error("dedup: error compacting fingerprints")
+		}
+	}
+}
+
+func (d *Deduper) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.DuplicateCountDesc
+}
+
+func (d *Deduper) Collect(ch chan<- prometheus.Metric) {
+	d.m.Lock()
+	ch <- prometheus.MustNewConstMetric(
+		d.DuplicateCountDesc,
+		prometheus.CounterValue,
+		float64(d.duplicates),
+		d.Config.Policy,
+	)
+	d.m.Unlock()
+}
+
+// key returns the dedup key of rec, using either its identity or its
+// fingerprint as configured.
+func (d *Deduper) key(rec gracc.Record) string {
+	if d.Config.Key == "fingerprint" {
+		return rec.Type() + ":" + rec.Fingerprint()
+	}
+	return dedupKey(rec)
+}
+
+// dedupKey returns the fingerprint of the identity of rec, or the empty
+// string if it has no identity. Records may provide their identity with an
+// Identity method, as the built-in types do (e.g. a job's RecordId and
+// GlobalJobId); otherwise it is their Id.
+func dedupKey(rec gracc.Record) string {
+	rec = unwrapRecord(rec)
+	id := rec.Id()
+	if r, ok := rec.(interface{ Identity() string }); ok {
+		id = r.Identity()
+	}
+	if id == "" {
+		return ""
+	}
+	h := sha1.Sum([]byte(rec.Type() + "\x00" + id))
+	return hex.EncodeToString(h[:])
+}
+
+// duplicateRecord is a record that has been sent before. Its JSON encoding
+// has the Duplicate field set to true.
+type duplicateRecord struct {
+	gracc.Record
+}
+
+// unwrapRecord returns rec, without its duplicate mark if it has one, for
+// encodings that can't include the mark.
+func unwrapRecord(rec gracc.Record) gracc.Record {
+	if d, ok := rec.(duplicateRecord); ok {
+		return d.Record
+	}
+	return rec
+}
+
+// isDuplicate returns true if rec is marked as a duplicate.
+func isDuplicate(rec gracc.Record) bool {
+	_, ok := rec.(duplicateRecord)
+	return ok
+}
+
+func (d duplicateRecord) ToJSON(indent string) ([]byte, error) {
+	j, err := d.Record.ToJSON("")
+	if err != nil {
+		return nil, err
+	}
+	var r map[string]interface{}
+	if err := json.Unmarshal(j, &r); err != nil {
+		return nil, err
+	}
+	r["Duplicate"] = true
+	if indent != "" {
+		return json.MarshalIndent(r, "", indent)
+	}
+	return json.Marshal(r)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+func testDedupConfig(t *testing.T, policy string) (DedupConfig, func()) {
+	dir, err := ioutil.TempDir("", "gracc-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := DedupConfig{
+		File:     filepath.Join(dir, "dedup"),
+		Window:   "1h",
+		Key:      "identity",
+		Policy:   policy,
+		Exchange: "gracc.dups",
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return conf, func() { os.RemoveAll(dir) }
+}
+
+func TestDedupDrop(t *testing.T) {
+	conf, cleanup := testDedupConfig(t, "drop")
+	defer cleanup()
+
+	var bun gracc.RecordBundle
+	if err := xml.Unmarshal([]byte(testBundleXML), &bun); err != nil {
+		t.Fatal(err)
+	}
+	recs := bundleRecords(&bun)
+	d, err := NewDeduper(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, keys := d.Filter(recs)
+	if len(out) != len(recs) || len(keys) != len(recs) {
+		t.Fatalf("expected %d new records, got %d (%d keys)", len(recs), len(out), len(keys))
+	}
+	// not committed yet, e.g. because the send failed
+	if out, _ = d.Filter(recs); len(out) != len(recs) {
+		t.Fatalf("expected %d records before Add, got %d", len(recs), len(out))
+	}
+	d.Add(keys)
+	if out, _ = d.Filter(recs); len(out) != 0 {
+		t.Errorf("expected all records dropped, got %d", len(out))
+	}
+
+	// fingerprints persist across restarts
+	d, err = NewDeduper(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ = d.Filter(recs); len(out) != 0 {
+		t.Errorf("expected all records dropped after reload, got %d", len(out))
+	}
+	if d.duplicates != uint64(len(recs)) {
+		t.Errorf("expected %d duplicates counted, got %d", len(recs), d.duplicates)
+	}
+}
+
+func TestDedupTag(t *testing.T) {
+	conf, cleanup := testDedupConfig(t, "tag")
+	defer cleanup()
+
+	var bun gracc.RecordBundle
+	if err := xml.Unmarshal([]byte(testBundleXML), &bun); err != nil {
+		t.Fatal(err)
+	}
+	recs := bundleRecords(&bun)
+	d, err := NewDeduper(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same record twice in one bundle
+	out, keys := d.Filter([]gracc.Record{recs[0], recs[0]})
+	if len(out) != 2 || len(keys) != 1 {
+		t.Fatalf("expected 2 records and 1 key, got %d and %d", len(out), len(keys))
+	}
+	for i, dup := range []bool{false, true} {
+		f, err := flattenRecord(out[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := f["Duplicate"]; ok != dup {
+			t.Errorf("record %d: expected Duplicate %v, got %v", i, dup, f["Duplicate"])
+		}
+	}
+	j, err := out[1].ToJSON("    ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f map[string]interface{}
+	if err := json.Unmarshal(j, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f["Duplicate"] != true {
+		t.Errorf("expected Duplicate true, got %v", f["Duplicate"])
+	}
+}
+
+func TestDedupFingerprint(t *testing.T) {
+	conf, cleanup := testDedupConfig(t, "drop")
+	defer cleanup()
+	conf.Key = "fingerprint"
+
+	a, err := gracc.ParseRecordXML([]byte(`<JobUsageRecord><RecordIdentity recordId="r1"/><SiteName>X</SiteName></JobUsageRecord>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := gracc.ParseRecordXML([]byte(`<JobUsageRecord><RecordIdentity recordId="r1"/><SiteName>Y</SiteName></JobUsageRecord>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDeduper(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same identity, different content
+	out, keys := d.Filter([]gracc.Record{a, b, a})
+	if len(out) != 2 || len(keys) != 2 {
+		t.Errorf("expected 2 records and keys, got %d and %d", len(out), len(keys))
+	}
+}
+
+// identityRecord is a record type with its own identity.
+type identityRecord struct {
+	*gracc.GenericRecord
+	identity string
+}
+
+func (r identityRecord) Identity() string {
+	return r.identity
+}
+
+func TestDedupKey(t *testing.T) {
+	parse := func(x string) gracc.Record {
+		rec, err := gracc.ParseRecordXML([]byte(x))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+	generic := func(x string) *gracc.GenericRecord {
+		gr, err := gracc.ParseGenericRecordXML([]byte(x))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gr
+	}
+	jur1 := parse(`<JobUsageRecord><RecordIdentity recordId="r1"/><JobIdentity><GlobalJobId>g1</GlobalJobId></JobIdentity></JobUsageRecord>`)
+	jur2 := parse(`<JobUsageRecord><RecordIdentity recordId="r1"/><JobIdentity><GlobalJobId>g2</GlobalJobId></JobIdentity></JobUsageRecord>`)
+	site1 := generic(`<SiteRecord><RecordId>s1</RecordId><Value>1</Value></SiteRecord>`)
+	site2 := generic(`<SiteRecord><RecordId>s1</RecordId><Value>2</Value></SiteRecord>`)
+	for _, tc := range []struct {
+		a, b gracc.Record
+		same bool
+	}{
+		// built-in types use their Identity
+		{jur1, jur2, false},
+		{jur1, duplicateRecord{jur1}, true},
+		// other types fall back to their Id
+		{site1, site2, true},
+		{identityRecord{site1, "a"}, identityRecord{site2, "b"}, false},
+		{identityRecord{site1, "a"}, identityRecord{site2, "a"}, true},
+	} {
+		ka, kb := dedupKey(tc.a), dedupKey(tc.b)
+		if ka == "" || (ka == kb) != tc.same {
+			t.Errorf("%s and %s: expected same key %v, got %q and %q", tc.a.Raw(), tc.b.Raw(), tc.same, ka, kb)
+		}
+	}
+	if k := dedupKey(generic(`<SiteRecord><Value>1</Value></SiteRecord>`)); k != "" {
+		t.Errorf("expected no key for record without identity, got %q", k)
+	}
+}
+
+func TestDedupRoute(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Dedup.File = "/nonexistent/dedup"
+	conf.Dedup.Policy = "route"
+	if err := conf.Validate(); err == nil {
+		t.Error("expected error for route policy without Exchange")
+	}
+	conf.Dedup.Exchange = "gracc.dups"
+	conf.Routes = []RouteConfig{{Type: "JobUsageRecord", Exchange: "gracc.jobs"}}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	oc := conf.OutputConfigs()
+	routes := oc[0].AMQP.routes
+	if len(routes) != 3 || routes[0].Exchange != "gracc.dups" || routes[1].Exchange != "gracc.probedetails" || routes[2].Exchange != "gracc.jobs" {
+		t.Errorf("expected dedup route first, got %+v", routes)
+	}
+}
+
+func TestDuplicateEncodings(t *testing.T) {
+	rec := testAPELRecord(t, "r1")
+	dup := duplicateRecord{rec}
+
+	// the mark doesn't change encodings that can't include it
+	encode := map[string]func(gracc.Record) ([]byte, error){
+		"xml": func(rec gracc.Record) ([]byte, error) {
+			b, _, err := encodeRecord(rec, "xml", "")
+			return b, err
+		},
+		"apel": func(rec gracc.Record) ([]byte, error) {
+			return encodeAPELRecord(rec, testAPELConfig)
+		},
+	}
+	for format, enc := range encode {
+		exp, err := enc(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := enc(dup)
+		if err != nil {
+			t.Errorf("%s: error encoding duplicate: %s", format, err)
+		} else if string(b) != string(exp) {
+			t.Errorf("%s: expected %s, got %s", format, exp, b)
+		}
+	}
+
+	// nor overwrite the original in Elasticsearch
+	if recordDocId(dup) == recordDocId(rec) {
+		t.Error("expected duplicate to have its own document ID")
+	}
+}
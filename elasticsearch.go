@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+type ElasticsearchConfig struct {
+	URL      string
+	Index    string
+	DocType  string
+	User     string
+	Password string
+}
+
+func (c *ElasticsearchConfig) Validate() error {
+	if c.URL == "" {
+		c.URL = "http://localhost:9200"
+	}
+	c.URL = strings.TrimRight(c.URL, "/")
+	if c.DocType == "" {
+		// Elasticsearch 6 allows only one type per index, so all records
+		// share one
+		c.DocType = "doc"
+	}
+	if c.Index == "" {
+		return fmt.Errorf("elasticsearch output Index is required")
+	}
+	return nil
+}
+
+// ElasticsearchOutput writes records directly to Elasticsearch using the
+// bulk API. Records are indexed in the JSON format, into an index named by
+// expanding the date in the Index pattern with the record's date (see
+// expandIndex), with a document ID derived from the record's identity so
+// that resent records overwrite the original rather than duplicating it.
+type ElasticsearchOutput struct {
+	Config ElasticsearchConfig
+	client *http.Client
+}
+
+func InitElasticsearch(conf ElasticsearchConfig) (*ElasticsearchOutput, error) {
+	log.WithFields(log.Fields{
+		"url":   conf.URL,
+		"index": conf.Index,
+	}).Info("elasticsearch: initializing output")
+	return &ElasticsearchOutput{
+		Config: conf,
+		client: &http.Client{},
+	}, nil
+}
+
+// Close does nothing; there is no persistent connection to close.
+func (e *ElasticsearchOutput) Close() error {
+	return nil
+}
+
+// ElasticsearchWorker collects a bundle of records into a bulk request,
+// which is sent when Wait is called.
+type ElasticsearchWorker struct {
+	output *ElasticsearchOutput
+	buf    bytes.Buffer
+	ids    []string
+}
+
+// NewWorker returns a new worker. bundleSize is the expected number
+// of records this worker will handle, and info describes the bundle.
+func (e *ElasticsearchOutput) NewWorker(bundleSize int, info BundleInfo) (Worker, error) {
+	return &ElasticsearchWorker{
+		output: e,
+		ids:    make([]string, 0, bundleSize),
+	}, nil
+}
+
+type esAction struct {
+	Index esActionMeta `json:"index"`
+}
+
+type esActionMeta struct {
+	Index string `json:"_index"`
+	Type  string `json:"_type,omitempty"`
+	Id    string `json:"_id"`
+}
+
+// PublishRecord adds rec to the bulk request.
+func (w *ElasticsearchWorker) PublishRecord(rec gracc.Record) error {
+	ll := log.WithFields(log.Fields{
+		"where":  "ElasticsearchWorker.PublishRecord",
+		"record": rec.Id(),
+	})
+	j, err := rec.ToJSON("")
+	if err != nil {
+		ll.WithField("error", err).Error("error converting record to json")
+		return NewRecordError("error converting record to json")
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(j, &doc); err != nil {
+		ll.WithField("error", err).Error("error decoding record json")
+		return NewRecordError("error converting record to json")
+	}
+	a := esAction{esActionMeta{
+		Index: expandIndex(w.output.Config.Index, recordDate(doc)),
+		Type:  w.output.Config.DocType,
+		Id:    recordDocId(rec),
+	}}
+	aj, err := json.Marshal(a)
+	if err != nil {
+		return NewRecordError("error encoding bulk action")
+	}
+	w.buf.Write(aj)
+	w.buf.WriteByte('\n')
+	w.buf.Write(j)
+	w.buf.WriteByte('\n')
+	w.ids = append(w.ids, rec.Id())
+	ll.WithFields(log.Fields{
+		"index": a.Index.Index,
+		"id":    a.Index.Id,
+	}).Debug("added record to bulk request")
+	return nil
+}
+
+type esBulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]esBulkItemResult `json:"items"`
+}
+
+type esBulkItemResult struct {
+	Id     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error,omitempty"`
+}
+
+// esRetryable returns true if an HTTP status from Elasticsearch indicates
+// that the request may succeed if retried later.
+func esRetryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// Wait sends the bulk request and checks the result for each record.
+// If any records were rejected for reasons that may succeed later (e.g. the
+// cluster is overloaded) an OutputError is returned, so the bundle will be
+// resent; if records were rejected because they are invalid (e.g. a mapping
+// error) a RejectedError is returned.
+func (w *ElasticsearchWorker) Wait(timeout time.Duration) error {
+	ll := log.WithFields(log.Fields{
+		"where": "ElasticsearchWorker.Wait",
+	})
+	if len(w.ids) == 0 {
+		ll.Warning("no records were sent")
+		return nil
+	}
+	conf := w.output.Config
+	req, err := http.NewRequest("POST", conf.URL+"/_bulk", bytes.NewReader(w.buf.Bytes()))
+	if err != nil {
+		ll.Error(err)
+		return NewOutputError("error creating bulk request")
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if conf.User != "" {
+		req.SetBasicAuth(conf.User, conf.Password)
+	}
+	client := *w.output.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		ll.Error(err)
+		return NewOutputError("error sending bulk request to elasticsearch")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		ll.Error(err)
+		return NewOutputError("error reading bulk response from elasticsearch")
+	}
+	if resp.StatusCode != http.StatusOK {
+		ll.WithFields(log.Fields{
+			"status": resp.Status,
+			"body":   string(body),
+		}).Error("bulk request failed")
+		return NewOutputError(fmt.Sprintf("elasticsearch bulk request failed: %s", resp.Status))
+	}
+	var br esBulkResponse
+	if err := json.Unmarshal(body, &br); err != nil {
+		ll.WithField("error", err).Error("error decoding bulk response")
+		return NewOutputError("error decoding bulk response from elasticsearch")
+	}
+	if len(br.Items) != len(w.ids) {
+		return NewOutputError(fmt.Sprintf("elasticsearch returned %d results for %d records", len(br.Items), len(w.ids)))
+	}
+	if !br.Errors {
+		ll.WithField("records", len(w.ids)).Debug("all records indexed successfully")
+		return nil
+	}
+	var retry int
+	var rejected RejectedError
+	for i, item := range br.Items {
+		for _, res := range item {
+			if res.Status < 300 {
+				continue
+			}
+			reason := fmt.Sprintf("status %d", res.Status)
+			if res.Error != nil {
+				reason = res.Error.Type + ": " + res.Error.Reason
+			}
+			ll.WithFields(log.Fields{
+				"record": w.ids[i],
+				"id":     res.Id,
+				"status": res.Status,
+				"reason": reason,
+			}).Warning("record not indexed")
+			if esRetryable(res.Status) {
+				retry++
+			} else {
+				rejected.Records = append(rejected.Records, i)
+				rejected.Reasons = append(rejected.Reasons, reason)
+			}
+		}
+	}
+	if retry > 0 {
+		return NewOutputError(fmt.Sprintf("%d of %d records could not be indexed right now", retry, len(w.ids)))
+	}
+	if n := len(rejected.Records); n > 0 {
+		rejected.Message = fmt.Sprintf("%d of %d records rejected by elasticsearch, first record %s: %s",
+			n, len(w.ids), w.ids[rejected.Records[0]], rejected.Reasons[0])
+		return rejected
+	}
+	return nil
+}
+
+// Close discards any records that have not been sent.
+func (w *ElasticsearchWorker) Close() error {
+	w.buf.Reset()
+	w.ids = nil
+	return nil
+}
+
+// recordDate returns the date that determines which index the flattened
+// record doc goes in, or the current time if it has none.
+func recordDate(doc map[string]interface{}) time.Time {
+	for _, k := range []string{"EndTime", "Timestamp", "StartTime", "CreateTime"} {
+		if s, ok := doc[k].(string); ok {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				return t.UTC()
+			}
+		}
+	}
+	return time.Now().UTC()
+}
+
+// expandIndex expands the date directives in index pattern p using time t:
+// %Y (year), %m (month), %d (day), %H (hour), and %% (a literal %).
+// e.g. "gracc.osg.raw-%Y.%m" becomes "gracc.osg.raw-2016.02".
+func expandIndex(p string, t time.Time) string {
+	var b bytes.Buffer
+	for i := 0; i < len(p); i++ {
+		if p[i] != '%' || i == len(p)-1 {
+			b.WriteByte(p[i])
+			continue
+		}
+		i++
+		switch p[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(p[i])
+		}
+	}
+	return b.String()
+}
+
+// recordDocId returns a document ID derived from the identity of rec, or
+// from its fingerprint if it has no identity. Duplicates have their own
+// document, derived from their fingerprint as well, so that they don't
+// overwrite the original.
+func recordDocId(rec gracc.Record) string {
+	h := sha1.New()
+	if id := rec.Id(); id != "" {
+		fmt.Fprintf(h, "%s\x00%s", rec.Type(), id)
+	} else {
+		fmt.Fprintf(h, "%s\x00%s", rec.Type(), rec.Fingerprint())
+	}
+	if isDuplicate(rec) {
+		fmt.Fprintf(h, "\x00duplicate\x00%s", rec.Fingerprint())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
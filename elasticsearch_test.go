@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+// fakeBulk is a stand-in for the Elasticsearch bulk endpoint. It records the
+// actions it receives, and responds to the nth item with status[n], if set.
+type fakeBulk struct {
+	actions []esActionMeta
+	status  map[int]int
+}
+
+func (f *fakeBulk) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/_bulk" || r.Method != "POST" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	f.actions = nil
+	var items []map[string]interface{}
+	errors := false
+	s := bufio.NewScanner(r.Body)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		var a esAction
+		if err := json.Unmarshal(s.Bytes(), &a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !s.Scan() {
+			http.Error(w, "missing document", http.StatusBadRequest)
+			return
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(s.Bytes(), &doc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res := map[string]interface{}{"_id": a.Index.Id, "status": 201}
+		if st, ok := f.status[len(f.actions)]; ok {
+			res["status"] = st
+			res["error"] = map[string]string{"type": "test_exception", "reason": fmt.Sprintf("status %d", st)}
+			errors = true
+		}
+		items = append(items, map[string]interface{}{"index": res})
+		f.actions = append(f.actions, a.Index)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"took":   1,
+		"errors": errors,
+		"items":  items,
+	})
+}
+
+func sendTestBundleES(t *testing.T, eo *ElasticsearchOutput) error {
+	var bun gracc.RecordBundle
+	if err := xml.Unmarshal([]byte(testBundleXML), &bun); err != nil {
+		t.Fatal(err)
+	}
+	w, err := eo.NewWorker(bun.RecordCount(), BundleInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for rec := range bun.Records() {
+		if err := w.PublishRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Wait(time.Second)
+}
+
+func TestElasticsearchOutput(t *testing.T) {
+	fb := &fakeBulk{}
+	ts := httptest.NewServer(fb)
+	defer ts.Close()
+	conf := ElasticsearchConfig{URL: ts.URL, Index: "gracc.test.raw-%Y.%m"}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	eo, err := InitElasticsearch(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendTestBundleES(t, eo); err != nil {
+		t.Fatal(err)
+	}
+	if len(fb.actions) == 0 {
+		t.Fatal("no records were sent")
+	}
+	first := fb.actions
+	for _, a := range first {
+		if !strings.HasPrefix(a.Index, "gracc.test.raw-20") || a.Type != "doc" || a.Id == "" {
+			t.Errorf("bad action: %v", a)
+		}
+	}
+	if first[0].Index != "gracc.test.raw-2015.11" {
+		t.Errorf("expected first record in gracc.test.raw-2015.11, got %s", first[0].Index)
+	}
+
+	// resending the bundle should produce the same document IDs
+	if err := sendTestBundleES(t, eo); err != nil {
+		t.Fatal(err)
+	}
+	for i, a := range fb.actions {
+		if a.Id != first[i].Id {
+			t.Errorf("record %d: resent with id %s, originally %s", i, a.Id, first[i].Id)
+		}
+	}
+
+	// invalid records are rejected, overload is an output error
+	fb.status = map[int]int{1: 400}
+	if err := sendTestBundleES(t, eo); err == nil {
+		t.Error("expected error for rejected record")
+	} else if rerr, ok := err.(RejectedError); !ok {
+		t.Errorf("expected RejectedError, got %T: %s", err, err)
+	} else if len(rerr.Records) != 1 || rerr.Records[0] != 1 {
+		t.Errorf("expected record 1 rejected, got %v", rerr.Records)
+	}
+	fb.status = map[int]int{1: 400, 2: 429}
+	if err := sendTestBundleES(t, eo); err == nil {
+		t.Error("expected error for rejected record")
+	} else if _, ok := err.(OutputError); !ok {
+		t.Errorf("expected OutputError, got %T: %s", err, err)
+	}
+}
+
+func TestExpandIndex(t *testing.T) {
+	d := time.Date(2016, 2, 5, 3, 0, 0, 0, time.UTC)
+	for p, e := range map[string]string{
+		"gracc.osg.raw-%Y.%m":     "gracc.osg.raw-2016.02",
+		"gracc-%Y%m%d%H":          "gracc-2016020503",
+		"gracc-%%-%q":             "gracc-%-%q",
+		"gracc-no-date":           "gracc-no-date",
+		"gracc-trailing-percent%": "gracc-trailing-percent%",
+	} {
+		if i := expandIndex(p, d); i != e {
+			t.Errorf("%s: expected %s, got %s", p, e, i)
+		}
+	}
+}
@@ -13,6 +13,20 @@ func (e AMQPError) Error() string {
 	return e.Message
 }
 
+// OutputError represents an error sending records to an output other
+// than AMQP, e.g. a file.
+type OutputError struct {
+	Message string
+}
+
+func NewOutputError(msg string) OutputError {
+	return OutputError{Message: msg}
+}
+
+func (e OutputError) Error() string {
+	return e.Message
+}
+
 // RequestError represents an error due to an invalid request.
 type RequestError struct {
 	Message string
@@ -38,3 +52,31 @@ func NewRecordError(msg string) RecordError {
 func (e RecordError) Error() string {
 	return e.Message
 }
+
+// SpoolError represents an error writing to or reading from the spool.
+type SpoolError struct {
+	Message string
+}
+
+func NewSpoolError(msg string) SpoolError {
+	return SpoolError{Message: msg}
+}
+
+func (e SpoolError) Error() string {
+	return e.Message
+}
+
+// RejectedError represents records that an output rejected as invalid,
+// while the rest of the batch was sent successfully. Records holds the
+// position of each rejected record in the order it was published, and
+// Reasons why it was rejected. A worker's PublishRecord may also return one,
+// without Records, for the record it was given.
+type RejectedError struct {
+	Message string
+	Records []int
+	Reasons []string
+}
+
+func (e RejectedError) Error() string {
+	return e.Message
+}
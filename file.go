@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+type FileConfig struct {
+	Dir      string
+	Prefix   string
+	Format   string
+	MaxSize  int64
+	Compress bool
+}
+
+func (c *FileConfig) Validate() error {
+	if c.Dir == "" {
+		return fmt.Errorf("file output Dir is required")
+	}
+	if c.Prefix == "" {
+		c.Prefix = "gracc"
+	}
+	switch c.Format {
+	case "":
+		c.Format = "json"
+	case "json", "raw":
+	default:
+		return fmt.Errorf("unknown file output Format \"%s\"", c.Format)
+	}
+	return nil
+}
+
+// FileOutput writes records to local files, one record per line. Files are
+// named <Prefix>-<YYYYMMDD>-<N>.<jsonl|xml>, and a new file is started each
+// UTC day, or when the current file would exceed MaxSize. Rotated files are
+// optionally gzip-compressed.
+type FileOutput struct {
+	Config FileConfig
+
+	m    sync.Mutex
+	f    *os.File
+	name string
+	day  string
+	seq  int
+	size int64
+	now  func() time.Time
+}
+
+// InitFile opens the output directory and starts a new file.
+func InitFile(conf FileConfig) (*FileOutput, error) {
+	fo := &FileOutput{
+		Config: conf,
+		now:    time.Now,
+	}
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+	// Files left over from a previous run are not appended to, since they
+	// may end with a partial line, but they still need compressing.
+	if conf.Compress {
+		names, err := filepath.Glob(filepath.Join(conf.Dir, conf.Prefix+"-*."+fo.ext()))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			go compressFile(name)
+		}
+	}
+	return fo, nil
+}
+
+func (fo *FileOutput) ext() string {
+	if fo.Config.Format == "raw" {
+		return "xml"
+	}
+	return "jsonl"
+}
+
+// open starts a new file for day, continuing the sequence of any existing
+// files for that day. Must be called with the lock held.
+func (fo *FileOutput) open(day string) error {
+	if fo.day != day {
+		fo.day = day
+		fo.seq = 0
+		names, err := filepath.Glob(filepath.Join(fo.Config.Dir, fo.Config.Prefix+"-"+day+"-*"))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			var n int
+			base := strings.TrimPrefix(filepath.Base(name), fo.Config.Prefix+"-"+day+"-")
+			if _, err := fmt.Sscanf(base, "%d.", &n); err == nil && n > fo.seq {
+				fo.seq = n
+			}
+		}
+	}
+	fo.seq++
+	name := filepath.Join(fo.Config.Dir, fmt.Sprintf("%s-%s-%03d.%s", fo.Config.Prefix, day, fo.seq, fo.ext()))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	log.WithField("file", name).Info("file output: opened file")
+	fo.f = f
+	fo.name = name
+	fo.size = 0
+	return nil
+}
+
+// rotate closes the current file, if any, and compresses it if configured.
+// Must be called with the lock held.
+func (fo *FileOutput) rotate() error {
+	if fo.f == nil {
+		return nil
+	}
+	err := fo.f.Close()
+	if fo.Config.Compress && err == nil {
+		go compressFile(fo.name)
+	}
+	fo.f = nil
+	return err
+}
+
+// write writes a batch of lines to the current file, rotating first if
+// necessary, and syncs the file to disk.
+func (fo *FileOutput) write(buf []byte) error {
+	fo.m.Lock()
+	defer fo.m.Unlock()
+	day := fo.now().UTC().Format("20060102")
+	if fo.f != nil && (day != fo.day ||
+		(fo.Config.MaxSize > 0 && fo.size > 0 && fo.size+int64(len(buf)) > fo.Config.MaxSize)) {
+		if err := fo.rotate(); err != nil {
+			log.WithFields(log.Fields{
+				"file":  fo.name,
+				"error": err,
+			}).Error("file output: error closing file")
+		}
+	}
+	if fo.f == nil {
+		if err := fo.open(day); err != nil {
+			return err
+		}
+	}
+	if _, err := fo.f.Write(buf); err != nil {
+		// don't leave a partial bundle at the end of the file
+		fo.f.Truncate(fo.size)
+		fo.f.Seek(fo.size, io.SeekStart)
+		return err
+	}
+	fo.size += int64(len(buf))
+	return fo.f.Sync()
+}
+
+// Close closes the current file.
+func (fo *FileOutput) Close() error {
+	fo.m.Lock()
+	defer fo.m.Unlock()
+	return fo.rotate()
+}
+
+// FileWorker collects a bundle of records and writes them to the
+// FileOutput when Wait is called.
+type FileWorker struct {
+	output *FileOutput
+	buf    bytes.Buffer
+}
+
+// NewWorker returns a new worker. bundleSize is the expected number
+// of records this worker will handle, and info describes the bundle.
+func (fo *FileOutput) NewWorker(bundleSize int, info BundleInfo) (Worker, error) {
+	return &FileWorker{output: fo}, nil
+}
+
+// PublishRecord encodes rec and adds it to the bundle.
+func (w *FileWorker) PublishRecord(rec gracc.Record) error {
+	line, _, err := encodeRecord(rec, w.output.Config.Format, "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"where":  "FileWorker.PublishRecord",
+			"error":  err,
+			"record": rec.Id(),
+		}).Error("error encoding record")
+		return NewRecordError("error encoding record")
+	}
+	if w.output.Config.Format == "raw" {
+		line = oneLineXML(line)
+	}
+	w.buf.Write(line)
+	w.buf.WriteByte('\n')
+	return nil
+}
+
+// Wait writes the bundle to disk and syncs the file. The timeout is ignored.
+func (w *FileWorker) Wait(timeout time.Duration) error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	if err := w.output.write(w.buf.Bytes()); err != nil {
+		log.WithFields(log.Fields{
+			"where": "FileWorker.Wait",
+			"error": err,
+		}).Error("error writing records to file")
+		return NewOutputError("error writing records to file")
+	}
+	w.buf.Reset()
+	return nil
+}
+
+// Close discards any records that have not been written.
+func (w *FileWorker) Close() error {
+	w.buf.Reset()
+	return nil
+}
+
+// oneLineXML replaces line breaks in XML document x so that it fits on one
+// line: in character data they are replaced with character references, and
+// within tags they are replaced with spaces.
+func oneLineXML(x []byte) []byte {
+	var b bytes.Buffer
+	inTag := false
+	var quote byte
+	for _, c := range bytes.TrimSpace(x) {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case inTag && (c == '"' || c == '\''):
+			quote = c
+		case c == '<':
+			inTag = true
+		case c == '>':
+			inTag = false
+		}
+		switch c {
+		case '\n':
+			if inTag && quote == 0 {
+				b.WriteByte(' ')
+			} else {
+				b.WriteString("&#xA;")
+			}
+		case '\r':
+			if inTag && quote == 0 {
+				b.WriteByte(' ')
+			} else {
+				b.WriteString("&#xD;")
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.Bytes()
+}
+
+// compressFile gzips file name to name.gz, then removes name.
+func compressFile(name string) {
+	ll := log.WithField("file", name)
+	if err := gzipFile(name); err != nil {
+		ll.WithField("error", err).Error("file output: error compressing file")
+		return
+	}
+	ll.Debug("file output: compressed file")
+}
+
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(name)
+	if _, err := io.Copy(zw, bufio.NewReader(in)); err != nil {
+		out.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
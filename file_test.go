@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+func writeTestBundle(t *testing.T, fo *FileOutput) int {
+	var bun gracc.RecordBundle
+	if err := xml.Unmarshal([]byte(testBundleXML), &bun); err != nil {
+		t.Fatal(err)
+	}
+	w, err := fo.NewWorker(bun.RecordCount(), BundleInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	n := 0
+	for rec := range bun.Records() {
+		if err := w.PublishRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if err := w.Wait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestFileOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gracc-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := FileConfig{Dir: dir}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	fo, err := InitFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2016, 2, 25, 23, 59, 0, 0, time.UTC)
+	fo.now = func() time.Time { return day }
+	n := writeTestBundle(t, fo)
+	writeTestBundle(t, fo)
+	// next day should go to a new file
+	day = day.Add(time.Hour)
+	writeTestBundle(t, fo)
+	if err := fo.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, lines := range map[string]int{
+		"gracc-20160225-001.jsonl": 2 * n,
+		"gracc-20160226-001.jsonl": n,
+	} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		s.Buffer(nil, 1024*1024)
+		var got int
+		for s.Scan() {
+			var r map[string]interface{}
+			if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+				t.Errorf("%s line %d: %s", name, got+1, err)
+			}
+			got++
+		}
+		if got != lines {
+			t.Errorf("%s: expected %d lines, got %d", name, lines, got)
+		}
+	}
+}
+
+func TestFileOutputRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gracc-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := FileConfig{Dir: dir, Format: "raw", MaxSize: 1024, Compress: true}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	fo, err := InitFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fo.now = func() time.Time { return time.Date(2016, 2, 25, 0, 0, 0, 0, time.UTC) }
+	n := writeTestBundle(t, fo)
+	writeTestBundle(t, fo)
+
+	// the first file should have been rotated and compressed
+	first := filepath.Join(dir, "gracc-20160225-001.xml")
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(first + ".gz"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(first + ".gz"); err != nil {
+		t.Errorf("rotated file was not compressed: %s", err)
+	}
+
+	// each line of the current file should be a complete record
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "gracc-20160225-002.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	s.Buffer(nil, 1024*1024)
+	var got int
+	for s.Scan() {
+		if _, err := gracc.ParseRecordXML(s.Bytes()); err != nil {
+			t.Errorf("line %d: %s", got+1, err)
+		}
+		got++
+	}
+	if got != n {
+		t.Errorf("expected %d lines, got %d", n, got)
+	}
+}
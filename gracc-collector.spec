@@ -47,6 +47,8 @@ cp -p etc/gracc-collector.cfg %{buildroot}%{_sysconfdir}/gracc/gracc-collector.c
 mkdir -p %{buildroot}%{_sysconfdir}/logrotate.d
 cp -p etc/gracc-collector.logrotate %{buildroot}%{_sysconfdir}/logrotate.d/gracc-collector
 mkdir -p %{buildroot}%{_var}/log/gracc
+mkdir -p %{buildroot}%{_var}/spool/gracc
+mkdir -p %{buildroot}%{_sharedstatedir}/gracc
 
 
 %files
@@ -57,6 +59,8 @@ mkdir -p %{buildroot}%{_var}/log/gracc
 %config(noreplace) %{_sysconfdir}/gracc/gracc-collector.cfg
 %config(noreplace) %{_sysconfdir}/logrotate.d/gracc-collector
 %attr(755, gracc, gracc) %{_var}/log/gracc/
+%attr(755, gracc, gracc) %{_var}/spool/gracc/
+%attr(755, gracc, gracc) %{_sharedstatedir}/gracc/
 
 
 %pre
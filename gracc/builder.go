@@ -0,0 +1,420 @@
+package gracc
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// JobUsageRecordBuilder builds a JobUsageRecord, for probes that want to
+// create records in Go. Elements are written in the order they are added,
+// after the identity blocks. For example:
+//
+//	jur, err := NewJobUsageRecordBuilder("host.example.org:1234.0").
+//		GlobalJobId("condor.host.example.org#1234.0#1464388242").
+//		VOName("osg").
+//		WallDuration(10 * time.Minute).
+//		CpuDuration("user", 9 * time.Minute).
+//		EndTime(time.Now()).
+//		ProbeName("condor:host.example.org").
+//		SiteName("EXAMPLE").
+//		Build()
+type JobUsageRecordBuilder struct {
+	recordBuilder
+	recordId   string
+	createTime time.Time
+	job        []xmlElement
+	user       []xmlElement
+	err        error
+}
+
+// NewJobUsageRecordBuilder returns a builder for a JobUsageRecord with
+// RecordId recordId, created now.
+func NewJobUsageRecordBuilder(recordId string) *JobUsageRecordBuilder {
+	return &JobUsageRecordBuilder{
+		recordId:   recordId,
+		createTime: time.Now(),
+	}
+}
+
+// CreateTime sets the time the record was created.
+func (b *JobUsageRecordBuilder) CreateTime(t time.Time) *JobUsageRecordBuilder {
+	b.createTime = t
+	return b
+}
+
+// GlobalJobId sets the globally unique job id.
+func (b *JobUsageRecordBuilder) GlobalJobId(id string) *JobUsageRecordBuilder {
+	b.job = setElement(b.job, "GlobalJobId", id)
+	return b
+}
+
+// LocalJobId sets the job id used by the batch system.
+func (b *JobUsageRecordBuilder) LocalJobId(id string) *JobUsageRecordBuilder {
+	b.job = setElement(b.job, "LocalJobId", id)
+	return b
+}
+
+// ProcessId adds a process id of the job.
+func (b *JobUsageRecordBuilder) ProcessId(id string) *JobUsageRecordBuilder {
+	b.job = append(b.job, xmlElement{Name: "ProcessId", Value: id})
+	return b
+}
+
+// LocalUserId sets the local user name the job ran as.
+func (b *JobUsageRecordBuilder) LocalUserId(id string) *JobUsageRecordBuilder {
+	b.user = setElement(b.user, "LocalUserId", id)
+	return b
+}
+
+// GlobalUsername sets the global user name of the job's owner.
+func (b *JobUsageRecordBuilder) GlobalUsername(name string) *JobUsageRecordBuilder {
+	b.user = setElement(b.user, "GlobalUsername", name)
+	return b
+}
+
+// CommonName sets the common name of the job owner's certificate.
+func (b *JobUsageRecordBuilder) CommonName(cn string) *JobUsageRecordBuilder {
+	b.user = setElement(b.user, "CommonName", cn)
+	return b
+}
+
+// DN sets the distinguished name of the job owner's certificate.
+func (b *JobUsageRecordBuilder) DN(dn string) *JobUsageRecordBuilder {
+	b.user = setElement(b.user, "DN", dn)
+	return b
+}
+
+// VOName sets the VO, or full VOMS FQAN, of the job's owner.
+func (b *JobUsageRecordBuilder) VOName(vo string) *JobUsageRecordBuilder {
+	b.user = setElement(b.user, "VOName", vo)
+	return b
+}
+
+// ReportableVOName sets the VO the job is accounted to.
+func (b *JobUsageRecordBuilder) ReportableVOName(vo string) *JobUsageRecordBuilder {
+	b.user = setElement(b.user, "ReportableVOName", vo)
+	return b
+}
+
+// Status sets the exit status of the job.
+func (b *JobUsageRecordBuilder) Status(status string) *JobUsageRecordBuilder {
+	b.set("Status", status)
+	return b
+}
+
+// WallDuration sets the wall clock time the job ran for.
+func (b *JobUsageRecordBuilder) WallDuration(d time.Duration) *JobUsageRecordBuilder {
+	b.set("WallDuration", FormatDuration(d))
+	return b
+}
+
+// CpuDuration adds the CPU time the job used, of usageType "user" or
+// "system".
+func (b *JobUsageRecordBuilder) CpuDuration(usageType string, d time.Duration) *JobUsageRecordBuilder {
+	b.add("CpuDuration", FormatDuration(d), urwgAttr("usageType", usageType))
+	return b
+}
+
+// StartTime sets the time the job started.
+func (b *JobUsageRecordBuilder) StartTime(t time.Time) *JobUsageRecordBuilder {
+	b.set("StartTime", formatTime(t))
+	return b
+}
+
+// EndTime sets the time the job ended.
+func (b *JobUsageRecordBuilder) EndTime(t time.Time) *JobUsageRecordBuilder {
+	b.set("EndTime", formatTime(t))
+	return b
+}
+
+// Processors sets the number of processors the job used.
+func (b *JobUsageRecordBuilder) Processors(n int) *JobUsageRecordBuilder {
+	b.set("Processors", strconv.Itoa(n), urwgAttr("metric", "max"))
+	return b
+}
+
+// NodeCount sets the number of nodes the job used.
+func (b *JobUsageRecordBuilder) NodeCount(n int) *JobUsageRecordBuilder {
+	b.set("NodeCount", strconv.Itoa(n), urwgAttr("metric", "max"))
+	return b
+}
+
+// MachineName sets the name of the machine (usually the CE) the job ran on.
+func (b *JobUsageRecordBuilder) MachineName(name string) *JobUsageRecordBuilder {
+	b.set("MachineName", name)
+	return b
+}
+
+// Host sets the name of the worker node the job ran on.
+func (b *JobUsageRecordBuilder) Host(name string) *JobUsageRecordBuilder {
+	b.set("Host", name)
+	return b
+}
+
+// SubmitHost sets the name of the host the job was submitted from.
+func (b *JobUsageRecordBuilder) SubmitHost(name string) *JobUsageRecordBuilder {
+	b.set("SubmitHost", name)
+	return b
+}
+
+// ProjectName sets the project the job is accounted to.
+func (b *JobUsageRecordBuilder) ProjectName(name string) *JobUsageRecordBuilder {
+	b.set("ProjectName", name)
+	return b
+}
+
+// ProbeName sets the name of the probe that created the record.
+func (b *JobUsageRecordBuilder) ProbeName(name string) *JobUsageRecordBuilder {
+	b.set("ProbeName", name)
+	return b
+}
+
+// SiteName sets the name of the site the job ran at.
+func (b *JobUsageRecordBuilder) SiteName(name string) *JobUsageRecordBuilder {
+	b.set("SiteName", name)
+	return b
+}
+
+// Grid sets the grid the job ran on, e.g. "OSG".
+func (b *JobUsageRecordBuilder) Grid(name string) *JobUsageRecordBuilder {
+	b.set("Grid", name)
+	return b
+}
+
+// ResourceType sets the type of resource, e.g. "Batch" or "BatchPilot".
+func (b *JobUsageRecordBuilder) ResourceType(t string) *JobUsageRecordBuilder {
+	return b.Resource("ResourceType", t)
+}
+
+// Resource adds a Resource with the given description and value.
+func (b *JobUsageRecordBuilder) Resource(description, value string) *JobUsageRecordBuilder {
+	b.add("Resource", value, urwgAttr("description", description))
+	return b
+}
+
+// TimeDuration adds a TimeDuration of type typ.
+func (b *JobUsageRecordBuilder) TimeDuration(typ string, d time.Duration) *JobUsageRecordBuilder {
+	b.add("TimeDuration", FormatDuration(d), urwgAttr("type", typ))
+	return b
+}
+
+// TimeInstant adds a TimeInstant of type typ.
+func (b *JobUsageRecordBuilder) TimeInstant(typ string, t time.Time) *JobUsageRecordBuilder {
+	b.add("TimeInstant", formatTime(t), urwgAttr("type", typ))
+	return b
+}
+
+// Field adds an arbitrary element, e.g. "JobName" or "Queue", with the given
+// UR-WG attributes, e.g. "description" or "metric", as name, value pairs.
+func (b *JobUsageRecordBuilder) Field(name, value string, attrs ...string) *JobUsageRecordBuilder {
+	if err := addField(&b.recordBuilder, name, value, attrs); err != nil && b.err == nil {
+		b.err = err
+	}
+	return b
+}
+
+// Build returns the record, or the first error in building it.
+func (b *JobUsageRecordBuilder) Build() (*JobUsageRecord, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	head := []xmlElement{{
+		Name: "RecordIdentity",
+		Attrs: []xml.Attr{
+			urwgAttr("recordId", b.recordId),
+			urwgAttr("createTime", formatTime(b.createTime)),
+		},
+	}}
+	if len(b.job) > 0 {
+		head = append(head, xmlElement{Name: "JobIdentity", Children: b.job})
+	}
+	if len(b.user) > 0 {
+		head = append(head, xmlElement{Name: "UserIdentity", Children: b.user})
+	}
+	var jur JobUsageRecord
+	if err := jur.ParseXML(b.render("JobUsageRecord", head...)); err != nil {
+		return nil, err
+	}
+	return &jur, nil
+}
+
+// StorageElementBuilder builds a StorageElement, which describes a storage
+// element or one of its areas.
+type StorageElementBuilder struct {
+	recordBuilder
+	err error
+}
+
+// NewStorageElementBuilder returns a builder for a StorageElement with
+// UniqueID uniqueID, with a Timestamp of now.
+func NewStorageElementBuilder(uniqueID string) *StorageElementBuilder {
+	b := &StorageElementBuilder{}
+	b.add("UniqueID", uniqueID)
+	b.add("Timestamp", formatTime(time.Now()))
+	return b
+}
+
+// Timestamp sets the time the record describes.
+func (b *StorageElementBuilder) Timestamp(t time.Time) *StorageElementBuilder {
+	b.set("Timestamp", formatTime(t))
+	return b
+}
+
+// Field sets an element, e.g. "SE", "Name", "ParentID", "SpaceType",
+// "Implementation", "Status", "ProbeName" or "SiteName", with the given
+// UR-WG attributes as name, value pairs.
+func (b *StorageElementBuilder) Field(name, value string, attrs ...string) *StorageElementBuilder {
+	if err := setField(&b.recordBuilder, name, value, attrs); err != nil && b.err == nil {
+		b.err = err
+	}
+	return b
+}
+
+// Build returns the record, or the first error in building it.
+func (b *StorageElementBuilder) Build() (*StorageElement, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	var se StorageElement
+	if err := se.ParseXML(b.render("StorageElement")); err != nil {
+		return nil, err
+	}
+	return &se, nil
+}
+
+// StorageElementRecordBuilder builds a StorageElementRecord, which reports
+// the space used in a storage element at a point in time.
+type StorageElementRecordBuilder struct {
+	recordBuilder
+	err error
+}
+
+// NewStorageElementRecordBuilder returns a builder for a StorageElementRecord
+// with UniqueID uniqueID, with a Timestamp of now.
+func NewStorageElementRecordBuilder(uniqueID string) *StorageElementRecordBuilder {
+	b := &StorageElementRecordBuilder{}
+	b.add("UniqueID", uniqueID)
+	b.add("Timestamp", formatTime(time.Now()))
+	return b
+}
+
+// Timestamp sets the time the record describes.
+func (b *StorageElementRecordBuilder) Timestamp(t time.Time) *StorageElementRecordBuilder {
+	b.set("Timestamp", formatTime(t))
+	return b
+}
+
+// MeasurementType sets how the space was measured, e.g. "raw" or "logical".
+func (b *StorageElementRecordBuilder) MeasurementType(t string) *StorageElementRecordBuilder {
+	b.set("MeasurementType", t)
+	return b
+}
+
+// StorageType sets the type of storage, e.g. "disk" or "tape".
+func (b *StorageElementRecordBuilder) StorageType(t string) *StorageElementRecordBuilder {
+	b.set("StorageType", t)
+	return b
+}
+
+// TotalSpace sets the total space, in bytes.
+func (b *StorageElementRecordBuilder) TotalSpace(n uint64) *StorageElementRecordBuilder {
+	b.set("TotalSpace", strconv.FormatUint(n, 10))
+	return b
+}
+
+// FreeSpace sets the free space, in bytes.
+func (b *StorageElementRecordBuilder) FreeSpace(n uint64) *StorageElementRecordBuilder {
+	b.set("FreeSpace", strconv.FormatUint(n, 10))
+	return b
+}
+
+// UsedSpace sets the used space, in bytes.
+func (b *StorageElementRecordBuilder) UsedSpace(n uint64) *StorageElementRecordBuilder {
+	b.set("UsedSpace", strconv.FormatUint(n, 10))
+	return b
+}
+
+// FileCount sets the number of files.
+func (b *StorageElementRecordBuilder) FileCount(n uint64) *StorageElementRecordBuilder {
+	b.set("FileCount", strconv.FormatUint(n, 10))
+	return b
+}
+
+// FileCountLimit sets the maximum number of files.
+func (b *StorageElementRecordBuilder) FileCountLimit(n uint64) *StorageElementRecordBuilder {
+	b.set("FileCountLimit", strconv.FormatUint(n, 10))
+	return b
+}
+
+// Field sets an element, e.g. "ProbeName" or "SiteName", with the given
+// UR-WG attributes as name, value pairs.
+func (b *StorageElementRecordBuilder) Field(name, value string, attrs ...string) *StorageElementRecordBuilder {
+	if err := setField(&b.recordBuilder, name, value, attrs); err != nil && b.err == nil {
+		b.err = err
+	}
+	return b
+}
+
+// Build returns the record, or the first error in building it.
+func (b *StorageElementRecordBuilder) Build() (*StorageElementRecord, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	var ser StorageElementRecord
+	if err := ser.ParseXML(b.render("StorageElementRecord")); err != nil {
+		return nil, err
+	}
+	return &ser, nil
+}
+
+// setElement replaces the value of the element named name in es, or appends
+// it if there is none.
+func setElement(es []xmlElement, name, value string) []xmlElement {
+	for i := range es {
+		if es[i].Name == name {
+			es[i].Value = value
+			return es
+		}
+	}
+	return append(es, xmlElement{Name: name, Value: value})
+}
+
+// fieldAttrs converts name, value pairs to UR-WG attributes.
+func fieldAttrs(name string, attrs []string) ([]xml.Attr, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+	if len(attrs)%2 != 0 {
+		return nil, fmt.Errorf("%s: attributes must be name, value pairs", name)
+	}
+	var as []xml.Attr
+	for i := 0; i < len(attrs); i += 2 {
+		if err := validName(attrs[i]); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		as = append(as, urwgAttr(attrs[i], attrs[i+1]))
+	}
+	return as, nil
+}
+
+// addField appends an arbitrary element to rb.
+func addField(rb *recordBuilder, name, value string, attrs []string) error {
+	as, err := fieldAttrs(name, attrs)
+	if err != nil {
+		return err
+	}
+	rb.add(name, value, as...)
+	return nil
+}
+
+// setField sets an arbitrary element of rb.
+func setField(rb *recordBuilder, name, value string, attrs []string) error {
+	as, err := fieldAttrs(name, attrs)
+	if err != nil {
+		return err
+	}
+	rb.set(name, value, as...)
+	return nil
+}
@@ -0,0 +1,200 @@
+package gracc
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestFormatDuration(t *testing.T) {
+	for _, dt := range []struct {
+		d   time.Duration
+		exp string
+	}{
+		{0, "PT0S"},
+		{90 * time.Second, "PT1M30S"},
+		{time.Hour, "PT1H"},
+		{26*time.Hour + 3*time.Minute + 4500*time.Millisecond, "PT26H3M4.5S"},
+		{-time.Minute, "-PT1M"},
+	} {
+		s := FormatDuration(dt.d)
+		if s != dt.exp {
+			t.Errorf("%s: expected %s, got %s", dt.d, dt.exp, s)
+		}
+		if dt.d >= 0 && convertDurationToSeconds(s) != dt.d.Seconds() {
+			t.Errorf("%s: %s parsed as %f seconds", dt.d, s, convertDurationToSeconds(s))
+		}
+	}
+}
+
+func TestJobUsageRecordBuilder(t *testing.T) {
+	end := time.Date(2016, 5, 27, 22, 44, 8, 0, time.UTC)
+	jur, err := NewJobUsageRecordBuilder("host.example.org:1234.0").
+		CreateTime(end).
+		GlobalJobId("condor.host.example.org#1234.0#1464388242").
+		LocalJobId("1234").
+		LocalUserId("user").
+		VOName("/osg/Role=NULL").
+		ReportableVOName("osg").
+		Status("0").
+		WallDuration(10*time.Minute).
+		CpuDuration("user", 9*time.Minute).
+		CpuDuration("system", 30*time.Second).
+		StartTime(end.Add(-10*time.Minute)).
+		EndTime(end).
+		Processors(8).
+		ProbeName("condor:host.example.org").
+		SiteName("EXAMPLE").
+		Grid("OSG").
+		Resource("ExitCode", "0").
+		ResourceType("BatchPilot").
+		Field("Queue", "5", "description", "Condor's JobUniverse field").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := jur.ToJSON("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r map[string]interface{}
+	if err := json.Unmarshal(j, &r); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]interface{}{
+		"RecordId":          "host.example.org:1234.0",
+		"CreateTime":        "2016-05-27T22:44:08Z",
+		"GlobalJobId":       "condor.host.example.org#1234.0#1464388242",
+		"LocalJobId":        "1234",
+		"LocalUserId":       "user",
+		"VOName":            "/osg/Role=NULL",
+		"ReportableVOName":  "osg",
+		"Status":            "0",
+		"WallDuration":      600.0,
+		"CpuDuration":       570.0,
+		"CpuDuration_user":  540.0,
+		"StartTime":         "2016-05-27T22:34:08Z",
+		"EndTime":           "2016-05-27T22:44:08Z",
+		"Processors":        "8",
+		"Processors_metric": "max",
+		"ProbeName":         "condor:host.example.org",
+		"Resource_ExitCode": "0",
+		"ResourceType":      "Payload",
+		"Queue_description": "Condor's JobUniverse field",
+	} {
+		if r[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, r[k])
+		}
+	}
+
+	if _, err := NewJobUsageRecordBuilder("x").Field("Bad Name", "").Build(); err == nil {
+		t.Error("expected error for invalid element name")
+	}
+	if _, err := NewJobUsageRecordBuilder("x").Field("Queue", "5", "description").Build(); err == nil {
+		t.Error("expected error for odd attributes")
+	}
+}
+
+func TestStorageElementRecordBuilder(t *testing.T) {
+	ts := time.Date(2016, 5, 27, 0, 0, 0, 0, time.UTC)
+	ser, err := NewStorageElementRecordBuilder("se.example.org:Pool:pool1").
+		Timestamp(ts).
+		MeasurementType("raw").
+		StorageType("disk").
+		TotalSpace(1000).
+		FreeSpace(400).
+		UsedSpace(600).
+		Field("ProbeName", "dCache-storage:se.example.org").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ser.UniqueID != "se.example.org:Pool:pool1" || !ser.Timestamp.Equal(ts) ||
+		ser.TotalSpace != 1000 || ser.FreeSpace != 400 || ser.UsedSpace != 600 {
+		t.Errorf("unexpected record %+v", ser)
+	}
+
+	se, err := NewStorageElementBuilder("se.example.org:SE:se.example.org").
+		Timestamp(ts).
+		Field("SE", "se.example.org").
+		Field("SpaceType", "SE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if se.UniqueID != "se.example.org:SE:se.example.org" || !se.Timestamp.Equal(ts) || len(se.Fields) != 2 {
+		t.Errorf("unexpected record %+v", se)
+	}
+}
+
+func TestMarshalRecordXML(t *testing.T) {
+	for _, rt := range Tests {
+		x, err := ioutil.ReadFile(rt.SourceXMLFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := ParseRecordXML(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := MarshalRecordXML(rec)
+		if err != nil {
+			t.Fatalf("%s: %s", rt.SourceXMLFile, err)
+		}
+		// all elements must be in the UR-WG namespace, or StAR records' in
+		// the StAR namespace
+		ns := URWGNamespace
+		if rec.Type() == "StorageUsageRecord" {
+			ns = StARNamespace
+		}
+		d := xml.NewDecoder(bytes.NewReader(m))
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				break
+			}
+			if se, ok := tok.(xml.StartElement); ok && se.Name.Space != ns {
+				t.Errorf("%s: element %s in namespace \"%s\"", rt.SourceXMLFile, se.Name.Local, se.Name.Space)
+			}
+		}
+		rec2, err := ParseRecordXML(m)
+		if err != nil {
+			t.Fatalf("%s: %s", rt.SourceXMLFile, err)
+		}
+		if rec2.Fingerprint() != rec.Fingerprint() {
+			t.Errorf("%s: fingerprint changed when marshalled:\n%s", rt.SourceXMLFile, m)
+		}
+	}
+}
+
+func TestRecordBundleToXML(t *testing.T) {
+	var b RecordBundle
+	jur, err := NewJobUsageRecordBuilder("r1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.AddRecord(jur)
+	ser, err := NewStorageElementRecordBuilder("se1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.AddRecord(ser)
+	x, err := b.ToXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b2 RecordBundle
+	if err := xml.Unmarshal(x, &b2); err != nil {
+		t.Fatal(err)
+	}
+	recs := bundleRecords(&b2)
+	if len(recs) != 2 || recs[0].Type() != "JobUsageRecord" || recs[1].Type() != "StorageElementRecord" {
+		t.Fatalf("unexpected bundle:\n%s", x)
+	}
+	if recs[0].Fingerprint() != jur.Fingerprint() {
+		t.Errorf("fingerprint changed in bundle:\n%s", x)
+	}
+}
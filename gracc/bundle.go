@@ -1,64 +1,236 @@
 package gracc
 
 import (
+	"bytes"
 	"encoding/xml"
+	"fmt"
 )
 
 // RecordBundle is a structure for unmarshalling a bundle of records, as would
-// be sent from a probe.
+// be sent from a probe. Records of registered types (see RegisterRecordType)
+// are unmarshalled into those types; others are kept in OtherRecords. An EMI
+// StAR StorageUsageRecords document, or one in a RecordEnvelope, is
+// unmarshalled as a bundle of its StorageUsageRecords. Records of registered
+// types that can't be unmarshalled (e.g. because an element has an invalid
+// value) are kept in InvalidRecords, rather than failing the whole bundle.
 type RecordBundle struct {
-	XMLName               xml.Name               `xml:"RecordEnvelope"`
-	UsageRecords          []JobUsageRecord       `xml:"UsageRecord,omitempty"`
-	JobUsageRecords       []JobUsageRecord       `xml:"JobUsageRecord,omitempty"`
-	StorageElements       []StorageElement       `xml:"StorageElement,omitempty"`
-	StorageElementRecords []StorageElementRecord `xml:"StorageElementRecord,omitempty"`
-	OtherRecords          []XMLRecord            `xml:",omitempty,any"`
+	XMLName        xml.Name        `xml:"RecordEnvelope"`
+	OtherRecords   []XMLRecord     `xml:",omitempty,any"`
+	InvalidRecords []InvalidRecord `xml:"-"`
+	records        []Record
+}
+
+// InvalidRecord is a record of a registered type that couldn't be
+// unmarshalled, and the reason why.
+type InvalidRecord struct {
+	XMLRecord
+	Err error
+}
+
+// UnmarshalXML unmarshals the bundle, and declares the namespaces that are
+// declared on the envelope on each record, so that their Raw XML is complete.
+// The root element must be a RecordEnvelope or StorageUsageRecords.
+func (b *RecordBundle) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	switch start.Name.Local {
+	case "RecordEnvelope", "StorageUsageRecords":
+	default:
+		return fmt.Errorf("expected RecordEnvelope or StorageUsageRecords, got %s", start.Name.Local)
+	}
+	if b.XMLName.Local == "" {
+		b.XMLName = start.Name
+	}
+	var decls []xml.Attr
+	for _, a := range start.Attr {
+		if a.Name.Space == "xmlns" {
+			decls = append(decls, a)
+		}
+	}
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "StorageUsageRecords" {
+				t.Attr = declareNamespaces(t.Attr, decls)
+				if err := b.UnmarshalXML(d, t); err != nil {
+					return err
+				}
+				continue
+			}
+			t.Attr = declareNamespaces(t.Attr, decls)
+			var r XMLRecord
+			if err := d.DecodeElement(&r, &t); err != nil {
+				return err
+			}
+			rt, ok := LookupRecordType(t.Name.Local)
+			if !ok {
+				b.OtherRecords = append(b.OtherRecords, r)
+				continue
+			}
+			// parse the record on its own, so that an invalid record
+			// doesn't fail the rest of the bundle
+			rec := rt.New()
+			if err := rec.ParseXML(r.Raw()); err != nil {
+				b.InvalidRecords = append(b.InvalidRecords, InvalidRecord{r, err})
+				continue
+			}
+			b.records = append(b.records, rec)
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// SplitRecordXML returns the records in record XML x: x itself, or if x is
+// an EMI StAR StorageUsageRecords document, each of its StorageUsageRecords,
+// with the namespaces that are declared on the document declared on them.
+func SplitRecordXML(x []byte) ([][]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(x))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse record XML: %s", err)
+		}
+		if start, ok := t.(xml.StartElement); ok {
+			if start.Name.Local != "StorageUsageRecords" {
+				return [][]byte{x}, nil
+			}
+			return splitStorageUsageRecords(d, start)
+		}
+	}
+}
+
+// splitStorageUsageRecords returns the raw XML of each record in the
+// StorageUsageRecords document that starts with start.
+func splitStorageUsageRecords(d *xml.Decoder, start xml.StartElement) ([][]byte, error) {
+	var decls []xml.Attr
+	for _, a := range start.Attr {
+		if a.Name.Space == "xmlns" {
+			decls = append(decls, a)
+		}
+	}
+	var xs [][]byte
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse StorageUsageRecords: %s", err)
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			t.Attr = declareNamespaces(t.Attr, decls)
+			var r XMLRecord
+			if err := d.DecodeElement(&r, &t); err != nil {
+				return nil, fmt.Errorf("unable to parse StorageUsageRecords: %s", err)
+			}
+			xs = append(xs, r.Raw())
+		case xml.EndElement:
+			return xs, nil
+		}
+	}
+}
+
+// declareNamespaces returns the attributes attrs of a record's start
+// element, preceded by the prefixed namespace declarations decls that aren't
+// already among them.
+func declareNamespaces(attrs, decls []xml.Attr) []xml.Attr {
+	declared := make(map[string]bool)
+	for _, a := range attrs {
+		if a.Name.Space == "xmlns" {
+			declared[a.Name.Local] = true
+		}
+	}
+	var r []xml.Attr
+	for _, a := range decls {
+		if !declared[a.Name.Local] {
+			r = append(r, a)
+		}
+	}
+	return append(r, attrs...)
 }
 
 // RecordCount returns the total number of records in the bundle.
 func (b *RecordBundle) RecordCount() int {
-	return len(b.UsageRecords) +
-		len(b.JobUsageRecords) +
-		len(b.StorageElements) +
-		len(b.StorageElementRecords) +
-		len(b.OtherRecords)
+	return len(b.records) + len(b.OtherRecords) + len(b.InvalidRecords)
 }
 
-// Records returns all recognized records. Records that did not match
-// a known type (i.e. those that are in OtherRecords) are not included!
+// Records returns all recognized and generic records, in the order they
+// were unmarshalled or added. Records that did not match a known type (i.e.
+// those that are in OtherRecords) are not included!
 func (b *RecordBundle) Records() chan Record {
-	recs := make(chan Record, b.RecordCount())
+	recs := make(chan Record, len(b.records))
 	defer close(recs)
-	for i, _ := range b.UsageRecords {
-		recs <- &b.UsageRecords[i]
-	}
-	for i, _ := range b.JobUsageRecords {
-		recs <- &b.JobUsageRecords[i]
+	for _, rec := range b.records {
+		recs <- rec
 	}
-	for i, _ := range b.StorageElements {
-		recs <- &b.StorageElements[i]
+	return recs
+}
+
+// TypeCounts returns the number of records of each type in the bundle,
+// including those in OtherRecords.
+func (b *RecordBundle) TypeCounts() map[string]int {
+	n := make(map[string]int)
+	for _, rec := range b.records {
+		n[rec.Type()]++
 	}
-	for i, _ := range b.StorageElementRecords {
-		recs <- &b.StorageElementRecords[i]
+	for _, r := range b.OtherRecords {
+		n[r.XMLName.Local]++
 	}
-	return recs
+	return n
 }
 
-// AddRecord attempts to coerce rec into a known type and add it to the
-// appropriate list. Otherwise, it is added to OtherRecords.
+// AddRecord adds rec to the bundle.
 func (b *RecordBundle) AddRecord(rec Record) error {
-	switch rec.(type) {
-	case *JobUsageRecord:
-		b.JobUsageRecords = append(b.JobUsageRecords, *rec.(*JobUsageRecord))
-	case *StorageElement:
-		b.StorageElements = append(b.StorageElements, *rec.(*StorageElement))
-	case *StorageElementRecord:
-		b.StorageElementRecords = append(b.StorageElementRecords, *rec.(*StorageElementRecord))
-	default:
-		b.OtherRecords = append(b.OtherRecords, XMLRecord{
-			XMLName:  xml.Name{Local: rec.Type()},
-			InnerXML: string(rec.Raw()),
-		})
-	}
+	b.records = append(b.records, rec)
 	return nil
 }
+
+// ParseOtherRecords converts the records in OtherRecords to GenericRecords,
+// and adds them to the bundle, so that they are included in Records. Any
+// that can't be parsed are left in OtherRecords.
+func (b *RecordBundle) ParseOtherRecords() {
+	var others []XMLRecord
+	for _, r := range b.OtherRecords {
+		gr, err := ParseGenericRecordXML(r.Raw())
+		if err != nil {
+			others = append(others, r)
+			continue
+		}
+		b.records = append(b.records, gr)
+	}
+	b.OtherRecords = others
+}
+
+// bundleRecordXML returns the XML of rec for a bundle: recognized records
+// in the UR-WG namespace (see MarshalRecordXML), and generic records as they
+// were received.
+func bundleRecordXML(rec Record) ([]byte, error) {
+	if gr, ok := rec.(*GenericRecord); ok {
+		return gr.Raw(), nil
+	}
+	return MarshalRecordXML(rec)
+}
+
+// ToXML returns the bundle as a RecordEnvelope, as would be sent from a
+// probe. Recognized records are in the UR-WG namespace (see
+// MarshalRecordXML); other records are included as they were received.
+func (b *RecordBundle) ToXML() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<RecordEnvelope>\n")
+	for rec := range b.Records() {
+		x, err := bundleRecordXML(rec)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(bytes.TrimSpace(x))
+		buf.WriteString("\n")
+	}
+	for _, r := range b.OtherRecords {
+		buf.Write(r.Raw())
+		buf.WriteString("\n")
+	}
+	buf.WriteString("</RecordEnvelope>\n")
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,149 @@
+package gracc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client sends records to a Gratia-compatible collector, as a Gratia probe
+// or collector would, using the collector's /gratia-servlets/rmi servlet.
+type Client struct {
+	// URL is the URL of the servlet,
+	// e.g. "http://localhost:8080/gratia-servlets/rmi".
+	URL string
+	// From identifies the sender to the collector.
+	From string
+	// Retries is the number of times to retry a request that fails with an
+	// error that may succeed later, e.g. the collector is unavailable.
+	Retries int
+	// RetryWait is the time to wait before the first retry; it is doubled
+	// for each subsequent retry.
+	RetryWait time.Duration
+	// HTTPClient is the client used to make requests.
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client that sends to the servlet at url, identifying
+// itself as from, with the default retry policy.
+func NewClient(url, from string) *Client {
+	return &Client{
+		URL:        url,
+		From:       from,
+		Retries:    3,
+		RetryWait:  time.Second,
+		HTTPClient: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// ResponseError is an error response from the collector.
+type ResponseError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Body != "" {
+		return fmt.Sprintf("collector responded %s: %s", e.Status, e.Body)
+	}
+	return fmt.Sprintf("collector responded %s", e.Status)
+}
+
+// Temporary returns true if the request may succeed if it is retried later,
+// i.e. the collector is unavailable or overloaded.
+func (e *ResponseError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// Ping checks that the collector is accepting requests.
+func (c *Client) Ping() error {
+	return c.post(url.Values{
+		"command":    {"update"},
+		"from":       {c.From},
+		"arg1":       {"xxx"},
+		"bundlesize": {"1"},
+	})
+}
+
+// Update sends a replication bundle, as sent by a Gratia collector,
+// containing size records.
+func (c *Client) Update(bundle string, size int) error {
+	return c.post(url.Values{
+		"command":    {"update"},
+		"from":       {c.From},
+		"arg1":       {bundle},
+		"bundlesize": {strconv.Itoa(size)},
+	})
+}
+
+// UpdateRecords sends the records in bundle b as a replication bundle (see
+// RecordBundle.ToReplicationBundle).
+func (c *Client) UpdateRecords(b *RecordBundle) error {
+	bundle, size, err := b.ToReplicationBundle()
+	if err != nil {
+		return err
+	}
+	return c.Update(bundle, size)
+}
+
+// MultiUpdate sends a RecordEnvelope bundle, as sent by a Gratia probe.
+func (c *Client) MultiUpdate(envelope string) error {
+	return c.post(url.Values{
+		"command": {"multiupdate"},
+		"from":    {c.From},
+		"arg1":    {envelope},
+	})
+}
+
+// post posts form v to the collector, retrying if it fails with a
+// temporary error.
+func (c *Client) post(v url.Values) error {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	wait := c.RetryWait
+	var err error
+	for try := 0; ; try++ {
+		var retry bool
+		if retry, err = c.postOnce(client, v); err == nil || !retry || try >= c.Retries {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// postOnce posts form v once, and returns whether the request should be
+// retried if it failed.
+func (c *Client) postOnce(client *http.Client, v url.Values) (bool, error) {
+	resp, err := client.PostForm(c.URL, v)
+	if err != nil {
+		// the collector may be down or restarting
+		return true, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+	body := strings.TrimSpace(string(b))
+	rerr := &ResponseError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       body,
+	}
+	if resp.StatusCode != http.StatusOK {
+		return rerr.Temporary(), rerr
+	}
+	// Gratia collectors respond 200 with an error message in the body.
+	if !strings.HasPrefix(body, "OK") {
+		return false, rerr
+	}
+	return false, nil
+}
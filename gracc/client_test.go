@@ -0,0 +1,121 @@
+package gracc
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeCollector responds to each request with the next of responses, and
+// records the forms it receives.
+type fakeCollector struct {
+	responses []int
+	forms     []map[string]string
+}
+
+func (f *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	form := make(map[string]string)
+	for k := range r.PostForm {
+		form[k] = r.PostForm.Get(k)
+	}
+	f.forms = append(f.forms, form)
+	status := http.StatusOK
+	if len(f.responses) > 0 {
+		status, f.responses = f.responses[0], f.responses[1:]
+	}
+	if status == http.StatusOK {
+		fmt.Fprint(w, "OK")
+		return
+	}
+	http.Error(w, "error", status)
+}
+
+func testClient(t *testing.T, f *fakeCollector) (*Client, func()) {
+	srv := httptest.NewServer(f)
+	c := NewClient(srv.URL+"/gratia-servlets/rmi", "test")
+	c.RetryWait = time.Millisecond
+	return c, srv.Close
+}
+
+func TestClientRequests(t *testing.T) {
+	f := &fakeCollector{}
+	c, done := testClient(t, f)
+	defer done()
+
+	if err := c.Ping(); err != nil {
+		t.Error(err)
+	}
+	if err := c.Update("replication|<JobUsageRecord/>|||", 1); err != nil {
+		t.Error(err)
+	}
+	if err := c.MultiUpdate("<RecordEnvelope></RecordEnvelope>"); err != nil {
+		t.Error(err)
+	}
+	for i, exp := range []map[string]string{
+		{"command": "update", "from": "test", "arg1": "xxx", "bundlesize": "1"},
+		{"command": "update", "from": "test", "arg1": "replication|<JobUsageRecord/>|||", "bundlesize": "1"},
+		{"command": "multiupdate", "from": "test", "arg1": "<RecordEnvelope></RecordEnvelope>"},
+	} {
+		if i >= len(f.forms) {
+			t.Fatalf("expected %d requests, got %d", i+1, len(f.forms))
+		}
+		if len(f.forms[i]) != len(exp) {
+			t.Errorf("request %d: expected %v, got %v", i, exp, f.forms[i])
+		}
+		for k, v := range exp {
+			if f.forms[i][k] != v {
+				t.Errorf("request %d: expected %s=%s, got %s", i, k, v, f.forms[i][k])
+			}
+		}
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	// temporary errors are retried
+	f := &fakeCollector{responses: []int{503, 503, 200}}
+	c, done := testClient(t, f)
+	defer done()
+	if err := c.Ping(); err != nil {
+		t.Error(err)
+	}
+	if len(f.forms) != 3 {
+		t.Errorf("expected 3 requests, got %d", len(f.forms))
+	}
+
+	// until they run out
+	f.forms = nil
+	f.responses = []int{503, 503, 503, 503, 503}
+	err := c.Ping()
+	if rerr, ok := err.(*ResponseError); !ok || rerr.StatusCode != 503 || !rerr.Temporary() {
+		t.Errorf("expected temporary ResponseError, got %T: %v", err, err)
+	}
+	if len(f.forms) != c.Retries+1 {
+		t.Errorf("expected %d requests, got %d", c.Retries+1, len(f.forms))
+	}
+
+	// other errors are not
+	f.forms = nil
+	f.responses = []int{400}
+	err = c.Ping()
+	if rerr, ok := err.(*ResponseError); !ok || rerr.StatusCode != 400 || rerr.Temporary() {
+		t.Errorf("expected permanent ResponseError, got %T: %v", err, err)
+	}
+	if len(f.forms) != 1 {
+		t.Errorf("expected 1 request, got %d", len(f.forms))
+	}
+}
+
+func TestClientErrorBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Error: bad record")
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, "test")
+	err := c.Ping()
+	if rerr, ok := err.(*ResponseError); !ok || rerr.Body != "Error: bad record" {
+		t.Errorf("expected ResponseError with body, got %T: %v", err, err)
+	}
+}
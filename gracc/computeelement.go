@@ -0,0 +1,137 @@
+package gracc
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"time"
+)
+
+// ComputeElement describes a compute element (CE) and its batch system, e.g.
+// its capacity in job slots.
+type ComputeElement struct {
+	XMLName   xml.Name
+	UniqueID  string    `xml:",omitempty"`
+	Timestamp time.Time `xml:",omitempty"`
+	// Counts are pointers so that zero counts are distinguished from
+	// counts that aren't reported.
+	MaxRunningJobs   *uint64 `xml:",omitempty"`
+	MaxTotalJobs     *uint64 `xml:",omitempty"`
+	AssignedJobSlots *uint64 `xml:",omitempty"`
+	Origin           origin  `xml:",omitempty"`
+	Fields           []field `xml:",any"`
+	RawXML           []byte  `xml:",innerxml"`
+	raw              []byte
+}
+
+func init() {
+	RegisterRecordType(RecordType{
+		Names: []string{"ComputeElement"},
+		New:   func() ParsableRecord { return &ComputeElement{} },
+	})
+}
+
+// ParseXML attempts to unmarshal the XML in xb into a ComputeElement.
+func (ce *ComputeElement) ParseXML(xb []byte) error {
+	if err := xml.Unmarshal(xb, ce); err != nil {
+		return err
+	}
+	ce.raw = recordBytes(xb)
+	return nil
+}
+
+type computeElement ComputeElement
+
+// UnmarshalXML unmarshals the record, keeping its start element for Raw.
+func (ce *ComputeElement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if err := d.DecodeElement((*computeElement)(ce), &start); err != nil {
+		return err
+	}
+	ce.raw = rawRecord(start, ce.RawXML)
+	return nil
+}
+
+// Id returns an identification string for the record.
+func (ce *ComputeElement) Id() string {
+	return ce.UniqueID
+}
+
+// Type returns the type of the record.
+func (ce *ComputeElement) Type() string {
+	return ce.XMLName.Local
+}
+
+// ProbeName returns the ProbeName element of the record, if it has one.
+func (ce *ComputeElement) ProbeName() string {
+	return fieldValue(ce.Fields, "ProbeName")
+}
+
+// Identity returns the values that identify the record, so that the same
+// record sent again can be recognized: its UniqueID and Timestamp, since
+// the UniqueID is repeated in each report.
+func (ce *ComputeElement) Identity() string {
+	return ce.UniqueID + "\x00" + ce.Timestamp.String()
+}
+
+// Raw returns the source of the record.
+func (ce *ComputeElement) Raw() []byte {
+	if ce.raw != nil {
+		return ce.raw
+	}
+	s := "<" + ce.XMLName.Local + ">" + string(ce.RawXML) + "</" + ce.XMLName.Local + ">"
+	return []byte(s)
+}
+
+// Fingerprint returns a checksum of the record's canonical XML.
+func (ce *ComputeElement) Fingerprint() string {
+	return fingerprint(ce.Raw())
+}
+
+// ToJSON returns a JSON encoding of the Record, with certain elements
+// transformed to fit the GRACC Raw Record schema.
+// Indent specifies the string to use for each indentation level,
+// if empty no indentation or pretty-printing is performed.
+func (ce *ComputeElement) ToJSON(indent string) ([]byte, error) {
+	var r = make(map[string]interface{})
+
+	r["type"] = "ComputeElement"
+
+	r["UniqueID"] = ce.UniqueID
+
+	// Standard time instants
+	if !ce.Timestamp.IsZero() {
+		r["Timestamp"] = ce.Timestamp.Format(time.RFC3339)
+	}
+
+	// data fields
+	setCount(r, "MaxRunningJobs", ce.MaxRunningJobs)
+	setCount(r, "MaxTotalJobs", ce.MaxTotalJobs)
+	setCount(r, "AssignedJobSlots", ce.AssignedJobSlots)
+
+	// flatten other fields
+	for _, f := range ce.Fields {
+		for k, v := range f.flatten() {
+			r[k] = v
+		}
+	}
+
+	// origin
+	for k, v := range ce.Origin.flatten() {
+		r[k] = v
+	}
+
+	// add XML
+	r["RawXML"] = string(ce.Raw())
+	r["Fingerprint"] = ce.Fingerprint()
+
+	if indent != "" {
+		return json.MarshalIndent(r, "", indent)
+	}
+	return json.Marshal(r)
+}
+
+// setCount sets r[k] to count n, if it was reported.
+func setCount(r map[string]interface{}, k string, n *uint64) {
+	if n != nil {
+		r[k] = *n
+	}
+}
@@ -0,0 +1,134 @@
+package gracc
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"time"
+)
+
+// ComputeElementRecord reports the jobs of a VO on a compute element at a
+// point in time.
+type ComputeElementRecord struct {
+	XMLName   xml.Name
+	UniqueID  string    `xml:",omitempty"`
+	VO        string    `xml:",omitempty"`
+	Timestamp time.Time `xml:",omitempty"`
+	// Counts are pointers so that zero counts are distinguished from
+	// counts that aren't reported.
+	RunningJobs *uint64 `xml:",omitempty"`
+	WaitingJobs *uint64 `xml:",omitempty"`
+	TotalJobs   *uint64 `xml:",omitempty"`
+	Origin      origin  `xml:",omitempty"`
+	Fields      []field `xml:",any"`
+	RawXML      []byte  `xml:",innerxml"`
+	raw         []byte
+}
+
+func init() {
+	RegisterRecordType(RecordType{
+		Names: []string{"ComputeElementRecord"},
+		New:   func() ParsableRecord { return &ComputeElementRecord{} },
+	})
+}
+
+// ParseXML attempts to unmarshal the XML in xb into a ComputeElementRecord.
+func (cer *ComputeElementRecord) ParseXML(xb []byte) error {
+	if err := xml.Unmarshal(xb, cer); err != nil {
+		return err
+	}
+	cer.raw = recordBytes(xb)
+	return nil
+}
+
+type computeElementRecord ComputeElementRecord
+
+// UnmarshalXML unmarshals the record, keeping its start element for Raw.
+func (cer *ComputeElementRecord) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if err := d.DecodeElement((*computeElementRecord)(cer), &start); err != nil {
+		return err
+	}
+	cer.raw = rawRecord(start, cer.RawXML)
+	return nil
+}
+
+// Id returns an identification string for the record.
+func (cer *ComputeElementRecord) Id() string {
+	return cer.UniqueID
+}
+
+// Type returns the type of the record.
+func (cer *ComputeElementRecord) Type() string {
+	return cer.XMLName.Local
+}
+
+// ProbeName returns the ProbeName element of the record, if it has one.
+func (cer *ComputeElementRecord) ProbeName() string {
+	return fieldValue(cer.Fields, "ProbeName")
+}
+
+// Identity returns the values that identify the record, so that the same
+// record sent again can be recognized: its UniqueID, VO and Timestamp, since
+// the UniqueID is repeated in each report.
+func (cer *ComputeElementRecord) Identity() string {
+	return cer.UniqueID + "\x00" + cer.VO + "\x00" + cer.Timestamp.String()
+}
+
+// Raw returns the source of the record.
+func (cer *ComputeElementRecord) Raw() []byte {
+	if cer.raw != nil {
+		return cer.raw
+	}
+	s := "<" + cer.XMLName.Local + ">" + string(cer.RawXML) + "</" + cer.XMLName.Local + ">"
+	return []byte(s)
+}
+
+// Fingerprint returns a checksum of the record's canonical XML.
+func (cer *ComputeElementRecord) Fingerprint() string {
+	return fingerprint(cer.Raw())
+}
+
+// ToJSON returns a JSON encoding of the Record, with certain elements
+// transformed to fit the GRACC Raw Record schema.
+// Indent specifies the string to use for each indentation level,
+// if empty no indentation or pretty-printing is performed.
+func (cer *ComputeElementRecord) ToJSON(indent string) ([]byte, error) {
+	var r = make(map[string]interface{})
+
+	r["type"] = "ComputeElementRecord"
+
+	r["UniqueID"] = cer.UniqueID
+	if cer.VO != "" {
+		r["VO"] = cer.VO
+	}
+
+	// Standard time instants
+	if !cer.Timestamp.IsZero() {
+		r["Timestamp"] = cer.Timestamp.Format(time.RFC3339)
+	}
+
+	// data fields
+	setCount(r, "RunningJobs", cer.RunningJobs)
+	setCount(r, "WaitingJobs", cer.WaitingJobs)
+	setCount(r, "TotalJobs", cer.TotalJobs)
+
+	// flatten other fields
+	for _, f := range cer.Fields {
+		for k, v := range f.flatten() {
+			r[k] = v
+		}
+	}
+
+	// origin
+	for k, v := range cer.Origin.flatten() {
+		r[k] = v
+	}
+
+	// add XML
+	r["RawXML"] = string(cer.Raw())
+	r["Fingerprint"] = cer.Fingerprint()
+
+	if indent != "" {
+		return json.MarshalIndent(r, "", indent)
+	}
+	return json.Marshal(r)
+}
@@ -0,0 +1,107 @@
+package gracc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"sort"
+	"strings"
+)
+
+// fingerprint returns the hex md5 checksum of the canonical form of record
+// XML x (see canonicalXML), or of x itself if it can't be parsed. Records'
+// Fingerprint methods return the fingerprint of their Raw XML, so it is the
+// same for records that differ only in formatting, namespace prefixes, or
+// Origin hops.
+func fingerprint(x []byte) string {
+	c, err := canonicalXML(x)
+	if err != nil {
+		c = x
+	}
+	h := md5.Sum(c)
+	return hex.EncodeToString(h[:])
+}
+
+// canonicalXML returns a canonical form of record XML x, so that records
+// that differ only in formatting or in how they were forwarded have the same
+// fingerprint:
+//
+//   - namespace prefixes and declarations are removed
+//   - attributes are sorted by name
+//   - leading and trailing whitespace in character data is removed, and
+//     internal runs of whitespace are collapsed to a single space
+//   - comments, processing instructions and directives are removed
+//   - Origin elements of the record, which record the collectors a record has
+//     passed through, are removed
+//   - attributes of the record element are removed
+func canonicalXML(x []byte) ([]byte, error) {
+	var b bytes.Buffer
+	d := xml.NewDecoder(bytes.NewReader(x))
+	depth := 0
+	skip := 0
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if skip > 0 {
+			switch t.(type) {
+			case xml.StartElement:
+				skip++
+			case xml.EndElement:
+				skip--
+			}
+			continue
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if depth == 1 && t.Name.Local == "Origin" {
+				skip = 1
+				continue
+			}
+			if depth == 0 {
+				// attributes of the record element (namespace declarations
+				// and schema locations) aren't part of the record
+				t.Attr = nil
+			}
+			depth++
+			writeCanonicalStart(&b, t)
+		case xml.EndElement:
+			depth--
+			b.WriteString("</" + t.Name.Local + ">")
+		case xml.CharData:
+			if s := strings.Join(strings.Fields(string(t)), " "); s != "" {
+				xml.EscapeText(&b, []byte(s))
+			}
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func writeCanonicalStart(b *bytes.Buffer, t xml.StartElement) {
+	var attrs []xml.Attr
+	for _, a := range t.Attr {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	sort.Sort(attrsByName(attrs))
+	b.WriteString("<" + t.Name.Local)
+	for _, a := range attrs {
+		b.WriteString(" " + a.Name.Local + "=\"")
+		xml.EscapeText(b, []byte(a.Value))
+		b.WriteString("\"")
+	}
+	b.WriteString(">")
+}
+
+type attrsByName []xml.Attr
+
+func (a attrsByName) Len() int           { return len(a) }
+func (a attrsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a attrsByName) Less(i, j int) bool { return a[i].Name.Local < a[j].Name.Local }
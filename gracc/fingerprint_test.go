@@ -0,0 +1,51 @@
+package gracc
+
+import "testing"
+
+var fingerprintTests = []struct {
+	a, b string
+	same bool
+}{
+	{
+		`<JobUsageRecord xmlns:urwg="http://www.gridforum.org/2003/ur-wg"><RecordIdentity urwg:recordId="r1" urwg:createTime="2016-05-27T22:46:46Z"/><SiteName>X</SiteName></JobUsageRecord>`,
+		`<JobUsageRecord xmlns:ur="http://www.gridforum.org/2003/ur-wg">
+		    <RecordIdentity ur:createTime="2016-05-27T22:46:46Z" ur:recordId="r1" />
+		    <!-- comment -->
+		    <SiteName>
+		        X
+		    </SiteName>
+		</JobUsageRecord>`,
+		true,
+	},
+	{
+		`<JobUsageRecord><RecordIdentity recordId="r1"/><Origin hop="1"><ServerDate>2016-05-27T22:46:59Z</ServerDate></Origin></JobUsageRecord>`,
+		`<JobUsageRecord><RecordIdentity recordId="r1"/><Origin hop="1"><ServerDate>2016-05-27T22:46:59Z</ServerDate></Origin><Origin hop="2"><ServerDate>2016-05-27T22:47:03Z</ServerDate></Origin></JobUsageRecord>`,
+		true,
+	},
+	{
+		`<JobUsageRecord><RecordIdentity recordId="r1"/><SiteName>X</SiteName></JobUsageRecord>`,
+		`<JobUsageRecord><RecordIdentity recordId="r1"/><SiteName>Y</SiteName></JobUsageRecord>`,
+		false,
+	},
+	{
+		`<JobUsageRecord><RecordIdentity recordId="r1"/><SiteName>X Y</SiteName></JobUsageRecord>`,
+		`<JobUsageRecord><RecordIdentity recordId="r1"/><SiteName>XY</SiteName></JobUsageRecord>`,
+		false,
+	},
+}
+
+func TestFingerprint(t *testing.T) {
+	for i, ft := range fingerprintTests {
+		a, err := ParseRecordXML([]byte(ft.a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseRecordXML([]byte(ft.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if same := a.Fingerprint() == b.Fingerprint(); same != ft.same {
+			t.Errorf("test %d: expected same fingerprint %v, got %s and %s", i, ft.same, a.Fingerprint(), b.Fingerprint())
+		}
+	}
+}
@@ -0,0 +1,674 @@
+package gracc
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecordFromJSON returns the record that JSON raw record j was created from
+// by ToJSON. If j has the RawXML field, it is parsed; otherwise, if the
+// record's type has a FromJSON method, the record is reconstructed from the
+// other fields. A reconstructed record has the same JSON encoding, but since
+// the order of elements is lost, not necessarily the same XML or fingerprint.
+func RecordFromJSON(j []byte) (Record, error) {
+	r, err := decodeJSONRecord(j)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := LookupRecordType(jsonString(r["type"]))
+	if !ok {
+		return nil, fmt.Errorf("unknown record type \"%s\"", jsonString(r["type"]))
+	}
+	rec := t.New()
+	if fj, ok := rec.(interface {
+		FromJSON(j []byte) error
+	}); ok {
+		err = fj.FromJSON(j)
+	} else if x := r.rawXML(); x != nil {
+		err = rec.ParseXML(x)
+	} else {
+		err = fmt.Errorf("%s records can't be converted from JSON without RawXML", jsonString(r["type"]))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// FromJSON sets jur to the record that JSON raw record j was created from.
+// Some characters in Resource descriptions are lost in a reconstructed
+// record.
+func (jur *JobUsageRecord) FromJSON(j []byte) error {
+	r, err := decodeJSONRecord(j)
+	if err != nil {
+		return err
+	}
+	return jur.fromJSON(r)
+}
+
+// FromJSON sets se to the record that JSON raw record j was created from.
+func (se *StorageElement) FromJSON(j []byte) error {
+	r, err := decodeJSONRecord(j)
+	if err != nil {
+		return err
+	}
+	return se.fromJSON(r)
+}
+
+// FromJSON sets ser to the record that JSON raw record j was created from.
+func (ser *StorageElementRecord) FromJSON(j []byte) error {
+	r, err := decodeJSONRecord(j)
+	if err != nil {
+		return err
+	}
+	return ser.fromJSON(r)
+}
+
+// FromJSON sets ce to the record that JSON raw record j was created from.
+func (ce *ComputeElement) FromJSON(j []byte) error {
+	r, err := decodeJSONRecord(j)
+	if err != nil {
+		return err
+	}
+	return ce.fromJSON(r)
+}
+
+// FromJSON sets cer to the record that JSON raw record j was created from.
+func (cer *ComputeElementRecord) FromJSON(j []byte) error {
+	r, err := decodeJSONRecord(j)
+	if err != nil {
+		return err
+	}
+	return cer.fromJSON(r)
+}
+
+// FromJSON sets sc to the record that JSON raw record j was created from.
+func (sc *Subcluster) FromJSON(j []byte) error {
+	r, err := decodeJSONRecord(j)
+	if err != nil {
+		return err
+	}
+	return sc.fromJSON(r)
+}
+
+// FromJSON sets pd to the record that JSON raw record j was created from.
+func (pd *ProbeDetails) FromJSON(j []byte) error {
+	r, err := decodeJSONRecord(j)
+	if err != nil {
+		return err
+	}
+	return pd.fromJSON(r)
+}
+
+// FromJSON sets sur to the record that JSON raw record j was created from.
+// A reconstructed record is in the StAR namespace.
+func (sur *StorageUsageRecord) FromJSON(j []byte) error {
+	r, err := decodeJSONRecord(j)
+	if err != nil {
+		return err
+	}
+	return sur.fromJSON(r)
+}
+
+// jsonRecord is a decoded JSON raw record.
+type jsonRecord map[string]interface{}
+
+func decodeJSONRecord(j []byte) (jsonRecord, error) {
+	var r jsonRecord
+	d := json.NewDecoder(bytes.NewReader(j))
+	d.UseNumber()
+	if err := d.Decode(&r); err != nil {
+		return nil, fmt.Errorf("unable to parse record JSON: %s", err)
+	}
+	return r, nil
+}
+
+// rawXML returns the RawXML of r, if any.
+func (r jsonRecord) rawXML() []byte {
+	if x := jsonString(r["RawXML"]); x != "" {
+		return []byte(x)
+	}
+	return nil
+}
+
+// take returns the value of key k as a string, and whether it was present,
+// and marks it as used by deleting it.
+func (r jsonRecord) take(k string) (string, bool) {
+	v, ok := r[k]
+	delete(r, k)
+	return jsonString(v), ok
+}
+
+// takeSeconds returns the value of key k, in seconds, as a duration.
+func (r jsonRecord) takeSeconds(k string) (time.Duration, bool, error) {
+	s, ok := r.take(k)
+	if !ok {
+		return 0, false, nil
+	}
+	d, err := secondsToDuration(s)
+	if err != nil {
+		return 0, false, fmt.Errorf("%s: %s", k, err)
+	}
+	return d, true, nil
+}
+
+// takeTime returns the value of key k as a time.
+func (r jsonRecord) takeTime(k string) (time.Time, bool, error) {
+	s, ok := r.take(k)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%s: %s", k, err)
+	}
+	return t, true, nil
+}
+
+// takeAttrs returns the attributes of the element flattened to key k, i.e.
+// the values of keys k+"_"+attr.
+func (r jsonRecord) takeAttrs(k string, attrs ...string) ([]string, error) {
+	var as []string
+	for _, a := range attrs {
+		v, ok := r.take(k + "_" + a)
+		if !ok {
+			continue
+		}
+		if a == "phaseUnit" {
+			d, err := secondsToDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s_%s: %s", k, a, err)
+			}
+			v = FormatDuration(d)
+		}
+		as = append(as, a, v)
+	}
+	return as, nil
+}
+
+// fieldAttrNames are the attributes of other elements that are flattened to
+// keys (see field.flatten).
+var fieldAttrNames = []string{"description", "unit", "phaseUnit", "storageUnit", "formula", "metric"}
+
+// takeOrigin adds the Origin element flattened in r, if any, to rb.
+func (r jsonRecord) takeOrigin(rb *recordBuilder) {
+	o := xmlElement{Name: "Origin"}
+	var conn []xmlElement
+	if v, ok := r.take("Origin_hop"); ok {
+		o.Attrs = append(o.Attrs, urwgAttr("hop", v))
+	}
+	if v, ok := r.take("OriginServerDate"); ok {
+		o.Children = append(o.Children, xmlElement{Name: "ServerDate", Value: v})
+	}
+	for _, k := range []string{"SenderHost", "Sender", "Collector"} {
+		if v, ok := r.take("Origin" + k); ok {
+			conn = append(conn, xmlElement{Name: k, Value: v})
+		}
+	}
+	if len(conn) > 0 {
+		o.Children = append(o.Children, xmlElement{Name: "Connection", Children: conn})
+	}
+	if len(o.Attrs) > 0 || len(o.Children) > 0 {
+		rb.elems = append(rb.elems, o)
+	}
+}
+
+// takeFields adds the remaining keys of r as elements of rb, in order of
+// name, with their flattened attributes.
+func (r jsonRecord) takeFields(rb *recordBuilder) error {
+	// these are added by ToJSON, or by the collector
+	for _, k := range []string{"type", "RawXML", "Fingerprint", "Duplicate"} {
+		delete(r, k)
+	}
+	var keys []string
+	for k := range r {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	isAttr := func(k string) bool {
+		for _, a := range fieldAttrNames {
+			if base := strings.TrimSuffix(k, "_"+a); base != k {
+				if _, ok := r[base]; ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	var fields []string
+	for _, k := range keys {
+		if !isAttr(k) {
+			fields = append(fields, k)
+		}
+	}
+	for _, k := range fields {
+		v, _ := r.take(k)
+		as, err := r.takeAttrs(k, fieldAttrNames...)
+		if err != nil {
+			return err
+		}
+		if err := addField(rb, k, v, as); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takePrefixed adds the keys of r with prefix, except those that are
+// attributes suffixed with one of attrs, as elements named name, with the
+// rest of the key as attribute key, and the value converted by conv.
+func (r jsonRecord) takePrefixed(rb *recordBuilder, prefix, name, key string, conv func(string) (string, error), attrs ...string) error {
+	var keys []string
+	for k := range r {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+Keys:
+	for _, k := range keys {
+		for _, a := range attrs {
+			if base := strings.TrimSuffix(k, "_"+a); base != k {
+				if _, ok := r[base]; ok {
+					continue Keys
+				}
+			}
+		}
+		if _, ok := r[k]; !ok {
+			continue
+		}
+		v, _ := r.take(k)
+		v, err := conv(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s", k, err)
+		}
+		as, err := r.takeAttrs(k, attrs...)
+		if err != nil {
+			return err
+		}
+		xas, err := fieldAttrs(name, append([]string{key, strings.TrimPrefix(k, prefix)}, as...))
+		if err != nil {
+			return err
+		}
+		rb.add(name, v, xas...)
+	}
+	return nil
+}
+
+func (jur *JobUsageRecord) fromJSON(r jsonRecord) error {
+	if x := r.rawXML(); x != nil {
+		return jur.ParseXML(x)
+	}
+	id, _ := r.take("RecordId")
+	b := NewJobUsageRecordBuilder(id)
+	if t, ok, err := r.takeTime("CreateTime"); err != nil {
+		return err
+	} else if ok {
+		b.CreateTime(t)
+	}
+
+	// identity blocks
+	for _, k := range []string{"GlobalJobId", "LocalJobId", "ProcessId"} {
+		if v, ok := r.take(k); ok {
+			b.job = append(b.job, xmlElement{Name: k, Value: v})
+		}
+	}
+	for n := 0; ; n++ {
+		v, ok := r.take(fmt.Sprintf("ProcessId%d", n))
+		if !ok {
+			break
+		}
+		b.ProcessId(v)
+	}
+	for _, k := range []string{"GlobalUsername", "LocalUserId", "VOName", "ReportableVOName", "CommonName", "DN"} {
+		if v, ok := r.take(k); ok {
+			b.user = append(b.user, xmlElement{Name: k, Value: v})
+		}
+	}
+
+	// standard times and durations
+	for _, k := range []string{"StartTime", "EndTime"} {
+		if t, ok, err := r.takeTime(k); err != nil {
+			return err
+		} else if ok {
+			b.set(k, formatTime(t))
+		}
+	}
+	if d, ok, err := r.takeSeconds("WallDuration"); err != nil {
+		return err
+	} else if ok {
+		as, _ := r.takeAttrs("WallDuration", "description")
+		if err := setField(&b.recordBuilder, "WallDuration", FormatDuration(d), as); err != nil {
+			return err
+		}
+	}
+	total, _, err := r.takeSeconds("CpuDuration")
+	if err != nil {
+		return err
+	}
+	var typed bool
+	for _, u := range []string{"user", "system"} {
+		d, ok, err := r.takeSeconds("CpuDuration_" + u)
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		typed = true
+		as := []string{"usageType", u}
+		if v, ok := r.take("CpuDuration_" + u + "_description"); ok {
+			as = append(as, "description", v)
+		}
+		if err := addField(&b.recordBuilder, "CpuDuration", FormatDuration(d), as); err != nil {
+			return err
+		}
+	}
+	if !typed && total > 0 {
+		b.add("CpuDuration", FormatDuration(total))
+	}
+
+	// resources
+	switch rt, _ := r.take("ResourceType"); rt {
+	case "":
+	case "Payload":
+		b.ResourceType("BatchPilot")
+	default:
+		b.ResourceType(rt)
+	}
+	keep := func(s string) (string, error) { return s, nil }
+	if err := r.takePrefixed(&b.recordBuilder, "Resource_", "Resource", "description", keep, "unit", "phaseUnit", "storageUnit"); err != nil {
+		return err
+	}
+	if err := r.takePrefixed(&b.recordBuilder, "TimeDuration_", "TimeDuration", "type", func(s string) (string, error) {
+		d, err := secondsToDuration(s)
+		return FormatDuration(d), err
+	}, "description"); err != nil {
+		return err
+	}
+	if err := r.takePrefixed(&b.recordBuilder, "TimeInstant_", "TimeInstant", "type", keep, "description"); err != nil {
+		return err
+	}
+
+	r.takeOrigin(&b.recordBuilder)
+	if err := r.takeFields(&b.recordBuilder); err != nil {
+		return err
+	}
+	built, err := b.Build()
+	if err != nil {
+		return err
+	}
+	*jur = *built
+	return nil
+}
+
+func (se *StorageElement) fromJSON(r jsonRecord) error {
+	if x := r.rawXML(); x != nil {
+		return se.ParseXML(x)
+	}
+	id, _ := r.take("UniqueID")
+	b := NewStorageElementBuilder(id)
+	if t, ok, err := r.takeTime("Timestamp"); err != nil {
+		return err
+	} else if ok {
+		b.Timestamp(t)
+	}
+	r.takeOrigin(&b.recordBuilder)
+	if err := r.takeFields(&b.recordBuilder); err != nil {
+		return err
+	}
+	built, err := b.Build()
+	if err != nil {
+		return err
+	}
+	*se = *built
+	return nil
+}
+
+func (ser *StorageElementRecord) fromJSON(r jsonRecord) error {
+	if x := r.rawXML(); x != nil {
+		return ser.ParseXML(x)
+	}
+	id, _ := r.take("UniqueID")
+	b := NewStorageElementRecordBuilder(id)
+	if t, ok, err := r.takeTime("Timestamp"); err != nil {
+		return err
+	} else if ok {
+		b.Timestamp(t)
+	}
+	for _, k := range []string{"TotalSpace", "FreeSpace", "UsedSpace", "FileCount", "FileCountLimit"} {
+		if v, ok := r.take(k); ok {
+			if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+				return fmt.Errorf("%s: %s", k, err)
+			}
+			b.set(k, v)
+		}
+	}
+	r.takeOrigin(&b.recordBuilder)
+	if err := r.takeFields(&b.recordBuilder); err != nil {
+		return err
+	}
+	built, err := b.Build()
+	if err != nil {
+		return err
+	}
+	*ser = *built
+	return nil
+}
+
+func (ce *ComputeElement) fromJSON(r jsonRecord) error {
+	if x := r.rawXML(); x != nil {
+		return ce.ParseXML(x)
+	}
+	return r.buildElement(ce, "ComputeElement", []string{"UniqueID"}, []string{"MaxRunningJobs", "MaxTotalJobs", "AssignedJobSlots"}, nil)
+}
+
+func (cer *ComputeElementRecord) fromJSON(r jsonRecord) error {
+	if x := r.rawXML(); x != nil {
+		return cer.ParseXML(x)
+	}
+	return r.buildElement(cer, "ComputeElementRecord", []string{"UniqueID", "VO"}, []string{"RunningJobs", "WaitingJobs", "TotalJobs"}, nil)
+}
+
+func (sc *Subcluster) fromJSON(r jsonRecord) error {
+	if x := r.rawXML(); x != nil {
+		return sc.ParseXML(x)
+	}
+	return r.buildElement(sc, "Subcluster", []string{"UniqueID"},
+		[]string{"Hosts", "Cpus", "Cores", "SmpSize", "RAM", "VirtualMem"},
+		[]string{"Clock", "SpecInt2000", "SpecFloat2000", "BenchmarkValue"})
+}
+
+// buildElement reconstructs a record named root from r, with elements keys
+// first, followed by the Timestamp, counts and numbers, and parses it into
+// rec.
+func (r jsonRecord) buildElement(rec interface {
+	ParseXML([]byte) error
+}, root string, keys, counts, numbers []string) error {
+	var rb recordBuilder
+	for _, k := range keys {
+		if v, ok := r.take(k); ok {
+			rb.add(k, v)
+		}
+	}
+	if t, ok, err := r.takeTime("Timestamp"); err != nil {
+		return err
+	} else if ok {
+		rb.add("Timestamp", formatTime(t))
+	}
+	for _, k := range counts {
+		if v, ok := r.take(k); ok {
+			if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+				return fmt.Errorf("%s: %s", k, err)
+			}
+			rb.add(k, v)
+		}
+	}
+	for _, k := range numbers {
+		if v, ok := r.take(k); ok {
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				return fmt.Errorf("%s: %s", k, err)
+			}
+			rb.add(k, v)
+		}
+	}
+	r.takeOrigin(&rb)
+	if err := r.takeFields(&rb); err != nil {
+		return err
+	}
+	return rec.ParseXML(rb.render(root))
+}
+
+func (pd *ProbeDetails) fromJSON(r jsonRecord) error {
+	if x := r.rawXML(); x != nil {
+		return pd.ParseXML(x)
+	}
+	var rb recordBuilder
+	ri := xmlElement{Name: "RecordIdentity"}
+	for _, a := range [][2]string{{"RecordId", "recordId"}, {"CreateTime", "createTime"}} {
+		if v, ok := r.take(a[0]); ok {
+			ri.Attrs = append(ri.Attrs, urwgAttr(a[1], v))
+		}
+	}
+	if len(ri.Attrs) > 0 {
+		rb.elems = append(rb.elems, ri)
+	}
+	for _, k := range []string{"ProbeName", "SiteName", "Grid"} {
+		if v, ok := r.take(k); ok {
+			rb.add(k, v)
+		}
+	}
+	for _, k := range []string{"ReporterLibrary", "Reporter"} {
+		name, ok := r.take(k)
+		as, _ := r.takeAttrs(k, "version")
+		if ok || len(as) > 0 {
+			if err := addField(&rb, k, name, as); err != nil {
+				return err
+			}
+		}
+	}
+	var services []string
+	for k := range r {
+		if strings.HasPrefix(k, "Service_") {
+			services = append(services, k)
+		}
+	}
+	sort.Strings(services)
+	for _, k := range services {
+		v, _ := r.take(k)
+		rb.add("Service", strings.TrimPrefix(k, "Service_"), urwgAttr("version", v))
+	}
+	r.takeOrigin(&rb)
+	if err := r.takeFields(&rb); err != nil {
+		return err
+	}
+	return pd.ParseXML(rb.render("ProbeDetails"))
+}
+
+func (sur *StorageUsageRecord) fromJSON(r jsonRecord) error {
+	if x := r.rawXML(); x != nil {
+		return sur.ParseXML(x)
+	}
+	var rb recordBuilder
+	ri := xmlElement{Name: "RecordIdentity"}
+	for _, a := range [][2]string{{"RecordId", "recordId"}, {"CreateTime", "createTime"}} {
+		if v, ok := r.take(a[0]); ok {
+			ri.Attrs = append(ri.Attrs, starAttr(a[1], v))
+		}
+	}
+	if len(ri.Attrs) > 0 {
+		rb.elems = append(rb.elems, ri)
+	}
+	for _, k := range []string{"StorageSystem", "Site", "StorageShare", "StorageMedia", "StorageClass"} {
+		if v, ok := r.take(k); ok {
+			rb.add(k, v)
+		}
+	}
+	if v, ok := r.take("FileCount"); ok {
+		if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+			return fmt.Errorf("FileCount: %s", err)
+		}
+		rb.add("FileCount", v)
+	}
+	if v, ok := r.take("DirectoryPath"); ok {
+		rb.add("DirectoryPath", v)
+	}
+	si := xmlElement{Name: "SubjectIdentity"}
+	for _, k := range []string{"LocalUser", "LocalGroup", "UserIdentity", "Group"} {
+		if v, ok := r.take(k); ok {
+			si.Children = append(si.Children, xmlElement{Name: k, Value: v})
+		}
+	}
+	var groupAttrs []string
+	for k := range r {
+		if strings.HasPrefix(k, "GroupAttribute_") {
+			groupAttrs = append(groupAttrs, k)
+		}
+	}
+	sort.Strings(groupAttrs)
+	for _, k := range groupAttrs {
+		v, _ := r.take(k)
+		si.Children = append(si.Children, xmlElement{
+			Name:  "GroupAttribute",
+			Value: v,
+			Attrs: []xml.Attr{starAttr("attributeType", strings.TrimPrefix(k, "GroupAttribute_"))},
+		})
+	}
+	if len(si.Children) > 0 {
+		rb.elems = append(rb.elems, si)
+	}
+	for _, k := range []string{"StartTime", "EndTime"} {
+		if t, ok, err := r.takeTime(k); err != nil {
+			return err
+		} else if ok {
+			rb.add(k, formatTime(t))
+		}
+	}
+	for _, k := range []string{"ResourceCapacityUsed", "LogicalCapacityUsed", "ResourceCapacityAllocated"} {
+		if v, ok := r.take(k); ok {
+			if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+				return fmt.Errorf("%s: %s", k, err)
+			}
+			rb.add(k, v)
+		}
+	}
+	r.takeOrigin(&rb)
+	if err := r.takeFields(&rb); err != nil {
+		return err
+	}
+	return sur.ParseXML(rb.renderNS(StARNamespace, "StorageUsageRecord"))
+}
+
+// jsonString returns JSON value v as a string.
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// secondsToDuration parses a number of seconds.
+func secondsToDuration(s string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	// round to the nearest nanosecond, rather than truncating e.g. 65.32
+	// seconds to 65.319999999
+	ns := f * float64(time.Second)
+	if ns < 0 {
+		return time.Duration(ns - 0.5), nil
+	}
+	return time.Duration(ns + 0.5), nil
+}
@@ -0,0 +1,97 @@
+package gracc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestFromJSONRawXML(t *testing.T) {
+	for _, rt := range Tests {
+		x, err := ioutil.ReadFile(rt.SourceXMLFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := ParseRecordXML(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := rec.ToJSON("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec2, err := RecordFromJSON(j)
+		if err != nil {
+			t.Fatalf("%s: %s", rt.RefJSONFile, err)
+		}
+		if rec2.Type() != rec.Type() || rec2.Fingerprint() != rec.Fingerprint() {
+			t.Errorf("%s: expected %s record %s, got %s record %s", rt.SourceXMLFile,
+				rec.Type(), rec.Fingerprint(), rec2.Type(), rec2.Fingerprint())
+		}
+	}
+}
+
+func TestFromJSONReconstruct(t *testing.T) {
+	for _, rt := range Tests {
+		j, err := ioutil.ReadFile(rt.RefJSONFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := RecordFromJSON(j)
+		if err != nil {
+			t.Fatalf("%s: %s", rt.RefJSONFile, err)
+		}
+		j2, err := rec.ToJSON("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ref, got map[string]interface{}
+		if err := json.Unmarshal(j, &ref); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(j2, &got); err != nil {
+			t.Fatal(err)
+		}
+		// the XML can't be the same, since the order of elements is lost
+		for _, k := range []string{"RawXML", "Fingerprint"} {
+			delete(ref, k)
+			delete(got, k)
+		}
+		if !reflect.DeepEqual(ref, got) {
+			for k, v := range ref {
+				if !reflect.DeepEqual(v, got[k]) {
+					t.Errorf("%s: %s: expected %v, got %v", rt.RefJSONFile, k, v, got[k])
+				}
+			}
+			for k, v := range got {
+				if _, ok := ref[k]; !ok {
+					t.Errorf("%s: unexpected %s: %v", rt.RefJSONFile, k, v)
+				}
+			}
+		}
+	}
+}
+
+func TestFromJSONMethods(t *testing.T) {
+	var jur JobUsageRecord
+	if err := jur.FromJSON([]byte(`{"type":"JobUsageRecord","RecordId":"r1","CpuDuration_user":1.5,"Resource_ExitCode":"0"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if jur.Id() != "r1" || len(jur.CpuDuration) != 1 || jur.CpuDuration[0].Value != "PT1.5S" || len(jur.Resource) != 1 {
+		t.Errorf("unexpected record %+v", jur)
+	}
+	var ser StorageElementRecord
+	if err := ser.FromJSON([]byte(`{"type":"StorageElementRecord","UniqueID":"u1","TotalSpace":18446744073709551615}`)); err != nil {
+		t.Fatal(err)
+	}
+	if ser.Id() != "u1" || ser.TotalSpace != 18446744073709551615 {
+		t.Errorf("unexpected record %+v", ser)
+	}
+	if _, err := RecordFromJSON([]byte(`{"type":"Bogus"}`)); err == nil {
+		t.Error("expected error for unknown type")
+	}
+	if _, err := RecordFromJSON([]byte(`{"type":"JobUsageRecord","StartTime":"yesterday"}`)); err == nil {
+		t.Error("expected error for bad time")
+	}
+}
@@ -0,0 +1,203 @@
+package gracc
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+)
+
+// genericField is an element of a GenericRecord, which may have any
+// attributes, and contain other elements.
+type genericField struct {
+	XMLName  xml.Name
+	Value    string         `xml:",chardata"`
+	Attrs    []xml.Attr     `xml:",any,attr"`
+	Children []genericField `xml:",any"`
+}
+
+// flatten flattens the element like field.flatten, with any other attributes
+// as <element>_<attribute>. The children of an element are flattened with the
+// element's name as a prefix, e.g. <Identity><Id>1</Id></Identity> becomes
+// Identity_Id: 1.
+func (f *genericField) flatten() map[string]interface{} {
+	fl := field{XMLName: f.XMLName, Value: strings.TrimSpace(f.Value)}
+	var other []xml.Attr
+	for _, a := range f.Attrs {
+		switch {
+		case a.Name.Space == "xmlns", a.Name.Local == "xmlns":
+		case a.Name.Local == "description":
+			fl.Description = a.Value
+		case a.Name.Local == "unit":
+			fl.Unit = a.Value
+		case a.Name.Local == "phaseUnit":
+			fl.PhaseUnit = a.Value
+		case a.Name.Local == "storageUnit":
+			fl.StorageUnit = a.Value
+		case a.Name.Local == "formula":
+			fl.Formula = a.Value
+		case a.Name.Local == "metric":
+			fl.Metric = a.Value
+		default:
+			other = append(other, a)
+		}
+	}
+	r := fl.flatten()
+	for _, a := range other {
+		r[f.XMLName.Local+"_"+a.Name.Local] = a.Value
+	}
+	for i := range f.Children {
+		for k, v := range f.Children[i].flatten() {
+			r[f.XMLName.Local+"_"+k] = v
+		}
+	}
+	return r
+}
+
+// attr returns the value of the attribute named name, if it has one.
+func (f *genericField) attr(name string) string {
+	for _, a := range f.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// GenericRecord is a record of a type that isn't otherwise recognized. Its
+// elements are flattened into JSON with the same rules as the other fields
+// of known record types, so that new types of record can be passed through
+// before they are supported.
+type GenericRecord struct {
+	XMLName xml.Name
+	Origin  origin         `xml:",omitempty"`
+	Fields  []genericField `xml:",any"`
+	RawXML  []byte         `xml:",innerxml"`
+	raw     []byte
+}
+
+// ParseGenericRecordXML unmarshals the XML in buf, which may be any element,
+// into a GenericRecord.
+func ParseGenericRecordXML(buf []byte) (*GenericRecord, error) {
+	var gr GenericRecord
+	if err := gr.ParseXML(buf); err != nil {
+		return nil, err
+	}
+	return &gr, nil
+}
+
+// ParseAnyRecordXML unmarshals the XML in buf into one of the known record
+// types like ParseRecordXML, or if it is of another type, into a
+// GenericRecord. Invalid records of known types are still an error.
+func ParseAnyRecordXML(buf []byte) (Record, error) {
+	rec, err := ParseRecordXML(buf)
+	if err == nil {
+		return rec, nil
+	}
+	var x XMLRecord
+	if xerr := xml.Unmarshal(buf, &x); xerr != nil || recognizedType(x.XMLName.Local) {
+		return nil, err
+	}
+	var gr GenericRecord
+	if err := gr.ParseXML(buf); err != nil {
+		return nil, err
+	}
+	return &gr, nil
+}
+
+// ParseXML attempts to unmarshal the XML in xb into a GenericRecord.
+func (gr *GenericRecord) ParseXML(xb []byte) error {
+	if err := xml.Unmarshal(xb, gr); err != nil {
+		return err
+	}
+	gr.raw = recordBytes(xb)
+	return nil
+}
+
+type genericRecord GenericRecord
+
+// UnmarshalXML unmarshals the record, keeping its start element for Raw.
+func (gr *GenericRecord) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if err := d.DecodeElement((*genericRecord)(gr), &start); err != nil {
+		return err
+	}
+	gr.raw = rawRecord(start, gr.RawXML)
+	return nil
+}
+
+// Id returns an identification string for the record: the recordId
+// attribute of its RecordIdentity, or its RecordId or UniqueID, if it has
+// one.
+func (gr *GenericRecord) Id() string {
+	for i := range gr.Fields {
+		f := &gr.Fields[i]
+		switch f.XMLName.Local {
+		case "RecordIdentity":
+			if id := f.attr("recordId"); id != "" {
+				return id
+			}
+		case "RecordId", "UniqueID":
+			return strings.TrimSpace(f.Value)
+		}
+	}
+	return ""
+}
+
+// Type returns the type of the record.
+func (gr *GenericRecord) Type() string {
+	return gr.XMLName.Local
+}
+
+// ProbeName returns the ProbeName element of the record, if it has one.
+func (gr *GenericRecord) ProbeName() string {
+	for _, f := range gr.Fields {
+		if f.XMLName.Local == "ProbeName" {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Raw returns the source of the record.
+func (gr *GenericRecord) Raw() []byte {
+	if gr.raw != nil {
+		return gr.raw
+	}
+	s := "<" + gr.XMLName.Local + ">" + string(gr.RawXML) + "</" + gr.XMLName.Local + ">"
+	return []byte(s)
+}
+
+// Fingerprint returns a checksum of the record's canonical XML.
+func (gr *GenericRecord) Fingerprint() string {
+	return fingerprint(gr.Raw())
+}
+
+// ToJSON returns a JSON encoding of the Record, with each element flattened
+// as for other fields of known record types.
+// Indent specifies the string to use for each indentation level,
+// if empty no indentation or pretty-printing is performed.
+func (gr *GenericRecord) ToJSON(indent string) ([]byte, error) {
+	var r = make(map[string]interface{})
+
+	r["type"] = gr.Type()
+
+	// flatten fields
+	for i := range gr.Fields {
+		for k, v := range gr.Fields[i].flatten() {
+			r[k] = v
+		}
+	}
+
+	// origin
+	for k, v := range gr.Origin.flatten() {
+		r[k] = v
+	}
+
+	// add XML
+	r["RawXML"] = string(gr.Raw())
+	r["Fingerprint"] = gr.Fingerprint()
+
+	if indent != "" {
+		return json.MarshalIndent(r, "", indent)
+	}
+	return json.Marshal(r)
+}
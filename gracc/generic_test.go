@@ -0,0 +1,160 @@
+package gracc
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+)
+
+var testGenericXML = `<NewRecord xmlns="http://example.org/new">
+	<RecordIdentity recordId="r1" createTime="2016-06-01T00:00:00Z"/>
+	<Site description="example">X</Site>
+	<Usage>
+		<Cores unit="count">8</Cores>
+		<WallDuration>PT1H</WallDuration>
+	</Usage>
+	<Origin hop="2"><ServerDate>2016-06-01T00:00:00Z</ServerDate></Origin>
+</NewRecord>`
+
+func TestGenericRecord(t *testing.T) {
+	gr, err := ParseGenericRecordXML([]byte(testGenericXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gr.Type() != "NewRecord" {
+		t.Errorf("expected type NewRecord, got %s", gr.Type())
+	}
+	if gr.Id() != "r1" {
+		t.Errorf("expected id r1, got %s", gr.Id())
+	}
+	if string(gr.Raw()) != testGenericXML {
+		t.Errorf("expected raw XML to be unchanged, got %s", gr.Raw())
+	}
+	j, err := gr.ToJSON("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r map[string]interface{}
+	if err := json.Unmarshal(j, &r); err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]interface{}{
+		"type":                      "NewRecord",
+		"RecordIdentity_recordId":   "r1",
+		"RecordIdentity_createTime": "2016-06-01T00:00:00Z",
+		"Site":                      "X",
+		"Site_description":          "example",
+		"Usage_Cores":               "8",
+		"Usage_Cores_unit":          "count",
+		"Usage_WallDuration":        "PT1H",
+		"Origin_hop":                float64(2),
+		"OriginServerDate":          "2016-06-01T00:00:00Z",
+		"RawXML":                    testGenericXML,
+		"Fingerprint":               gr.Fingerprint(),
+	}
+	for k, v := range exp {
+		if r[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, r[k])
+		}
+	}
+	for k := range r {
+		if _, ok := exp[k]; !ok {
+			t.Errorf("unexpected key %s: %v", k, r[k])
+		}
+	}
+}
+
+func TestParseAnyRecordXML(t *testing.T) {
+	rec, err := ParseAnyRecordXML([]byte(testGenericXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rec.(*GenericRecord); !ok {
+		t.Errorf("expected GenericRecord, got %T", rec)
+	}
+	rec, err = ParseAnyRecordXML([]byte(`<StorageElement><UniqueID>se1</UniqueID></StorageElement>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rec.(*StorageElement); !ok {
+		t.Errorf("expected StorageElement, got %T", rec)
+	}
+	if _, err := ParseAnyRecordXML([]byte(`<JobUsageRecord><RecordIdentity></JobUsageRecord>`)); err == nil {
+		t.Error("expected error parsing invalid JobUsageRecord")
+	}
+}
+
+func TestParseOtherRecords(t *testing.T) {
+	var b RecordBundle
+	env := "<RecordEnvelope><StorageElement><UniqueID>se1</UniqueID></StorageElement>" + testGenericXML + "</RecordEnvelope>"
+	if err := xml.Unmarshal([]byte(env), &b); err != nil {
+		t.Fatal(err)
+	}
+	b.ParseOtherRecords()
+	if n := b.TypeCounts(); len(b.OtherRecords) != 0 || n["NewRecord"] != 1 {
+		t.Fatalf("expected 1 generic record and no others, got %v and %d others", n, len(b.OtherRecords))
+	}
+	if n := b.RecordCount(); n != 2 {
+		t.Errorf("expected 2 records, got %d", n)
+	}
+	n := 0
+	for rec := range b.Records() {
+		n++
+		if rec.Type() == "NewRecord" && rec.Id() != "r1" {
+			t.Errorf("expected generic record r1, got %s", rec.Id())
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected 2 records from Records, got %d", n)
+	}
+	x, err := b.ToXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b2 RecordBundle
+	if err := xml.Unmarshal(x, &b2); err != nil {
+		t.Fatal(err)
+	}
+	if n := b2.TypeCounts(); n["StorageElement"] != 1 || len(b2.OtherRecords) != 1 || b2.OtherRecords[0].XMLName.Local != "NewRecord" {
+		t.Errorf("unexpected bundle from ToXML: %s", x)
+	}
+}
+
+func TestParseOtherRecordsNamespaces(t *testing.T) {
+	// the record's namespace and prefixes are declared on the envelope
+	env := `<RecordEnvelope xmlns="http://example.org/new" xmlns:ex="http://example.org/ex">
+<NewRecord ex:version="2"><RecordIdentity ex:recordId="r1"/><Site>X</Site></NewRecord>
+</RecordEnvelope>`
+	var b RecordBundle
+	if err := xml.Unmarshal([]byte(env), &b); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.OtherRecords) != 1 {
+		t.Fatalf("expected 1 other record, got %d", len(b.OtherRecords))
+	}
+	b.ParseOtherRecords()
+	var raw []byte
+	for rec := range b.Records() {
+		raw = rec.Raw()
+	}
+	if raw == nil {
+		t.Fatal("expected a generic record")
+	}
+	var r struct {
+		XMLName xml.Name
+		Version string `xml:"http://example.org/ex version,attr"`
+	}
+	if err := xml.Unmarshal(raw, &r); err != nil {
+		t.Fatalf("generic record isn't well-formed: %s\n%s", err, raw)
+	}
+	if r.XMLName.Space != "http://example.org/new" || r.Version != "2" {
+		t.Errorf("namespaces or attributes were lost: %s", raw)
+	}
+	gr, err := ParseGenericRecordXML(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gr.Id() != "r1" {
+		t.Errorf("expected id r1, got %q from %s", gr.Id(), raw)
+	}
+}
@@ -140,6 +140,14 @@ type JobUsageRecord struct {
 	Origin             origin         `xml:",omitempty"`
 	Fields             []field        `xml:",any"`
 	RawXML             []byte         `xml:",innerxml"`
+	raw                []byte
+}
+
+func init() {
+	RegisterRecordType(RecordType{
+		Names: []string{"JobUsageRecord", "UsageRecord"},
+		New:   func() ParsableRecord { return &JobUsageRecord{} },
+	})
 }
 
 // ParseXML attempts to unmarshal the XML in xb into a JobUsageRecord.
@@ -147,6 +155,18 @@ func (jur *JobUsageRecord) ParseXML(xb []byte) error {
 	if err := xml.Unmarshal(xb, jur); err != nil {
 		return err
 	}
+	jur.raw = recordBytes(xb)
+	return nil
+}
+
+type jobUsageRecord JobUsageRecord
+
+// UnmarshalXML unmarshals the record, keeping its start element for Raw.
+func (jur *JobUsageRecord) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if err := d.DecodeElement((*jobUsageRecord)(jur), &start); err != nil {
+		return err
+	}
+	jur.raw = rawRecord(start, jur.RawXML)
 	return nil
 }
 
@@ -160,12 +180,35 @@ func (jur *JobUsageRecord) Type() string {
 	return jur.XMLName.Local
 }
 
-// Raw returns the unaltered source of the record.
+// ProbeName returns the ProbeName element of the record, if it has one.
+func (jur *JobUsageRecord) ProbeName() string {
+	return fieldValue(jur.Fields, "ProbeName")
+}
+
+// Identity returns the values that identify the record, so that the same
+// record sent again can be recognized: its RecordId and GlobalJobId, or the
+// empty string if it has neither.
+func (jur *JobUsageRecord) Identity() string {
+	if jur.RecordIdentity.RecordId == "" && jur.JobIdentity.GlobalJobId == "" {
+		return ""
+	}
+	return jur.RecordIdentity.RecordId + "\x00" + jur.JobIdentity.GlobalJobId
+}
+
+// Raw returns the source of the record.
 func (jur *JobUsageRecord) Raw() []byte {
+	if jur.raw != nil {
+		return jur.raw
+	}
 	s := "<" + jur.XMLName.Local + ">" + string(jur.RawXML) + "</" + jur.XMLName.Local + ">"
 	return []byte(s)
 }
 
+// Fingerprint returns a checksum of the record's canonical XML.
+func (jur *JobUsageRecord) Fingerprint() string {
+	return fingerprint(jur.Raw())
+}
+
 // ToJSON returns a JSON encoding of the Record, with certain elements
 // transformed to fit the GRACC Raw Record schema.
 // Indent specifies the string to use for each indentation level,
@@ -265,6 +308,7 @@ func (jur *JobUsageRecord) ToJSON(indent string) ([]byte, error) {
 
 	// add XML
 	r["RawXML"] = string(jur.Raw())
+	r["Fingerprint"] = jur.Fingerprint()
 
 	if indent != "" {
 		return json.MarshalIndent(r, "", indent)
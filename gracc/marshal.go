@@ -0,0 +1,216 @@
+package gracc
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// URWGNamespace is the namespace of the OGF Usage Record Working Group
+// schema that Gratia records use.
+const URWGNamespace = "http://www.gridforum.org/2003/ur-wg"
+
+// StARNamespace is the namespace of the EMI StAR storage accounting record
+// schema.
+const StARNamespace = "http://eu-emi.eu/namespaces/2011/02/storagerecord"
+
+// namespacePrefixes are the prefixes used for namespaced attributes of
+// records in each namespace.
+var namespacePrefixes = map[string]string{
+	URWGNamespace: "urwg",
+	StARNamespace: "sr",
+}
+
+// MarshalRecordXML returns the XML of rec in the UR-WG namespace, or for a
+// StorageUsageRecord, the StAR namespace: the record element declares it as
+// the default namespace and as the "urwg" (or "sr") prefix, and namespaced
+// attributes use that prefix, whatever prefix the record was received with.
+func MarshalRecordXML(rec Record) ([]byte, error) {
+	ns := URWGNamespace
+	if _, ok := rec.(*StorageUsageRecord); ok {
+		ns = StARNamespace
+	}
+	p := namespacePrefixes[ns]
+	var b bytes.Buffer
+	d := xml.NewDecoder(bytes.NewReader(rec.Raw()))
+	depth := 0
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			b.WriteString("<" + t.Name.Local)
+			if depth == 0 {
+				b.WriteString(` xmlns="` + ns + `" xmlns:` + p + `="` + ns + `"`)
+			}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns", a.Name.Space == "" && a.Name.Local == "xmlns":
+					// namespaces are declared above
+				case a.Name.Space == "xsi":
+					// schema locations no longer apply
+				case a.Name.Space != "":
+					writeAttr(&b, p+":"+a.Name.Local, a.Value)
+				default:
+					writeAttr(&b, a.Name.Local, a.Value)
+				}
+			}
+			b.WriteString(">")
+			depth++
+		case xml.EndElement:
+			b.WriteString("</" + t.Name.Local + ">")
+			depth--
+		case xml.CharData:
+			escapeText(&b, t)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func writeAttr(b *bytes.Buffer, name, value string) {
+	b.WriteString(" " + name + `="`)
+	xml.EscapeText(b, []byte(value))
+	b.WriteString(`"`)
+}
+
+// escapeText writes s to b with XML special characters escaped, except that
+// newlines and tabs, which are allowed in character data, are left as is.
+func escapeText(b *bytes.Buffer, s []byte) {
+	var e bytes.Buffer
+	xml.EscapeText(&e, s)
+	b.WriteString(textUnescaper.Replace(e.String()))
+}
+
+var textUnescaper = strings.NewReplacer("&#xA;", "\n", "&#x9;", "\t")
+
+// FormatDuration formats d as an ISO 8601 duration, e.g. "PT1H2M3.5S", as
+// used in usage records.
+func FormatDuration(d time.Duration) string {
+	var b bytes.Buffer
+	if d < 0 {
+		b.WriteString("-")
+		d = -d
+	}
+	b.WriteString("PT")
+	if h := d / time.Hour; h > 0 {
+		fmt.Fprintf(&b, "%dH", h)
+		d -= h * time.Hour
+	}
+	if m := d / time.Minute; m > 0 {
+		fmt.Fprintf(&b, "%dM", m)
+		d -= m * time.Minute
+	}
+	if d > 0 || b.Len() <= 3 {
+		s := strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+		b.WriteString(s + "S")
+	}
+	return b.String()
+}
+
+// formatTime formats t as an ISO 8601 time in UTC, as used in usage records.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// xmlElement is an element of a record being built.
+type xmlElement struct {
+	Name     string
+	Attrs    []xml.Attr
+	Value    string
+	Children []xmlElement
+}
+
+// write writes e to b. Namespaced attributes (those with a Space) are written
+// with prefix, that of the record's namespace.
+func (e *xmlElement) write(b *bytes.Buffer, indent, prefix string) {
+	b.WriteString(indent + "<" + e.Name)
+	for _, a := range e.Attrs {
+		if a.Name.Space != "" {
+			writeAttr(b, prefix+":"+a.Name.Local, a.Value)
+		} else {
+			writeAttr(b, a.Name.Local, a.Value)
+		}
+	}
+	if len(e.Children) == 0 && e.Value == "" {
+		b.WriteString("/>\n")
+		return
+	}
+	b.WriteString(">")
+	escapeText(b, []byte(e.Value))
+	if len(e.Children) > 0 {
+		b.WriteString("\n")
+		for i := range e.Children {
+			e.Children[i].write(b, indent+"    ", prefix)
+		}
+		b.WriteString(indent)
+	}
+	b.WriteString("</" + e.Name + ">\n")
+}
+
+// urwgAttr returns an attribute in the UR-WG namespace.
+func urwgAttr(name, value string) xml.Attr {
+	return xml.Attr{Name: xml.Name{Space: URWGNamespace, Local: name}, Value: value}
+}
+
+// starAttr returns an attribute in the StAR namespace.
+func starAttr(name, value string) xml.Attr {
+	return xml.Attr{Name: xml.Name{Space: StARNamespace, Local: name}, Value: value}
+}
+
+// recordBuilder accumulates the elements of a record, in order.
+type recordBuilder struct {
+	elems []xmlElement
+}
+
+// add appends an element with the given value and attributes.
+func (rb *recordBuilder) add(name, value string, attrs ...xml.Attr) {
+	rb.elems = append(rb.elems, xmlElement{Name: name, Value: value, Attrs: attrs})
+}
+
+// set replaces the value of the first element named name, or appends it if
+// there is none.
+func (rb *recordBuilder) set(name, value string, attrs ...xml.Attr) {
+	for i := range rb.elems {
+		if rb.elems[i].Name == name {
+			rb.elems[i] = xmlElement{Name: name, Value: value, Attrs: attrs}
+			return
+		}
+	}
+	rb.add(name, value, attrs...)
+}
+
+// render returns the XML of a record named root in the UR-WG namespace,
+// containing elements head followed by the accumulated elements.
+func (rb *recordBuilder) render(root string, head ...xmlElement) []byte {
+	return rb.renderNS(URWGNamespace, root, head...)
+}
+
+// renderNS is like render, with the record in namespace ns.
+func (rb *recordBuilder) renderNS(ns, root string, head ...xmlElement) []byte {
+	var b bytes.Buffer
+	p := namespacePrefixes[ns]
+	b.WriteString("<" + root + ` xmlns="` + ns + `" xmlns:` + p + `="` + ns + `">` + "\n")
+	for _, es := range [][]xmlElement{head, rb.elems} {
+		for i := range es {
+			es[i].write(&b, "    ", p)
+		}
+	}
+	b.WriteString("</" + root + ">\n")
+	return b.Bytes()
+}
+
+// validName returns an error if name is not a valid element name.
+func validName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n<>&\"'/=:") {
+		return fmt.Errorf("invalid element name \"%s\"", name)
+	}
+	return nil
+}
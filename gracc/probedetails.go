@@ -0,0 +1,148 @@
+package gracc
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+)
+
+// software is a named, versioned piece of software reported in ProbeDetails,
+// e.g. <Reporter version="1.16.1">condor_meter</Reporter>.
+type software struct {
+	Name    string `xml:",chardata"`
+	Version string `xml:"version,attr,omitempty"`
+}
+
+// ProbeDetails describes a probe: the probe and reporting library software,
+// their versions, and the services it reports on. Probes send them when they
+// start, so they can be used to track probe versions.
+type ProbeDetails struct {
+	XMLName         xml.Name
+	RecordIdentity  recordIdentity `xml:",omitempty"`
+	ProbeName       string         `xml:",omitempty"`
+	SiteName        string         `xml:",omitempty"`
+	Grid            string         `xml:",omitempty"`
+	ReporterLibrary software       `xml:",omitempty"`
+	Reporter        software       `xml:",omitempty"`
+	Service         []software     `xml:",omitempty"`
+	Origin          origin         `xml:",omitempty"`
+	Fields          []field        `xml:",any"`
+	RawXML          []byte         `xml:",innerxml"`
+	raw             []byte
+}
+
+func init() {
+	RegisterRecordType(RecordType{
+		Names: []string{"ProbeDetails"},
+		New:   func() ParsableRecord { return &ProbeDetails{} },
+	})
+}
+
+// ParseXML attempts to unmarshal the XML in xb into a ProbeDetails.
+func (pd *ProbeDetails) ParseXML(xb []byte) error {
+	if err := xml.Unmarshal(xb, pd); err != nil {
+		return err
+	}
+	pd.raw = recordBytes(xb)
+	return nil
+}
+
+type probeDetails ProbeDetails
+
+// UnmarshalXML unmarshals the record, keeping its start element for Raw.
+func (pd *ProbeDetails) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if err := d.DecodeElement((*probeDetails)(pd), &start); err != nil {
+		return err
+	}
+	pd.raw = rawRecord(start, pd.RawXML)
+	return nil
+}
+
+// Id returns an identification string for the record.
+func (pd *ProbeDetails) Id() string {
+	return pd.RecordIdentity.RecordId
+}
+
+// Type returns the type of the record.
+func (pd *ProbeDetails) Type() string {
+	return pd.XMLName.Local
+}
+
+// Raw returns the source of the record.
+func (pd *ProbeDetails) Raw() []byte {
+	if pd.raw != nil {
+		return pd.raw
+	}
+	s := "<" + pd.XMLName.Local + ">" + string(pd.RawXML) + "</" + pd.XMLName.Local + ">"
+	return []byte(s)
+}
+
+// Fingerprint returns a checksum of the record's canonical XML.
+func (pd *ProbeDetails) Fingerprint() string {
+	return fingerprint(pd.Raw())
+}
+
+// ToJSON returns a JSON encoding of the Record, with certain elements
+// transformed to fit the GRACC Raw Record schema. The version of each
+// service is under Service_<name>.
+// Indent specifies the string to use for each indentation level,
+// if empty no indentation or pretty-printing is performed.
+func (pd *ProbeDetails) ToJSON(indent string) ([]byte, error) {
+	var r = make(map[string]interface{})
+
+	r["type"] = "ProbeDetails"
+
+	for k, v := range pd.RecordIdentity.flatten() {
+		r[k] = v
+	}
+	for k, v := range map[string]string{
+		"ProbeName": pd.ProbeName,
+		"SiteName":  pd.SiteName,
+		"Grid":      pd.Grid,
+	} {
+		if v != "" {
+			r[k] = v
+		}
+	}
+
+	// software versions
+	for k, s := range map[string]software{
+		"ReporterLibrary": pd.ReporterLibrary,
+		"Reporter":        pd.Reporter,
+	} {
+		if s.Name != "" {
+			r[k] = strings.TrimSpace(s.Name)
+		}
+		if s.Version != "" {
+			r[k+"_version"] = s.Version
+		}
+	}
+	for _, s := range pd.Service {
+		k := "unknown"
+		if name := strings.TrimSpace(s.Name); name != "" {
+			k = strings.Map(mapForKey, name)
+		}
+		r["Service_"+k] = s.Version
+	}
+
+	// flatten other fields
+	for _, f := range pd.Fields {
+		for k, v := range f.flatten() {
+			r[k] = v
+		}
+	}
+
+	// origin
+	for k, v := range pd.Origin.flatten() {
+		r[k] = v
+	}
+
+	// add XML
+	r["RawXML"] = string(pd.Raw())
+	r["Fingerprint"] = pd.Fingerprint()
+
+	if indent != "" {
+		return json.MarshalIndent(r, "", indent)
+	}
+	return json.Marshal(r)
+}
@@ -1,6 +1,7 @@
 package gracc
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"strings"
@@ -13,6 +14,26 @@ import (
 type XMLRecord struct {
 	XMLName  xml.Name
 	InnerXML string `xml:",innerxml"`
+	raw      []byte
+}
+
+type xmlRecord XMLRecord
+
+// UnmarshalXML unmarshals the record, keeping its start element for Raw.
+func (r *XMLRecord) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if err := d.DecodeElement((*xmlRecord)(r), &start); err != nil {
+		return err
+	}
+	r.raw = rawRecord(start, []byte(r.InnerXML))
+	return nil
+}
+
+// Raw returns the XML of the record, including its start element.
+func (r XMLRecord) Raw() []byte {
+	if r.raw != nil {
+		return r.raw
+	}
+	return []byte("<" + r.XMLName.Local + ">" + r.InnerXML + "</" + r.XMLName.Local + ">")
 }
 
 // Record is an interface implemented by all record types.
@@ -21,33 +42,104 @@ type Record interface {
 	Type() string
 	ToJSON(indent string) ([]byte, error)
 	Raw() []byte
+	Fingerprint() string
+}
+
+// ProbeName returns the ProbeName element of rec, if it has one. Records
+// may provide it with a ProbeName method, as the built-in types do;
+// otherwise it is read from the record's XML. Unlike reading it from the JSON
+// encoding, it doesn't need to convert the record.
+func ProbeName(rec Record) string {
+	if r, ok := rec.(interface{ ProbeName() string }); ok {
+		return r.ProbeName()
+	}
+	gr, err := ParseGenericRecordXML(rec.Raw())
+	if err != nil {
+		return ""
+	}
+	return gr.ProbeName()
 }
 
 // ParseRecordXML will attempt to unmarshall the XML in buf into one of the
-// known record types.
+// registered record types (see RegisterRecordType).
 func ParseRecordXML(buf []byte) (Record, error) {
 	var rec XMLRecord
 	if err := xml.Unmarshal(buf, &rec); err != nil {
 		return nil, fmt.Errorf("unable to parse record XML")
 	}
-	switch rec.XMLName.Local {
-	case "UsageRecord", "JobUsageRecord":
-		var jur JobUsageRecord
-		if err := jur.ParseXML(buf); err == nil {
-			return &jur, nil
+	if t, ok := LookupRecordType(rec.XMLName.Local); ok {
+		r := t.New()
+		if err := r.ParseXML(buf); err == nil {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to unmarshall XML into record")
+}
+
+// recordBytes returns the bytes of the root element of XML document x,
+// without any XML declaration, comments or whitespace around it.
+func recordBytes(x []byte) []byte {
+	d := xml.NewDecoder(bytes.NewReader(x))
+	for {
+		start := d.InputOffset()
+		t, err := d.Token()
+		if err != nil {
+			return nil
 		}
-	case "StorageElement":
-		var se StorageElement
-		if err := se.ParseXML(buf); err == nil {
-			return &se, nil
+		if _, ok := t.(xml.StartElement); ok {
+			if err := d.Skip(); err != nil {
+				return nil
+			}
+			// copy, since the caller may reuse x
+			return append([]byte(nil), x[start:d.InputOffset()]...)
 		}
-	case "StorageElementRecord":
-		var ser StorageElementRecord
-		if err := ser.ParseXML(buf); err == nil {
-			return &ser, nil
+	}
+}
+
+// rawRecord reconstructs the XML of a record from its start element and
+// inner XML. The start element's namespace, and those of its attributes, are
+// declared on it if they were declared on an enclosing element.
+//
+// Records' Raw methods return the exact XML that they were parsed from by
+// ParseXML (see recordBytes), or if they were unmarshalled as part of a
+// bundle, the XML reconstructed by rawRecord, with their attributes and
+// namespace declarations. Records that were built some other way have their
+// inner XML wrapped in an element without attributes.
+func rawRecord(start xml.StartElement, inner []byte) []byte {
+	var b bytes.Buffer
+	prefixes := make(map[string]string)
+	defaultNS := false
+	for _, a := range start.Attr {
+		if a.Name.Space == "xmlns" {
+			prefixes[a.Value] = a.Name.Local
+		} else if a.Name.Space == "" && a.Name.Local == "xmlns" {
+			defaultNS = true
 		}
 	}
-	return nil, fmt.Errorf("unable to unmarshall XML into record")
+	b.WriteString("<" + start.Name.Local)
+	if start.Name.Space != "" && !defaultNS {
+		writeAttr(&b, "xmlns", start.Name.Space)
+	}
+	for _, a := range start.Attr {
+		switch {
+		case a.Name.Space == "":
+			writeAttr(&b, a.Name.Local, a.Value)
+		case a.Name.Space == "xmlns":
+			writeAttr(&b, "xmlns:"+a.Name.Local, a.Value)
+		default:
+			p, ok := prefixes[a.Name.Space]
+			if !ok {
+				p = fmt.Sprintf("ns%d", len(prefixes))
+				prefixes[a.Name.Space] = p
+				writeAttr(&b, "xmlns:"+p, a.Name.Space)
+			}
+			writeAttr(&b, p+":"+a.Name.Local, a.Value)
+		}
+	}
+	b.WriteString(">")
+	b.Write(inner)
+	b.WriteString("</" + start.Name.Local + ">")
+	return b.Bytes()
 }
 
 type origin struct {
@@ -90,6 +182,16 @@ type field struct {
 	Metric      string `xml:"metric,attr,omitempty"`
 }
 
+// fieldValue returns the value of the first of fields named name, if any.
+func fieldValue(fields []field, name string) string {
+	for _, f := range fields {
+		if f.XMLName.Local == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
 func (f *field) flatten() map[string]interface{} {
 	var r = make(map[string]interface{})
 	if f.Value != "" {
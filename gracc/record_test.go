@@ -3,7 +3,11 @@ package gracc
 import (
 	"bytes"
 	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -23,7 +27,13 @@ var Tests = []RecordTest{
 	{"test_data/StorageElement02.xml", "test_data/StorageElement02.json"},
 	{"test_data/StorageElementRecord01.xml", "test_data/StorageElementRecord01.json"},
 	{"test_data/StorageElementRecord02.xml", "test_data/StorageElementRecord02.json"},
+	{"test_data/ComputeElement01.xml", "test_data/ComputeElement01.json"},
+	{"test_data/ComputeElementRecord01.xml", "test_data/ComputeElementRecord01.json"},
+	{"test_data/ComputeElementRecord02.xml", "test_data/ComputeElementRecord02.json"},
+	{"test_data/Subcluster01.xml", "test_data/Subcluster01.json"},
 	{"test_data/UsageRecord01.xml", "test_data/UsageRecord01.json"},
+	{"test_data/ProbeDetails01.xml", "test_data/ProbeDetails01.json"},
+	{"test_data/StorageUsageRecord01.xml", "test_data/StorageUsageRecord01.json"},
 }
 
 func TestUnmarshal(t *testing.T) {
@@ -78,3 +88,250 @@ func TestUnmarshal(t *testing.T) {
 		}
 	}
 }
+
+func TestRaw(t *testing.T) {
+	// parsed records keep their exact bytes
+	x := `<?xml version="1.0"?>
+<JobUsageRecord xmlns="http://www.gridforum.org/2003/ur-wg" xmlns:urwg="http://www.gridforum.org/2003/ur-wg" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="x">
+<RecordIdentity urwg:recordId="r1" urwg:createTime="2016-05-27T22:46:46Z" />
+</JobUsageRecord>
+`
+	rec, err := ParseRecordXML([]byte(x))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := strings.TrimSpace(x[strings.Index(x, "\n")+1:]); string(rec.Raw()) != exp {
+		t.Errorf("expected raw:\n%s\ngot:\n%s", exp, rec.Raw())
+	}
+
+	// records in bundles keep their start element, and namespaces declared
+	// on the envelope
+	env := `<RecordEnvelope xmlns:urwg="http://www.gridforum.org/2003/ur-wg">
+<JobUsageRecord xmlns="http://www.gridforum.org/2003/ur-wg" urwg:extra="1"><RecordIdentity urwg:recordId="r1" urwg:createTime="2016-05-27T22:46:46Z"/></JobUsageRecord>
+<StorageElementRecord xmlns:urwg="http://www.gridforum.org/2003/ur-wg"><UniqueID>u1</UniqueID></StorageElementRecord>
+</RecordEnvelope>`
+	var b RecordBundle
+	if err := xml.Unmarshal([]byte(env), &b); err != nil {
+		t.Fatal(err)
+	}
+	recs := bundleRecords(&b)
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 records in bundle, got %d", len(recs))
+	}
+	for i, exp := range []string{
+		`<JobUsageRecord xmlns:urwg="http://www.gridforum.org/2003/ur-wg" xmlns="http://www.gridforum.org/2003/ur-wg" urwg:extra="1"><RecordIdentity urwg:recordId="r1" urwg:createTime="2016-05-27T22:46:46Z"/></JobUsageRecord>`,
+		`<StorageElementRecord xmlns:urwg="http://www.gridforum.org/2003/ur-wg"><UniqueID>u1</UniqueID></StorageElementRecord>`,
+	} {
+		if raw := recs[i].Raw(); string(raw) != exp {
+			t.Errorf("expected raw:\n%s\ngot:\n%s", exp, raw)
+		}
+	}
+	// the fingerprint doesn't depend on the record's attributes
+	if recs[0].Fingerprint() != rec.Fingerprint() {
+		t.Errorf("expected same fingerprint for %s and %s", recs[0].Raw(), rec.Raw())
+	}
+}
+
+// bundleRecords returns the records in b.
+func bundleRecords(b *RecordBundle) []Record {
+	var recs []Record
+	for rec := range b.Records() {
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestComputeElementBundle(t *testing.T) {
+	env := `<RecordEnvelope>
+<ComputeElement><UniqueID>ce1</UniqueID><MaxRunningJobs>100</MaxRunningJobs></ComputeElement>
+<ComputeElementRecord><UniqueID>ce1</UniqueID><VO>cms</VO><RunningJobs>0</RunningJobs></ComputeElementRecord>
+</RecordEnvelope>`
+	var b RecordBundle
+	if err := xml.Unmarshal([]byte(env), &b); err != nil {
+		t.Fatal(err)
+	}
+	n := b.TypeCounts()
+	if n["ComputeElement"] != 1 || n["ComputeElementRecord"] != 1 || len(b.OtherRecords) != 0 {
+		t.Fatalf("expected 1 ComputeElement and 1 ComputeElementRecord, got %v", n)
+	}
+	if n := b.RecordCount(); n != 2 {
+		t.Errorf("expected 2 records, got %d", n)
+	}
+	recs := bundleRecords(&b)
+	if _, ok := recs[1].(*ComputeElementRecord); !ok {
+		t.Fatalf("expected ComputeElementRecord, got %T", recs[1])
+	}
+	// counts that are reported as zero are kept
+	j, err := recs[1].ToJSON("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r map[string]interface{}
+	if err := json.Unmarshal(j, &r); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := r["RunningJobs"]; !ok || v != float64(0) {
+		t.Errorf("expected RunningJobs 0, got %v", v)
+	}
+	if _, ok := r["WaitingJobs"]; ok {
+		t.Errorf("expected no WaitingJobs, got %v", r["WaitingJobs"])
+	}
+}
+
+func TestBundleRoot(t *testing.T) {
+	for _, x := range []string{
+		`<JobUsageRecord><RecordIdentity recordId="r1"/></JobUsageRecord>`,
+		`<Envelope><JobUsageRecord><RecordIdentity recordId="r1"/></JobUsageRecord></Envelope>`,
+	} {
+		var b RecordBundle
+		if err := xml.Unmarshal([]byte(x), &b); err == nil {
+			t.Errorf("expected error unmarshalling bundle %s", x)
+		}
+	}
+}
+
+func TestSubclusterBundle(t *testing.T) {
+	rec, err := ParseRecordXML([]byte(`<Subcluster><UniqueID>sc1</UniqueID><Cores>8</Cores><BenchmarkValue>10.5</BenchmarkValue></Subcluster>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, ok := rec.(*Subcluster)
+	if !ok {
+		t.Fatalf("expected Subcluster, got %T", rec)
+	}
+	if sc.Id() != "sc1" || sc.Cores == nil || *sc.Cores != 8 || sc.BenchmarkValue == nil || *sc.BenchmarkValue != 10.5 {
+		t.Errorf("unexpected Subcluster %+v", sc)
+	}
+	var b RecordBundle
+	b.AddRecord(rec)
+	if n := b.TypeCounts(); n["Subcluster"] != 1 || b.RecordCount() != 1 {
+		t.Fatalf("expected 1 Subcluster in bundle, got %v", n)
+	}
+	for r := range b.Records() {
+		if r.Type() != "Subcluster" || r.Id() != "sc1" {
+			t.Errorf("expected Subcluster sc1 from Records, got %s %s", r.Type(), r.Id())
+		}
+	}
+	if _, err := ParseRecordXML([]byte(`<Subcluster><Cores>many</Cores></Subcluster>`)); err == nil {
+		t.Error("expected error parsing Subcluster with invalid Cores")
+	}
+}
+
+func TestSplitRecordXML(t *testing.T) {
+	doc := `<?xml version="1.0"?>
+<sr:StorageUsageRecords xmlns:sr="http://eu-emi.eu/namespaces/2011/02/storagerecord">
+<sr:StorageUsageRecord><sr:RecordIdentity sr:recordId="sr1"/><sr:StorageSystem>se1</sr:StorageSystem></sr:StorageUsageRecord>
+<sr:StorageUsageRecord><sr:RecordIdentity sr:recordId="sr2"/><sr:StorageSystem>se1</sr:StorageSystem></sr:StorageUsageRecord>
+</sr:StorageUsageRecords>`
+	xs, err := SplitRecordXML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xs) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(xs))
+	}
+	for i, x := range xs {
+		rec, err := ParseRecordXML(x)
+		if err != nil {
+			t.Fatalf("record %d: %s\n%s", i, err, x)
+		}
+		if id := fmt.Sprintf("sr%d", i+1); rec.Type() != "StorageUsageRecord" || rec.Id() != id {
+			t.Errorf("expected StorageUsageRecord %s, got %s %s", id, rec.Type(), rec.Id())
+		}
+	}
+
+	// other records are returned as is
+	x := `<JobUsageRecord><RecordIdentity recordId="r1"/></JobUsageRecord>`
+	if xs, err := SplitRecordXML([]byte(x)); err != nil || len(xs) != 1 || string(xs[0]) != x {
+		t.Errorf("expected record unchanged, got %q (%v)", xs, err)
+	}
+	if _, err := SplitRecordXML([]byte(`<sr:StorageUsageRecords><sr:StorageUsageRecord>`)); err == nil {
+		t.Error("expected error splitting truncated document")
+	}
+}
+
+func TestStorageUsageRecords(t *testing.T) {
+	doc := `<sr:StorageUsageRecords xmlns:sr="http://eu-emi.eu/namespaces/2011/02/storagerecord">
+<sr:StorageUsageRecord><sr:RecordIdentity sr:recordId="sr1"/><sr:StorageSystem>se1</sr:StorageSystem><sr:ResourceCapacityUsed>0</sr:ResourceCapacityUsed></sr:StorageUsageRecord>
+<sr:StorageUsageRecord><sr:RecordIdentity sr:recordId="sr2"/><sr:StorageSystem>se1</sr:StorageSystem></sr:StorageUsageRecord>
+</sr:StorageUsageRecords>`
+	// as a document, or in an envelope with other records
+	for _, x := range []string{doc, "<RecordEnvelope><StorageElement><UniqueID>se1</UniqueID></StorageElement>" + doc + "</RecordEnvelope>"} {
+		var b RecordBundle
+		if err := xml.Unmarshal([]byte(x), &b); err != nil {
+			t.Fatal(err)
+		}
+		if n := b.TypeCounts(); n["StorageUsageRecord"] != 2 || len(b.OtherRecords) != 0 {
+			t.Fatalf("expected 2 StorageUsageRecords, got %v", n)
+		}
+		var ids []string
+		for _, rec := range bundleRecords(&b) {
+			if sur, ok := rec.(*StorageUsageRecord); ok {
+				ids = append(ids, sur.Id())
+			}
+		}
+		if len(ids) != 2 || ids[0] != "sr1" || ids[1] != "sr2" {
+			t.Errorf("expected records sr1 and sr2, got %v", ids)
+		}
+	}
+
+	// records keep the namespace declared on the document
+	var b RecordBundle
+	if err := xml.Unmarshal([]byte(doc), &b); err != nil {
+		t.Fatal(err)
+	}
+	rec := bundleRecords(&b)[0]
+	if _, err := ParseRecordXML(rec.Raw()); err != nil {
+		t.Errorf("error parsing raw record %s: %s", rec.Raw(), err)
+	}
+	x, err := MarshalRecordXML(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(x), `<StorageUsageRecord xmlns="`+StARNamespace+`" xmlns:sr="`+StARNamespace+`"><RecordIdentity sr:recordId="sr1">`) {
+		t.Errorf("expected record in StAR namespace, got %s", x)
+	}
+	j, err := rec.ToJSON("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r map[string]interface{}
+	if err := json.Unmarshal(j, &r); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := r["ResourceCapacityUsed"]; !ok || v != float64(0) {
+		t.Errorf("expected ResourceCapacityUsed 0, got %v", v)
+	}
+}
+
+func TestProbeName(t *testing.T) {
+	for _, rt := range Tests {
+		x, err := ioutil.ReadFile(rt.SourceXMLFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := ParseRecordXML(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := rec.ToJSON("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r map[string]interface{}
+		if err := json.Unmarshal(j, &r); err != nil {
+			t.Fatal(err)
+		}
+		exp, _ := r["ProbeName"].(string)
+		if p := ProbeName(rec); p != exp {
+			t.Errorf("%s: expected ProbeName %q, got %q", rt.SourceXMLFile, exp, p)
+		}
+	}
+	gr, err := ParseGenericRecordXML([]byte(`<NewRecord><ProbeName>new:host</ProbeName></NewRecord>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := ProbeName(gr); p != "new:host" {
+		t.Errorf("expected ProbeName new:host, got %q", p)
+	}
+}
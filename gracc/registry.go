@@ -0,0 +1,106 @@
+package gracc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ParsableRecord is a Record that can be parsed from its XML, by ParseXML or
+// by unmarshalling it as part of a bundle.
+type ParsableRecord interface {
+	Record
+	ParseXML(xb []byte) error
+}
+
+// RecordType describes a type of record, so that it can be recognized by
+// ParseRecordXML, RecordFromJSON and RecordBundle.
+// Records of the type may also have a ProbeName method (see ProbeName), and
+// an Identity method, returning the values that identify the same record
+// sent again; otherwise the ProbeName is read from their XML, and their Id
+// identifies them.
+type RecordType struct {
+	// Names are the XML element names of records of the type, e.g.
+	// "JobUsageRecord" and "UsageRecord".
+	Names []string
+	// New returns a new, empty record of the type, e.g. &JobUsageRecord{}.
+	// If it has a FromJSON method, it is used by RecordFromJSON; otherwise
+	// only JSON records with RawXML can be converted back.
+	New func() ParsableRecord
+	// Schema is an optional JSON schema of the type's JSON encoding.
+	Schema []byte
+}
+
+var registry = struct {
+	sync.RWMutex
+	types map[string]*RecordType
+}{types: make(map[string]*RecordType)}
+
+// RegisterRecordType registers a type of record. It panics if the type has
+// no names or constructor, or if one of its names is already registered.
+// Types are usually registered in init functions, e.g.
+//
+//	func init() {
+//		gracc.RegisterRecordType(gracc.RecordType{
+//			Names: []string{"SiteRecord"},
+//			New:   func() gracc.ParsableRecord { return &SiteRecord{} },
+//		})
+//	}
+func RegisterRecordType(t RecordType) {
+	if len(t.Names) == 0 || t.New == nil {
+		panic("gracc: record type must have names and a constructor")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	for _, name := range t.Names {
+		if _, ok := registry.types[name]; ok {
+			panic(fmt.Sprintf("gracc: record type %s registered twice", name))
+		}
+	}
+	for _, name := range t.Names {
+		registry.types[name] = &t
+	}
+}
+
+// LookupRecordType returns the registered type of records with XML element
+// name, if any.
+func LookupRecordType(name string) (*RecordType, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	t, ok := registry.types[name]
+	return t, ok
+}
+
+// RecordTypeSchema returns the JSON schema of the registered type of records
+// with XML element name. It returns an error if there is no such type, or it
+// has no schema.
+func RecordTypeSchema(name string) ([]byte, error) {
+	t, ok := LookupRecordType(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown record type %s", name)
+	}
+	if t.Schema == nil {
+		return nil, fmt.Errorf("record type %s has no schema", name)
+	}
+	return t.Schema, nil
+}
+
+// RecordTypeNames returns the XML element names of all registered types of
+// record, in order.
+func RecordTypeNames() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	var names []string
+	for name := range registry.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recognizedType returns true if name is the element name of a registered
+// type of record.
+func recognizedType(name string) bool {
+	_, ok := LookupRecordType(name)
+	return ok
+}
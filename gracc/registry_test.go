@@ -0,0 +1,104 @@
+package gracc
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+// siteRecord is a record type registered by a test, as a downstream fork
+// would register its own types.
+type siteRecord struct {
+	GenericRecord
+}
+
+func registerSiteRecord() {
+	if _, ok := LookupRecordType("SiteRecord"); !ok {
+		RegisterRecordType(RecordType{
+			Names:  []string{"SiteRecord"},
+			New:    func() ParsableRecord { return &siteRecord{} },
+			Schema: []byte(`{"type": "object"}`),
+		})
+	}
+}
+
+// plainRecord is a record type without a ProbeName method.
+type plainRecord struct {
+	Record
+}
+
+func TestProbeNameFromXML(t *testing.T) {
+	rec, err := ParseRecordXML([]byte(`<JobUsageRecord><ProbeName>condor:host</ProbeName></JobUsageRecord>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := ProbeName(plainRecord{rec}); p != "condor:host" {
+		t.Errorf("expected ProbeName condor:host, got %q", p)
+	}
+}
+
+func TestRegisterRecordType(t *testing.T) {
+	registerSiteRecord()
+	x := `<SiteRecord><RecordId>s1</RecordId><ProbeName>site:host</ProbeName><SiteName>X</SiteName></SiteRecord>`
+
+	rec, err := ParseRecordXML([]byte(x))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rec.(*siteRecord); !ok || rec.Id() != "s1" {
+		t.Errorf("expected siteRecord s1, got %T %s", rec, rec.Id())
+	}
+	if p := ProbeName(rec); p != "site:host" {
+		t.Errorf("expected ProbeName site:host, got %q", p)
+	}
+
+	var b RecordBundle
+	if err := xml.Unmarshal([]byte("<RecordEnvelope>"+x+"<JobUsageRecord/></RecordEnvelope>"), &b); err != nil {
+		t.Fatal(err)
+	}
+	recs := bundleRecords(&b)
+	if len(recs) != 2 || len(b.OtherRecords) != 0 {
+		t.Fatalf("expected 2 records in bundle, got %d and %d others", len(recs), len(b.OtherRecords))
+	}
+	if _, ok := recs[0].(*siteRecord); !ok {
+		t.Errorf("expected siteRecord in bundle, got %T", recs[0])
+	}
+
+	// types without FromJSON are converted from their RawXML
+	j, err := rec.ToJSON("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec2, err := RecordFromJSON(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rec2.(*siteRecord); !ok || rec2.Fingerprint() != rec.Fingerprint() {
+		t.Errorf("expected siteRecord %s from JSON, got %T %s", rec.Fingerprint(), rec2, rec2.Fingerprint())
+	}
+	if _, err := RecordFromJSON([]byte(`{"type": "SiteRecord", "RecordId": "s1"}`)); err == nil {
+		t.Error("expected error converting SiteRecord from JSON without RawXML")
+	}
+
+	rt, ok := LookupRecordType("SiteRecord")
+	if !ok || string(rt.Schema) != `{"type": "object"}` {
+		t.Errorf("expected SiteRecord type with schema, got %+v", rt)
+	}
+	if s, err := RecordTypeSchema("SiteRecord"); err != nil || string(s) != `{"type": "object"}` {
+		t.Errorf("expected SiteRecord schema, got %s (%v)", s, err)
+	}
+	for _, name := range []string{"JobUsageRecord", "Bogus"} {
+		if _, err := RecordTypeSchema(name); err == nil {
+			t.Errorf("expected error getting schema of %s", name)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic registering JobUsageRecord twice")
+		}
+	}()
+	RegisterRecordType(RecordType{
+		Names: []string{"JobUsageRecord"},
+		New:   func() ParsableRecord { return &JobUsageRecord{} },
+	})
+}
@@ -0,0 +1,202 @@
+package gracc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// ReplicatedRecord is a record from a replication bundle, as sent by a
+// Gratia collector: the record XML, and the raw XML and extra XML that
+// accompany it.
+type ReplicatedRecord struct {
+	Rec   string
+	Raw   string
+	Extra string
+}
+
+// ScanReplicationBundle splits the replication bundle in r into its records.
+func ScanReplicationBundle(r io.Reader, startBufferSize, maxBufferSize int) ([]ReplicatedRecord, error) {
+	var rrs []ReplicatedRecord
+	bs := bufio.NewScanner(r)
+	bs.Buffer(make([]byte, startBufferSize), maxBufferSize)
+	bs.Split(ScanBundle)
+ScannerLoop:
+	for bs.Scan() {
+		tok := bs.Text()
+		switch tok {
+		case "":
+			continue
+		case "replication":
+			var rr ReplicatedRecord
+			for _, p := range []*string{&rr.Rec, &rr.Raw, &rr.Extra} {
+				if bs.Scan() {
+					*p = bs.Text()
+				} else {
+					break ScannerLoop
+				}
+			}
+			rrs = append(rrs, rr)
+		}
+	}
+	// check for scanner errors
+	if err := bs.Err(); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
+
+// ScanBundle is a split function for bufio.Scanner that splits the bundle
+// at each pipe/bar character "|" that does not occur in a double-
+// quote delimited string.
+func ScanBundle(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	inString := false
+	escape := false
+	var stringDelim rune
+	for width, i := 0, 0; i < len(data); i += width {
+		var r rune
+		r, width = utf8.DecodeRune(data[i:])
+		switch r {
+		case '|':
+			if !inString {
+				return i + width, data[0:i], nil
+			}
+		case '"':
+			if inString && !escape && r == stringDelim {
+				inString = false
+			} else if !inString {
+				inString = true
+				stringDelim = r
+			}
+		}
+		escape = (r == '\\' && !escape)
+	}
+	// If we're at EOF, we have a final, non-terminated bundle. Return it.
+	if atEOF {
+		return len(data), data, bufio.ErrFinalToken
+	}
+	// Request more data.
+	return 0, nil, nil
+}
+
+// WriteReplicationBundle writes rrs to w as a replication bundle, which
+// ScanReplicationBundle (or a Gratia collector) will split back into the
+// same records. Parts that would not split correctly are escaped with
+// EscapeReplicationXML.
+func WriteReplicationBundle(w io.Writer, rrs []ReplicatedRecord) error {
+	var b bytes.Buffer
+	for _, rr := range rrs {
+		b.WriteString("replication|")
+		for _, p := range []string{rr.Rec, rr.Raw, rr.Extra} {
+			x, err := EscapeReplicationXML(p)
+			if err != nil {
+				return err
+			}
+			b.WriteString(x)
+			b.WriteString("|")
+		}
+	}
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// ToReplicationBundle returns the bundle in the replication format, as a
+// Gratia collector would send it, and the number of records in it.
+// Recognized records are in the UR-WG namespace (see MarshalRecordXML);
+// other records are included as they were received.
+func (b *RecordBundle) ToReplicationBundle() (string, int, error) {
+	rrs := make([]ReplicatedRecord, 0, b.RecordCount())
+	for rec := range b.Records() {
+		x, err := bundleRecordXML(rec)
+		if err != nil {
+			return "", 0, err
+		}
+		rrs = append(rrs, ReplicatedRecord{Rec: string(x), Raw: string(x)})
+	}
+	for _, r := range b.OtherRecords {
+		x := string(r.Raw())
+		rrs = append(rrs, ReplicatedRecord{Rec: x, Raw: x})
+	}
+	var buf bytes.Buffer
+	if err := WriteReplicationBundle(&buf, rrs); err != nil {
+		return "", 0, err
+	}
+	return buf.String(), len(rrs), nil
+}
+
+// EscapeReplicationXML returns XML x in a form that can be included in a
+// replication bundle. ScanBundle splits bundles at each "|" outside of a
+// double-quoted string, so x can be included as is unless it has a "|" or
+// unbalanced double quote in character data, or an attribute value that
+// contains a "|", a double quote or a trailing backslash. Otherwise x is
+// rewritten with those characters as character references, which XML
+// parsers treat the same, and comments that contain them are removed.
+func EscapeReplicationXML(x string) (string, error) {
+	if bundleSafe(x) {
+		return x, nil
+	}
+	var b bytes.Buffer
+	d := xml.NewDecoder(strings.NewReader(x))
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("can't escape XML for replication: %s", err)
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			b.WriteString("<" + qualifiedName(t.Name))
+			for _, a := range t.Attr {
+				b.WriteString(" " + qualifiedName(a.Name) + `="`)
+				b.WriteString(replicationEscaper.Replace(a.Value))
+				b.WriteString(`"`)
+			}
+			b.WriteString(">")
+		case xml.EndElement:
+			b.WriteString("</" + qualifiedName(t.Name) + ">")
+		case xml.CharData:
+			b.WriteString(replicationEscaper.Replace(string(t)))
+		case xml.Comment:
+			if !strings.ContainsAny(string(t), "|\"\\") {
+				b.WriteString("<!--" + string(t) + "-->")
+			}
+		case xml.ProcInst:
+			b.WriteString("<?" + t.Target + " " + string(t.Inst) + "?>")
+		case xml.Directive:
+			b.WriteString("<!" + string(t) + ">")
+		}
+	}
+	s := b.String()
+	if !bundleSafe(s) {
+		return "", fmt.Errorf("can't escape XML for replication")
+	}
+	return s, nil
+}
+
+var replicationEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&#34;",
+	"|", "&#124;",
+	`\`, "&#92;",
+)
+
+func qualifiedName(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+// bundleSafe returns true if ScanBundle would split s followed by a "|" at
+// that "|", i.e. return s as a single token.
+func bundleSafe(s string) bool {
+	adv, tok, err := ScanBundle([]byte(s+"|"), true)
+	return err == nil && adv == len(s)+1 && len(tok) == len(s)
+}
@@ -0,0 +1,163 @@
+package gracc
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestEscapeReplicationXML(t *testing.T) {
+	for _, x := range []string{
+		`<JobUsageRecord><JobName>a|b</JobName></JobUsageRecord>`,
+		`<JobUsageRecord><JobName>say "hi</JobName></JobUsageRecord>`,
+		`<JobUsageRecord><JobName urwg:description='a "b" | c\'>x</JobName></JobUsageRecord>`,
+		`<JobUsageRecord><JobName urwg:description="C:\">x</JobName></JobUsageRecord>`,
+		`<JobUsageRecord><!-- a|b --><JobName><![CDATA[x|y]]></JobName></JobUsageRecord>`,
+	} {
+		e, err := EscapeReplicationXML(x)
+		if err != nil {
+			t.Errorf("%s: %s", x, err)
+			continue
+		}
+		if !bundleSafe(e) {
+			t.Errorf("%s: escaped XML can't be replicated: %s", x, e)
+		}
+		if canonical(t, x) != canonical(t, e) {
+			t.Errorf("%s: escaped XML differs: %s", x, e)
+		}
+	}
+
+	// safe XML is left as is
+	x := `<JobUsageRecord xmlns:urwg="http://www.gridforum.org/2003/ur-wg"><JobName urwg:description="a|b">"x"</JobName ></JobUsageRecord>`
+	if e, err := EscapeReplicationXML(x); err != nil || e != x {
+		t.Errorf("expected XML unchanged, got %s (%v)", e, err)
+	}
+}
+
+func canonical(t *testing.T, x string) string {
+	c, err := canonicalXML([]byte(x))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(c)
+}
+
+func TestReplicationBundleRoundTrip(t *testing.T) {
+	var b RecordBundle
+	for _, rt := range Tests {
+		x, err := ioutil.ReadFile(rt.SourceXMLFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := ParseRecordXML(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.AddRecord(rec)
+	}
+	jur, err := NewJobUsageRecordBuilder(`tricky|"id`).
+		Field("JobName", `a|b "c" \d`, "description", `"|\`).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.AddRecord(jur)
+
+	bundle, n, err := b.ToReplicationBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != b.RecordCount() {
+		t.Errorf("expected %d records, got %d", b.RecordCount(), n)
+	}
+	rrs, err := ScanReplicationBundle(strings.NewReader(bundle), 4096, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != n {
+		t.Fatalf("expected %d records, scanned %d", n, len(rrs))
+	}
+	i := 0
+	for rec := range b.Records() {
+		rec2, err := ParseRecordXML([]byte(rrs[i].Rec))
+		if err != nil {
+			t.Fatalf("record %d: %s\n%s", i, err, rrs[i].Rec)
+		}
+		if rec2.Fingerprint() != rec.Fingerprint() {
+			t.Errorf("record %d: fingerprint changed:\n%s", i, rrs[i].Rec)
+		}
+		if rrs[i].Raw != rrs[i].Rec || rrs[i].Extra != "" {
+			t.Errorf("record %d: unexpected raw or extra", i)
+		}
+		i++
+	}
+	found := false
+	for _, rr := range rrs {
+		if rec, err := ParseRecordXML([]byte(rr.Rec)); err == nil && rec.Id() == `tricky|"id` {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("record with id tricky|\"id not found in bundle:\n%s", bundle)
+	}
+}
+
+func TestWriteReplicationBundle(t *testing.T) {
+	rrs := []ReplicatedRecord{
+		{Rec: "<A>1|2</A>", Raw: "<A>1|2</A>", Extra: ""},
+		{Rec: `<B x="|">"</B>`, Raw: "", Extra: "<C/>"},
+	}
+	var buf bytes.Buffer
+	if err := WriteReplicationBundle(&buf, rrs); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ScanReplicationBundle(&buf, 16, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(got))
+	}
+	if got[0].Rec != "<A>1&#124;2</A>" || got[1].Rec != `<B x="&#124;">&#34;</B>` || got[1].Extra != "<C/>" {
+		t.Errorf("unexpected records %+v", got)
+	}
+
+	if err := WriteReplicationBundle(&buf, []ReplicatedRecord{{Rec: `<A x="|>`}}); err == nil {
+		t.Error("expected error for malformed XML")
+	}
+}
+
+func TestReplicationBundleOtherRecords(t *testing.T) {
+	x := `<RecordEnvelope xmlns:urwg="http://www.gridforum.org/2003/ur-wg"><Bogus urwg:id="b1" kind="test"><Field urwg:unit="s">1</Field></Bogus></RecordEnvelope>`
+	var b RecordBundle
+	if err := xml.Unmarshal([]byte(x), &b); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.OtherRecords) != 1 {
+		t.Fatalf("expected 1 other record, got %d", len(b.OtherRecords))
+	}
+	bundle, n, err := b.ToReplicationBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 record, got %d", n)
+	}
+	rrs, err := ScanReplicationBundle(strings.NewReader(bundle), 4096, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 {
+		t.Fatalf("expected 1 record, scanned %d", len(rrs))
+	}
+	if rrs[0].Rec != string(b.OtherRecords[0].Raw()) {
+		t.Errorf("expected record as received:\n%s\ngot:\n%s", b.OtherRecords[0].Raw(), rrs[0].Rec)
+	}
+	for _, s := range []string{`xmlns:urwg="http://www.gridforum.org/2003/ur-wg"`, `urwg:id="b1"`, `kind="test"`, `urwg:unit="s"`} {
+		if !strings.Contains(rrs[0].Rec, s) {
+			t.Errorf("expected %s in record: %s", s, rrs[0].Rec)
+		}
+	}
+}
@@ -11,9 +11,17 @@ type StorageElement struct {
 	XMLName   xml.Name
 	UniqueID  string    `xml:",omitempty"`
 	Timestamp time.Time `xml:",omitempty"`
-	Origin    origin    `xml:,omitempty"`
+	Origin    origin    `xml:",omitempty"`
 	Fields    []field   `xml:",any"`
 	RawXML    []byte    `xml:",innerxml"`
+	raw       []byte
+}
+
+func init() {
+	RegisterRecordType(RecordType{
+		Names: []string{"StorageElement"},
+		New:   func() ParsableRecord { return &StorageElement{} },
+	})
 }
 
 // ParseXML attempts to unmarshal the XML in xb into a StorageElement.
@@ -21,6 +29,18 @@ func (se *StorageElement) ParseXML(xb []byte) error {
 	if err := xml.Unmarshal(xb, se); err != nil {
 		return err
 	}
+	se.raw = recordBytes(xb)
+	return nil
+}
+
+type storageElement StorageElement
+
+// UnmarshalXML unmarshals the record, keeping its start element for Raw.
+func (se *StorageElement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if err := d.DecodeElement((*storageElement)(se), &start); err != nil {
+		return err
+	}
+	se.raw = rawRecord(start, se.RawXML)
 	return nil
 }
 
@@ -34,12 +54,32 @@ func (se *StorageElement) Type() string {
 	return se.XMLName.Local
 }
 
-// Raw returns the unaltered source of the record.
+// ProbeName returns the ProbeName element of the record, if it has one.
+func (se *StorageElement) ProbeName() string {
+	return fieldValue(se.Fields, "ProbeName")
+}
+
+// Identity returns the values that identify the record, so that the same
+// record sent again can be recognized: its UniqueID and Timestamp, since
+// the UniqueID is repeated in each report.
+func (se *StorageElement) Identity() string {
+	return se.UniqueID + "\x00" + se.Timestamp.String()
+}
+
+// Raw returns the source of the record.
 func (se *StorageElement) Raw() []byte {
+	if se.raw != nil {
+		return se.raw
+	}
 	s := "<" + se.XMLName.Local + ">" + string(se.RawXML) + "</" + se.XMLName.Local + ">"
 	return []byte(s)
 }
 
+// Fingerprint returns a checksum of the record's canonical XML.
+func (se *StorageElement) Fingerprint() string {
+	return fingerprint(se.Raw())
+}
+
 // ToJSON returns a JSON encoding of the Record, with certain elements
 // transformed to fit the GRACC Raw Record schema.
 // Indent specifies the string to use for each indentation level,
@@ -70,6 +110,7 @@ func (se *StorageElement) ToJSON(indent string) ([]byte, error) {
 
 	// add XML
 	r["RawXML"] = string(se.Raw())
+	r["Fingerprint"] = se.Fingerprint()
 
 	if indent != "" {
 		return json.MarshalIndent(r, "", indent)
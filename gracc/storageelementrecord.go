@@ -16,15 +16,35 @@ type StorageElementRecord struct {
 	UsedSpace      uint64    `xml:",omitempty"`
 	FileCount      uint64    `xml:",omitempty"`
 	FileCountLimit uint64    `xml:",omitempty"`
-	Origin         origin    `xml:,omitempty"`
+	Origin         origin    `xml:",omitempty"`
 	Fields         []field   `xml:",any"`
 	RawXML         []byte    `xml:",innerxml"`
+	raw            []byte
+}
+
+func init() {
+	RegisterRecordType(RecordType{
+		Names: []string{"StorageElementRecord"},
+		New:   func() ParsableRecord { return &StorageElementRecord{} },
+	})
 }
 
 func (ser *StorageElementRecord) ParseXML(xb []byte) error {
 	if err := xml.Unmarshal(xb, ser); err != nil {
 		return err
 	}
+	ser.raw = recordBytes(xb)
+	return nil
+}
+
+type storageElementRecord StorageElementRecord
+
+// UnmarshalXML unmarshals the record, keeping its start element for Raw.
+func (ser *StorageElementRecord) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if err := d.DecodeElement((*storageElementRecord)(ser), &start); err != nil {
+		return err
+	}
+	ser.raw = rawRecord(start, ser.RawXML)
 	return nil
 }
 
@@ -38,12 +58,32 @@ func (ser *StorageElementRecord) Type() string {
 	return ser.XMLName.Local
 }
 
-// Raw returns the unaltered source of the record.
+// ProbeName returns the ProbeName element of the record, if it has one.
+func (ser *StorageElementRecord) ProbeName() string {
+	return fieldValue(ser.Fields, "ProbeName")
+}
+
+// Identity returns the values that identify the record, so that the same
+// record sent again can be recognized: its UniqueID and Timestamp, since
+// the UniqueID is repeated in each report.
+func (ser *StorageElementRecord) Identity() string {
+	return ser.UniqueID + "\x00" + ser.Timestamp.String()
+}
+
+// Raw returns the source of the record.
 func (ser *StorageElementRecord) Raw() []byte {
+	if ser.raw != nil {
+		return ser.raw
+	}
 	s := "<" + ser.XMLName.Local + ">" + string(ser.RawXML) + "</" + ser.XMLName.Local + ">"
 	return []byte(s)
 }
 
+// Fingerprint returns a checksum of the record's canonical XML.
+func (ser *StorageElementRecord) Fingerprint() string {
+	return fingerprint(ser.Raw())
+}
+
 // ToJSON returns a JSON encoding of the Record, with certain elements
 // transformed to fit the GRACC Raw Record schema.
 // Indent specifies the string to use for each indentation level,
@@ -91,6 +131,7 @@ func (ser *StorageElementRecord) ToJSON(indent string) ([]byte, error) {
 
 	// add XML
 	r["RawXML"] = string(ser.Raw())
+	r["Fingerprint"] = ser.Fingerprint()
 
 	if indent != "" {
 		return json.MarshalIndent(r, "", indent)
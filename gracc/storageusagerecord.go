@@ -0,0 +1,190 @@
+package gracc
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"time"
+)
+
+type groupAttribute struct {
+	Type  string `xml:"attributeType,attr"`
+	Value string `xml:",chardata"`
+}
+
+type subjectIdentity struct {
+	LocalUser      string           `xml:",omitempty"`
+	LocalGroup     string           `xml:",omitempty"`
+	UserIdentity   string           `xml:",omitempty"`
+	Group          string           `xml:",omitempty"`
+	GroupAttribute []groupAttribute `xml:",omitempty"`
+}
+
+func (i *subjectIdentity) flatten() map[string]interface{} {
+	var r = make(map[string]interface{})
+	for k, v := range map[string]string{
+		"LocalUser":    i.LocalUser,
+		"LocalGroup":   i.LocalGroup,
+		"UserIdentity": i.UserIdentity,
+		"Group":        i.Group,
+	} {
+		if v != "" {
+			r[k] = v
+		}
+	}
+	for _, a := range i.GroupAttribute {
+		k := "unknown"
+		if a.Type != "" {
+			k = strings.Map(mapForKey, a.Type)
+		}
+		r["GroupAttribute_"+k] = a.Value
+	}
+	return r
+}
+
+// StorageUsageRecord is an EMI StAR storage accounting record, as reported
+// by WLCG storage sites: the space and number of files used in a share of a
+// storage system, by a user or group, over a period of time.
+type StorageUsageRecord struct {
+	XMLName         xml.Name
+	RecordIdentity  recordIdentity  `xml:",omitempty"`
+	StorageSystem   string          `xml:",omitempty"`
+	Site            string          `xml:",omitempty"`
+	StorageShare    string          `xml:",omitempty"`
+	StorageMedia    string          `xml:",omitempty"`
+	StorageClass    string          `xml:",omitempty"`
+	DirectoryPath   string          `xml:",omitempty"`
+	SubjectIdentity subjectIdentity `xml:",omitempty"`
+	StartTime       time.Time       `xml:",omitempty"`
+	EndTime         time.Time       `xml:",omitempty"`
+	// Counts are pointers so that zeros are distinguished from values that
+	// aren't reported. Capacities are in bytes.
+	FileCount                 *uint64 `xml:",omitempty"`
+	ResourceCapacityUsed      *uint64 `xml:",omitempty"`
+	LogicalCapacityUsed       *uint64 `xml:",omitempty"`
+	ResourceCapacityAllocated *uint64 `xml:",omitempty"`
+	Origin                    origin  `xml:",omitempty"`
+	Fields                    []field `xml:",any"`
+	RawXML                    []byte  `xml:",innerxml"`
+	raw                       []byte
+}
+
+func init() {
+	RegisterRecordType(RecordType{
+		Names: []string{"StorageUsageRecord"},
+		New:   func() ParsableRecord { return &StorageUsageRecord{} },
+	})
+}
+
+// ParseXML attempts to unmarshal the XML in xb into a StorageUsageRecord.
+func (sur *StorageUsageRecord) ParseXML(xb []byte) error {
+	if err := xml.Unmarshal(xb, sur); err != nil {
+		return err
+	}
+	sur.raw = recordBytes(xb)
+	return nil
+}
+
+type storageUsageRecord StorageUsageRecord
+
+// UnmarshalXML unmarshals the record, keeping its start element for Raw.
+func (sur *StorageUsageRecord) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if err := d.DecodeElement((*storageUsageRecord)(sur), &start); err != nil {
+		return err
+	}
+	sur.raw = rawRecord(start, sur.RawXML)
+	return nil
+}
+
+// Id returns an identification string for the record.
+func (sur *StorageUsageRecord) Id() string {
+	return sur.RecordIdentity.RecordId
+}
+
+// Type returns the type of the record.
+func (sur *StorageUsageRecord) Type() string {
+	return sur.XMLName.Local
+}
+
+// ProbeName returns the ProbeName element of the record, if it has one.
+func (sur *StorageUsageRecord) ProbeName() string {
+	return fieldValue(sur.Fields, "ProbeName")
+}
+
+// Raw returns the source of the record.
+func (sur *StorageUsageRecord) Raw() []byte {
+	if sur.raw != nil {
+		return sur.raw
+	}
+	s := "<" + sur.XMLName.Local + ">" + string(sur.RawXML) + "</" + sur.XMLName.Local + ">"
+	return []byte(s)
+}
+
+// Fingerprint returns a checksum of the record's canonical XML.
+func (sur *StorageUsageRecord) Fingerprint() string {
+	return fingerprint(sur.Raw())
+}
+
+// ToJSON returns a JSON encoding of the Record, with certain elements
+// transformed to fit the GRACC Raw Record schema. Each GroupAttribute of the
+// subject is under GroupAttribute_<attributeType>.
+// Indent specifies the string to use for each indentation level,
+// if empty no indentation or pretty-printing is performed.
+func (sur *StorageUsageRecord) ToJSON(indent string) ([]byte, error) {
+	var r = make(map[string]interface{})
+
+	r["type"] = "StorageUsageRecord"
+
+	for k, v := range sur.RecordIdentity.flatten() {
+		r[k] = v
+	}
+	for k, v := range map[string]string{
+		"StorageSystem": sur.StorageSystem,
+		"Site":          sur.Site,
+		"StorageShare":  sur.StorageShare,
+		"StorageMedia":  sur.StorageMedia,
+		"StorageClass":  sur.StorageClass,
+		"DirectoryPath": sur.DirectoryPath,
+	} {
+		if v != "" {
+			r[k] = v
+		}
+	}
+	for k, v := range sur.SubjectIdentity.flatten() {
+		r[k] = v
+	}
+
+	// validity window
+	if !sur.StartTime.IsZero() {
+		r["StartTime"] = sur.StartTime.Format(time.RFC3339)
+	}
+	if !sur.EndTime.IsZero() {
+		r["EndTime"] = sur.EndTime.Format(time.RFC3339)
+	}
+
+	setCount(r, "FileCount", sur.FileCount)
+	setCount(r, "ResourceCapacityUsed", sur.ResourceCapacityUsed)
+	setCount(r, "LogicalCapacityUsed", sur.LogicalCapacityUsed)
+	setCount(r, "ResourceCapacityAllocated", sur.ResourceCapacityAllocated)
+
+	// flatten other fields
+	for _, f := range sur.Fields {
+		for k, v := range f.flatten() {
+			r[k] = v
+		}
+	}
+
+	// origin
+	for k, v := range sur.Origin.flatten() {
+		r[k] = v
+	}
+
+	// add XML
+	r["RawXML"] = string(sur.Raw())
+	r["Fingerprint"] = sur.Fingerprint()
+
+	if indent != "" {
+		return json.MarshalIndent(r, "", indent)
+	}
+	return json.Marshal(r)
+}
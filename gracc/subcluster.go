@@ -0,0 +1,152 @@
+package gracc
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"time"
+)
+
+// Subcluster describes a homogeneous set of hosts in a cluster: their
+// number, cores, memory, processor model, and benchmark values, which are
+// used to normalize CPU hours.
+type Subcluster struct {
+	XMLName   xml.Name
+	UniqueID  string    `xml:",omitempty"`
+	Timestamp time.Time `xml:",omitempty"`
+	// Counts and benchmarks are pointers so that zeros are distinguished
+	// from values that aren't reported.
+	Hosts          *uint64  `xml:",omitempty"`
+	Cpus           *uint64  `xml:",omitempty"`
+	Cores          *uint64  `xml:",omitempty"`
+	SmpSize        *uint64  `xml:",omitempty"`
+	RAM            *uint64  `xml:",omitempty"`
+	VirtualMem     *uint64  `xml:",omitempty"`
+	Clock          *float64 `xml:",omitempty"`
+	SpecInt2000    *float64 `xml:",omitempty"`
+	SpecFloat2000  *float64 `xml:",omitempty"`
+	BenchmarkValue *float64 `xml:",omitempty"`
+	Origin         origin   `xml:",omitempty"`
+	Fields         []field  `xml:",any"`
+	RawXML         []byte   `xml:",innerxml"`
+	raw            []byte
+}
+
+func init() {
+	RegisterRecordType(RecordType{
+		Names: []string{"Subcluster"},
+		New:   func() ParsableRecord { return &Subcluster{} },
+	})
+}
+
+// ParseXML attempts to unmarshal the XML in xb into a Subcluster.
+func (sc *Subcluster) ParseXML(xb []byte) error {
+	if err := xml.Unmarshal(xb, sc); err != nil {
+		return err
+	}
+	sc.raw = recordBytes(xb)
+	return nil
+}
+
+type subcluster Subcluster
+
+// UnmarshalXML unmarshals the record, keeping its start element for Raw.
+func (sc *Subcluster) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if err := d.DecodeElement((*subcluster)(sc), &start); err != nil {
+		return err
+	}
+	sc.raw = rawRecord(start, sc.RawXML)
+	return nil
+}
+
+// Id returns an identification string for the record.
+func (sc *Subcluster) Id() string {
+	return sc.UniqueID
+}
+
+// Type returns the type of the record.
+func (sc *Subcluster) Type() string {
+	return sc.XMLName.Local
+}
+
+// ProbeName returns the ProbeName element of the record, if it has one.
+func (sc *Subcluster) ProbeName() string {
+	return fieldValue(sc.Fields, "ProbeName")
+}
+
+// Identity returns the values that identify the record, so that the same
+// record sent again can be recognized: its UniqueID and Timestamp, since
+// the UniqueID is repeated in each report.
+func (sc *Subcluster) Identity() string {
+	return sc.UniqueID + "\x00" + sc.Timestamp.String()
+}
+
+// Raw returns the source of the record.
+func (sc *Subcluster) Raw() []byte {
+	if sc.raw != nil {
+		return sc.raw
+	}
+	s := "<" + sc.XMLName.Local + ">" + string(sc.RawXML) + "</" + sc.XMLName.Local + ">"
+	return []byte(s)
+}
+
+// Fingerprint returns a checksum of the record's canonical XML.
+func (sc *Subcluster) Fingerprint() string {
+	return fingerprint(sc.Raw())
+}
+
+// ToJSON returns a JSON encoding of the Record, with certain elements
+// transformed to fit the GRACC Raw Record schema.
+// Indent specifies the string to use for each indentation level,
+// if empty no indentation or pretty-printing is performed.
+func (sc *Subcluster) ToJSON(indent string) ([]byte, error) {
+	var r = make(map[string]interface{})
+
+	r["type"] = "Subcluster"
+
+	r["UniqueID"] = sc.UniqueID
+
+	// Standard time instants
+	if !sc.Timestamp.IsZero() {
+		r["Timestamp"] = sc.Timestamp.Format(time.RFC3339)
+	}
+
+	// data fields
+	setCount(r, "Hosts", sc.Hosts)
+	setCount(r, "Cpus", sc.Cpus)
+	setCount(r, "Cores", sc.Cores)
+	setCount(r, "SmpSize", sc.SmpSize)
+	setCount(r, "RAM", sc.RAM)
+	setCount(r, "VirtualMem", sc.VirtualMem)
+	setNumber(r, "Clock", sc.Clock)
+	setNumber(r, "SpecInt2000", sc.SpecInt2000)
+	setNumber(r, "SpecFloat2000", sc.SpecFloat2000)
+	setNumber(r, "BenchmarkValue", sc.BenchmarkValue)
+
+	// flatten other fields
+	for _, f := range sc.Fields {
+		for k, v := range f.flatten() {
+			r[k] = v
+		}
+	}
+
+	// origin
+	for k, v := range sc.Origin.flatten() {
+		r[k] = v
+	}
+
+	// add XML
+	r["RawXML"] = string(sc.Raw())
+	r["Fingerprint"] = sc.Fingerprint()
+
+	if indent != "" {
+		return json.MarshalIndent(r, "", indent)
+	}
+	return json.Marshal(r)
+}
+
+// setNumber sets r[k] to number n, if it was reported.
+func setNumber(r map[string]interface{}, k string, n *float64) {
+	if n != nil {
+		r[k] = *n
+	}
+}
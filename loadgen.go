@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+// runLoadgen implements the loadgen subcommand, which sends synthetic bundles
+// to a collector at a given rate or concurrency, and reports the throughput,
+// latency, and errors, for capacity planning.
+func runLoadgen(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var g loadGenerator
+	url := fs.String("url", "http://localhost:8080/gratia-servlets/rmi", "URL of the collector's rmi servlet")
+	duration := fs.Duration("duration", 30*time.Second, "how long to send bundles for")
+	requests := fs.Int("requests", 0, "number of bundles to send, or 0 to send until duration has passed")
+	rate := fs.Float64("rate", 0, "bundles to send per second, or 0 to send as fast as the concurrency allows")
+	concurrency := fs.Int("concurrency", 4, "maximum number of requests in flight")
+	fs.IntVar(&g.MinSize, "minsize", 1, "minimum number of records per bundle")
+	fs.IntVar(&g.MaxSize, "maxsize", 100, "maximum number of records per bundle")
+	fs.IntVar(&g.Probes, "probes", 20, "number of distinct probes to send as")
+	fs.Float64Var(&g.Storage, "storage", 0.1, "fraction of records that are StorageElementRecords")
+	fs.Float64Var(&g.Invalid, "invalid", 0, "fraction of bundles that contain a record of an unrecognized type")
+	seed := fs.Int64("seed", 0, "random seed, or 0 to use the current time")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: gracc-collector loadgen [-url url] [-rate n | -concurrency n] [-duration d | -requests n]\n\n")
+		fmt.Fprintf(stderr, "Sends synthetic RecordEnvelope bundles to a collector and reports the\n")
+		fmt.Fprintf(stderr, "throughput, latency percentiles, and errors.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *concurrency < 1 || g.MinSize < 1 || g.MaxSize < g.MinSize || g.Probes < 1 {
+		fmt.Fprintf(stderr, "concurrency, minsize and probes must be at least 1, and maxsize at least minsize\n")
+		return 2
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	g.rand = rand.New(rand.NewSource(*seed))
+
+	c := gracc.NewClient(*url, "")
+	c.Retries = 0
+	res := g.Run(c, *duration, *requests, *rate, *concurrency)
+	res.Report(stdout)
+	if res.Requests == 0 {
+		return 1
+	}
+	return 0
+}
+
+// loadGenerator synthesizes bundles of JobUsageRecords and
+// StorageElementRecords from a number of probes.
+type loadGenerator struct {
+	MinSize, MaxSize int
+	Probes           int
+	Storage          float64
+	Invalid          float64
+
+	rand *rand.Rand
+	seq  int
+}
+
+// loadBundle is a synthetic bundle.
+type loadBundle struct {
+	From     string
+	Envelope string
+	Records  int
+	// Invalid is true if the bundle contains an invalid record.
+	Invalid bool
+}
+
+// loadResult is the outcome of sending one bundle.
+type loadResult struct {
+	Records  int
+	Latency  time.Duration
+	Category string
+}
+
+// loadResults summarizes the outcomes of a load generator run.
+type loadResults struct {
+	Requests   int
+	Records    int
+	Elapsed    time.Duration
+	Latencies  durations
+	Categories map[string]int
+}
+
+// Run sends bundles with client c until duration has passed, or n bundles
+// have been sent if n > 0. If rate > 0, bundles are started at that rate per
+// second; at most concurrency requests are in flight at once.
+func (g *loadGenerator) Run(c *gracc.Client, duration time.Duration, n int, rate float64, concurrency int) *loadResults {
+	bundles := make(chan loadBundle, concurrency)
+	results := make(chan loadResult, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range bundles {
+				cl := *c
+				cl.From = b.From
+				start := time.Now()
+				err := cl.MultiUpdate(b.Envelope)
+				cat := errorCategory(err)
+				if b.Invalid {
+					// counted separately, since the response depends on
+					// the collector's acceptance policy
+					cat += " (invalid)"
+				}
+				results <- loadResult{
+					Records:  b.Records,
+					Latency:  time.Since(start),
+					Category: cat,
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	go func() {
+		defer close(bundles)
+		var tick <-chan time.Time
+		if rate > 0 {
+			t := time.NewTicker(time.Duration(float64(time.Second) / rate))
+			defer t.Stop()
+			tick = t.C
+		}
+		deadline := time.After(duration)
+		for i := 0; n <= 0 || i < n; i++ {
+			b := g.Bundle()
+			if tick != nil {
+				select {
+				case <-tick:
+				case <-deadline:
+					return
+				}
+			}
+			select {
+			case bundles <- b:
+			case <-deadline:
+				return
+			}
+		}
+	}()
+
+	res := &loadResults{Categories: make(map[string]int)}
+	for r := range results {
+		res.Requests++
+		res.Records += r.Records
+		res.Latencies = append(res.Latencies, r.Latency)
+		res.Categories[r.Category]++
+	}
+	res.Elapsed = time.Since(start)
+	return res
+}
+
+// errorCategory returns the category of the response to a request, which
+// corresponds to the kinds of error distinguished by handleError.
+func errorCategory(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	rerr, ok := err.(*gracc.ResponseError)
+	if !ok {
+		return "connection error"
+	}
+	switch rerr.StatusCode {
+	case http.StatusOK:
+		return "error response"
+	case http.StatusServiceUnavailable:
+		return "503 unavailable"
+	case http.StatusBadRequest:
+		return "400 bad request"
+	case http.StatusInternalServerError:
+		return "500 internal error"
+	}
+	return rerr.Status
+}
+
+// Report writes a summary of the results to w.
+func (res *loadResults) Report(w io.Writer) {
+	secs := res.Elapsed.Seconds()
+	fmt.Fprintf(w, "bundles:    %d (%.1f/s)\n", res.Requests, float64(res.Requests)/secs)
+	fmt.Fprintf(w, "records:    %d (%.1f/s)\n", res.Records, float64(res.Records)/secs)
+	fmt.Fprintf(w, "elapsed:    %s\n", res.Elapsed)
+	if len(res.Latencies) > 0 {
+		sort.Sort(res.Latencies)
+		fmt.Fprintf(w, "latency:    p50 %s, p90 %s, p99 %s, max %s\n",
+			res.Latencies.Percentile(50),
+			res.Latencies.Percentile(90),
+			res.Latencies.Percentile(99),
+			res.Latencies[len(res.Latencies)-1])
+	}
+	cats := make([]string, 0, len(res.Categories))
+	for c := range res.Categories {
+		cats = append(cats, c)
+	}
+	sort.Strings(cats)
+	for _, c := range cats {
+		fmt.Fprintf(w, "%-20s%d\n", c+":", res.Categories[c])
+	}
+}
+
+// durations is a sortable list of durations.
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// Percentile returns the pth percentile of sorted durations d.
+func (d durations) Percentile(p float64) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	i := int(float64(len(d))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(d) {
+		i = len(d) - 1
+	}
+	return d[i]
+}
+
+// Bundle returns a new synthetic bundle, from a random probe.
+func (g *loadGenerator) Bundle() loadBundle {
+	probe := g.rand.Intn(g.Probes)
+	host := fmt.Sprintf("ce%02d.loadgen.example.org", probe)
+	size := g.MinSize + g.rand.Intn(g.MaxSize-g.MinSize+1)
+	invalid := -1
+	if g.rand.Float64() < g.Invalid {
+		invalid = g.rand.Intn(size)
+	}
+	var b bytes.Buffer
+	b.WriteString("<RecordEnvelope>\n")
+	for i := 0; i < size; i++ {
+		g.seq++
+		var rec string
+		if g.rand.Float64() < g.Storage {
+			rec = g.storageRecord(host)
+		} else {
+			rec = g.jobRecord(host)
+		}
+		if i == invalid {
+			// rename the root element, so that the record is well-formed
+			// but of an unrecognized type
+			rec = strings.Replace(rec, "JobUsageRecord", "LoadGenUsageRecord", -1)
+			rec = strings.Replace(rec, "StorageElementRecord", "LoadGenUsageRecord", -1)
+		}
+		b.WriteString(rec)
+	}
+	b.WriteString("</RecordEnvelope>\n")
+	return loadBundle{
+		From:     host,
+		Envelope: b.String(),
+		Records:  size,
+		Invalid:  invalid >= 0,
+	}
+}
+
+var loadVOs = []string{"osg", "cms", "atlas", "fermilab", "ligo", "icecube", "gluex"}
+
+// jobRecord returns a JobUsageRecord from probe host, with a random number
+// of optional fields.
+func (g *loadGenerator) jobRecord(host string) string {
+	end := time.Now().Add(-time.Duration(g.rand.Intn(86400)) * time.Second).UTC()
+	wall := g.rand.Intn(86400) + 1
+	cpu := g.rand.Intn(wall*8) + 1
+	procs := 1 << uint(g.rand.Intn(4))
+	vo := loadVOs[g.rand.Intn(len(loadVOs))]
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<JobUsageRecord xmlns="http://www.gridforum.org/2003/ur-wg" xmlns:urwg="http://www.gridforum.org/2003/ur-wg">
+<RecordIdentity urwg:recordId="%s:%d.%d" urwg:createTime="%s"/>
+<JobIdentity>
+<GlobalJobId>condor.%s#%d.0#%d</GlobalJobId>
+<LocalJobId>%d</LocalJobId>
+</JobIdentity>
+<UserIdentity>
+<LocalUserId>%s%03d</LocalUserId>
+<VOName>%s</VOName>
+<ReportableVOName>%s</ReportableVOName>
+</UserIdentity>
+<Status>0</Status>
+<WallDuration>PT%dS</WallDuration>
+<CpuDuration urwg:usageType="user">PT%dS</CpuDuration>
+<CpuDuration urwg:usageType="system">PT%dS</CpuDuration>
+<Processors urwg:metric="max">%d</Processors>
+<StartTime>%s</StartTime>
+<EndTime>%s</EndTime>
+<MachineName>%s</MachineName>
+<SiteName>LOADGEN_%s</SiteName>
+<ProbeName>condor:%s</ProbeName>
+<Grid>OSG</Grid>
+`,
+		host, g.seq, g.rand.Intn(1000), time.Now().UTC().Format(time.RFC3339),
+		host, g.seq, end.Unix(), g.seq,
+		vo, g.rand.Intn(1000), vo, vo,
+		wall, cpu*9/10, cpu/10, procs,
+		end.Add(-time.Duration(wall)*time.Second).Format(time.RFC3339), end.Format(time.RFC3339),
+		host, host[:4], host)
+	for i, n := 0, g.rand.Intn(8); i < n; i++ {
+		fmt.Fprintf(&b, "<Resource urwg:description=\"LoadGen%d\">%d</Resource>\n", i, g.rand.Intn(1000000))
+	}
+	if g.rand.Intn(2) == 0 {
+		fmt.Fprintf(&b, "<Memory urwg:storageUnit=\"KB\" urwg:metric=\"max\">%d</Memory>\n", g.rand.Intn(8000000))
+	}
+	b.WriteString("<Resource urwg:description=\"ResourceType\">Batch</Resource>\n</JobUsageRecord>\n")
+	return b.String()
+}
+
+// storageRecord returns a StorageElementRecord from probe host.
+func (g *loadGenerator) storageRecord(host string) string {
+	total := uint64(g.rand.Int63n(1<<50)) + 1
+	used := uint64(g.rand.Int63n(int64(total)))
+	return fmt.Sprintf(`<StorageElementRecord xmlns:urwg="http://www.gridforum.org/2003/ur-wg">
+<UniqueID>%s:Pool:pool%02d</UniqueID>
+<MeasurementType>raw</MeasurementType>
+<StorageType>disk</StorageType>
+<Timestamp>%s</Timestamp>
+<TotalSpace>%d</TotalSpace>
+<FreeSpace>%d</FreeSpace>
+<UsedSpace>%d</UsedSpace>
+<ProbeName>dCache-storage:%s</ProbeName>
+<SiteName>LOADGEN_%s</SiteName>
+<Grid>OSG</Grid>
+</StorageElementRecord>
+`,
+		host, g.rand.Intn(16), time.Now().UTC().Format(time.RFC3339),
+		total, total-used, used, host, host[:4])
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+func TestLoadGenBundle(t *testing.T) {
+	g := loadGenerator{
+		MinSize: 1,
+		MaxSize: 20,
+		Probes:  3,
+		Storage: 0.5,
+		rand:    rand.New(rand.NewSource(1)),
+	}
+	for i := 0; i < 20; i++ {
+		b := g.Bundle()
+		inputs, err := splitConvertInput([]byte(b.Envelope), 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(inputs) != b.Records {
+			t.Errorf("expected %d records, got %d", b.Records, len(inputs))
+		}
+		for _, x := range inputs {
+			if _, err := gracc.ParseRecordXML(x); err != nil {
+				t.Errorf("error parsing generated record: %s\n%s", err, x)
+			}
+		}
+	}
+
+	// an invalid record is well-formed, but of an unrecognized type
+	g.Invalid = 1
+	b := g.Bundle()
+	if !b.Invalid {
+		t.Errorf("expected invalid bundle")
+	}
+	var bun gracc.RecordBundle
+	if err := xml.Unmarshal([]byte(b.Envelope), &bun); err != nil {
+		t.Fatalf("error parsing bundle with invalid record: %s", err)
+	}
+	if len(bun.OtherRecords) != 1 || bun.OtherRecords[0].XMLName.Local != "LoadGenUsageRecord" {
+		t.Errorf("expected 1 record of unrecognized type, got %v", bun.OtherRecords)
+	}
+	var n int
+	for range bun.Records() {
+		n++
+	}
+	if n != b.Records-1 {
+		t.Errorf("expected %d valid records, got %d", b.Records-1, n)
+	}
+}
+
+func TestLoadGenRun(t *testing.T) {
+	n := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if n%4 == 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "OK")
+	}))
+	defer srv.Close()
+	g := loadGenerator{
+		MinSize: 5,
+		MaxSize: 5,
+		Probes:  1,
+		Invalid: 0.5,
+		rand:    rand.New(rand.NewSource(1)),
+	}
+	c := gracc.NewClient(srv.URL, "")
+	c.Retries = 0
+	res := g.Run(c, time.Minute, 20, 0, 1)
+	if res.Requests != 20 || res.Records != 100 {
+		t.Errorf("expected 20 bundles of 100 records, got %d of %d", res.Requests, res.Records)
+	}
+	// bundles with an invalid record are counted separately
+	ok := res.Categories["ok"] + res.Categories["ok (invalid)"]
+	unavailable := res.Categories["503 unavailable"] + res.Categories["503 unavailable (invalid)"]
+	if ok != 15 || unavailable != 5 || res.Categories["ok (invalid)"] == 0 {
+		t.Errorf("unexpected categories %v", res.Categories)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var d durations
+	for i := 1; i <= 100; i++ {
+		d = append(d, time.Duration(i))
+	}
+	for _, pt := range []struct {
+		p   float64
+		exp time.Duration
+	}{{50, 50}, {90, 90}, {99, 99}, {100, 100}, {0, 1}} {
+		if got := d.Percentile(pt.p); got != pt.exp {
+			t.Errorf("p%v: expected %d, got %d", pt.p, pt.exp, got)
+		}
+	}
+}
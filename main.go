@@ -33,6 +33,16 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "convert":
+			os.Exit(runConvert(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "send":
+			os.Exit(runSend(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "loadgen":
+			os.Exit(runLoadgen(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
 	flag.Parse()
 
 	// need to set log output first, since we log everything else
@@ -133,6 +143,7 @@ MainLoop:
 			case os.Interrupt, syscall.SIGTERM:
 				// terminate
 				log.WithField("signal", s).Info("exiting")
+				g.Close()
 				break MainLoop
 			case syscall.SIGUSR1, syscall.SIGHUP:
 				// refresh log file
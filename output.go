@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+// Output is a destination for records, e.g. an AMQP exchange.
+type Output interface {
+	// NewWorker opens a new batch of bundleSize records from the bundle
+	// described by info.
+	NewWorker(bundleSize int, info BundleInfo) (Worker, error)
+	// Close shuts down the output.
+	Close() error
+}
+
+// Worker sends a batch of records to an Output.
+type Worker interface {
+	// PublishRecord sends rec to the output. It does not wait for
+	// confirmation that the record was received. A RecordError (or a
+	// RejectedError, if the output rejects rec as invalid) is returned if
+	// rec can't be sent by this output, in which case the worker may still
+	// be used for other records.
+	PublishRecord(rec gracc.Record) error
+	// Wait waits for confirmation that all records published so far were
+	// received, or until timeout elapses (unless timeout<=0). A
+	// RejectedError is returned if only some records were rejected.
+	Wait(timeout time.Duration) error
+	// Close retires the worker. Call Wait first to make sure all records
+	// were received!
+	Close() error
+}
+
+// OutputConfig configures one of the outputs that each bundle is sent to.
+type OutputConfig struct {
+	Name          string
+	Type          string
+	Required      bool
+	AMQP          AMQPConfig
+	File          FileConfig
+	Elasticsearch ElasticsearchConfig
+}
+
+func (c *OutputConfig) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("output name is required")
+	}
+	switch c.Type {
+	case "amqp":
+		c.AMQP.setDefaults(DefaultConfig().AMQP)
+		if err := c.AMQP.Validate(); err != nil {
+			return fmt.Errorf("output %s: %s", c.Name, err)
+		}
+	case "file":
+		if err := c.File.Validate(); err != nil {
+			return fmt.Errorf("output %s: %s", c.Name, err)
+		}
+	case "elasticsearch":
+		if err := c.Elasticsearch.Validate(); err != nil {
+			return fmt.Errorf("output %s: %s", c.Name, err)
+		}
+	default:
+		return fmt.Errorf("output %s: unknown type \"%s\"", c.Name, c.Type)
+	}
+	return nil
+}
+
+// NewOutput initializes the Output described by conf.
+func NewOutput(conf OutputConfig) (Output, error) {
+	switch conf.Type {
+	case "amqp":
+		return InitAMQP(conf.AMQP)
+	case "file":
+		return InitFile(conf.File)
+	case "elasticsearch":
+		return InitElasticsearch(conf.Elasticsearch)
+	}
+	return nil, fmt.Errorf("unknown output type \"%s\"", conf.Type)
+}
+
+// OutputSink is an initialized Output along with the policy for handling
+// errors sending to it. If a Required output fails the sender will get an
+// error response, while errors from best-effort outputs are only logged.
+type OutputSink struct {
+	Name     string
+	Required bool
+	Output   Output
+	Spool    *Spool
+	errors   uint64
+}
+
+// flattenRecord returns the fields of rec as they appear in its JSON encoding.
+func flattenRecord(rec gracc.Record) (map[string]interface{}, error) {
+	j, err := rec.ToJSON("")
+	if err != nil {
+		return nil, err
+	}
+	var f map[string]interface{}
+	if err := json.Unmarshal(j, &f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// encodeRecord encodes rec in format: "raw" (the original XML), "xml"
+// (the XML in the UR-WG namespace, see gracc.MarshalRecordXML; generic
+// records as they were received), or "json" (indented with indent, if not
+// empty). It also returns the MIME type of the encoding. Records in "apel"
+// format are encoded in batches, by encodeAPELRecord.
+func encodeRecord(rec gracc.Record, format, indent string) ([]byte, string, error) {
+	switch format {
+	case "raw":
+		return rec.Raw(), "text/xml", nil
+	case "xml":
+		rec = unwrapRecord(rec)
+		if gr, ok := rec.(*gracc.GenericRecord); ok {
+			return gr.Raw(), "text/xml", nil
+		}
+		b, err := gracc.MarshalRecordXML(rec)
+		return b, "text/xml", err
+	case "json":
+		b, err := rec.ToJSON(indent)
+		return b, "application/json", err
+	}
+	return nil, "", fmt.Errorf("unknown format \"%s\"", format)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+// BundleInfo describes where and when a bundle was received.
+type BundleInfo struct {
+	From       string
+	RemoteAddr string
+	Received   time.Time
+	// Command and BundleSize are the command of the request the bundle was
+	// received in, and the number of records the sender said it contains.
+	Command    string
+	BundleSize int
+}
+
+// RouteConfig is a rule that sends matching records to a different AMQP
+// exchange, routing key, or format than the output's default. Match
+// conditions are shell patterns (see path.Match); empty conditions match any
+// record, and all conditions must match.
+type RouteConfig struct {
+	Type       string
+	From       string
+	ProbeName  string
+	SiteName   string
+	Fields     map[string]string
+	Exchange   string
+	RoutingKey string
+	Format     string
+	// optional is true if the broker may drop matching records when no
+	// queue is bound for them, rather than returning them.
+	optional bool
+	// drop is true if matching records aren't published at all.
+	drop bool
+}
+
+func (c *RouteConfig) Validate() error {
+	if c.Exchange == "" && c.RoutingKey == "" && c.Format == "" {
+		return fmt.Errorf("route must set at least one of Exchange, RoutingKey, or Format")
+	}
+	switch c.Format {
+	case "", "raw", "xml", "json", "apel":
+	default:
+		return fmt.Errorf("unknown route Format \"%s\"", c.Format)
+	}
+	pats := []string{c.Type, c.From, c.ProbeName, c.SiteName}
+	for _, p := range c.Fields {
+		pats = append(pats, p)
+	}
+	for _, p := range pats {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad route pattern \"%s\": %s", p, err)
+		}
+	}
+	if _, err := parseRoutingKey(c.RoutingKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ProbeDetailsConfig is where ProbeDetails records, which describe the
+// probes' software, are sent on AMQP outputs, so they are kept out of the
+// usage record streams.
+type ProbeDetailsConfig struct {
+	Exchange   string `env:"EXCHANGE"`
+	RoutingKey string `env:"ROUTINGKEY"`
+}
+
+// route returns the route that sends ProbeDetails to their exchange. They
+// are optional, so that bundles don't fail if nothing consumes them, and
+// are dropped if no exchange is set, so they never go to the usage record
+// exchange.
+func (c *ProbeDetailsConfig) route() RouteConfig {
+	return RouteConfig{
+		Type:       "ProbeDetails",
+		Exchange:   c.Exchange,
+		RoutingKey: c.RoutingKey,
+		optional:   true,
+		drop:       c.Exchange == "",
+	}
+}
+
+// match returns true if the record matches all the route's conditions.
+func (c *RouteConfig) match(rec gracc.Record, info BundleInfo, rf *recordFields) bool {
+	if !matchPattern(c.Type, rec.Type()) || !matchPattern(c.From, info.From) {
+		return false
+	}
+	if !matchPattern(c.ProbeName, rf.Get("ProbeName")) ||
+		!matchPattern(c.SiteName, rf.Get("SiteName")) {
+		return false
+	}
+	for k, p := range c.Fields {
+		if !matchPattern(p, rf.Get(k)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPattern returns true if s matches shell pattern p, or p is empty.
+func matchPattern(p, s string) bool {
+	if p == "" {
+		return true
+	}
+	m, _ := path.Match(p, s)
+	return m
+}
+
+// amqpTarget is where, and in what format, to publish a record.
+type amqpTarget struct {
+	Exchange   string
+	RoutingKey string
+	Format     string
+	routingKey *template.Template
+	optional   bool
+	drop       bool
+}
+
+// amqpRoute is a route with its target filled in from the output defaults.
+type amqpRoute struct {
+	RouteConfig
+	target amqpTarget
+}
+
+// newAMQPRoutes makes the routes for an AMQP output with default target def.
+func newAMQPRoutes(routes []RouteConfig, def amqpTarget) []amqpRoute {
+	var rr []amqpRoute
+	for _, r := range routes {
+		t := def
+		if r.Exchange != "" {
+			t.Exchange = r.Exchange
+		}
+		if r.RoutingKey != "" {
+			t.RoutingKey = r.RoutingKey
+			t.routingKey, _ = parseRoutingKey(r.RoutingKey)
+		}
+		if r.Format != "" {
+			t.Format = r.Format
+		}
+		t.optional = r.optional
+		t.drop = r.drop
+		rr = append(rr, amqpRoute{RouteConfig: r, target: t})
+	}
+	return rr
+}
+
+// parseRoutingKey parses key as a template if it contains any actions,
+// otherwise it returns nil.
+func parseRoutingKey(key string) (*template.Template, error) {
+	if !strings.Contains(key, "{{") {
+		return nil, nil
+	}
+	t, err := template.New("routingKey").Option("missingkey=zero").Parse(key)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing RoutingKey template: %s", err)
+	}
+	return t, nil
+}
+
+// recordRoutingKey returns the routing key to publish rec with. If the
+// RoutingKey is a template it is executed with the flattened (JSON)
+// fields of the record, plus Type and Id; fields that the record doesn't
+// have expand to the empty string. e.g. "{{.Type}}.{{.ProbeName}}".
+func (t *amqpTarget) recordRoutingKey(rec gracc.Record, rf *recordFields) (string, error) {
+	if t.routingKey == nil {
+		return t.RoutingKey, nil
+	}
+	f, err := rf.Fields()
+	if err != nil {
+		return "", err
+	}
+	data := make(map[string]string, len(f)+2)
+	for k, v := range f {
+		data[k] = fmt.Sprint(v)
+	}
+	data["Type"] = rec.Type()
+	data["Id"] = rec.Id()
+	var b bytes.Buffer
+	if err := t.routingKey.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// recordFields lazily flattens a record, so it is only done once and only
+// if needed.
+type recordFields struct {
+	rec    gracc.Record
+	fields map[string]interface{}
+	err    error
+	done   bool
+}
+
+func newRecordFields(rec gracc.Record) *recordFields {
+	return &recordFields{rec: rec}
+}
+
+// Fields returns the flattened fields of the record.
+func (rf *recordFields) Fields() (map[string]interface{}, error) {
+	if !rf.done {
+		rf.fields, rf.err = flattenRecord(rf.rec)
+		rf.done = true
+	}
+	return rf.fields, rf.err
+}
+
+// Get returns the value of field k as a string, or the empty string if the
+// record doesn't have the field.
+func (rf *recordFields) Get(k string) string {
+	f, err := rf.Fields()
+	if err != nil {
+		return ""
+	}
+	if v, ok := f[k]; ok {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
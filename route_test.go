@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+func TestRoutes(t *testing.T) {
+	jur, err := gracc.ParseRecordXML([]byte(`<JobUsageRecord>
+<ProbeName>condor:test.example.com</ProbeName>
+<SiteName>Test_Site</SiteName>
+<Grid>OSG</Grid>
+</JobUsageRecord>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ser, err := gracc.ParseRecordXML([]byte(`<StorageElementRecord>
+<UniqueID>test</UniqueID>
+<ProbeName>hadoop-storage:test.example.com</ProbeName>
+</StorageElementRecord>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := []RouteConfig{
+		{Type: "StorageElement*", Exchange: "gracc.osg.storage"},
+		{From: "transfer:*", Exchange: "gracc.osg-transfer.raw", Format: "raw"},
+		{ProbeName: "condor:*", SiteName: "Other_Site", Exchange: "gracc.other.raw"},
+		{Fields: map[string]string{"Grid": "OSG"}, RoutingKey: "{{.Type}}.{{.SiteName}}"},
+	}
+	for i := range routes {
+		if err := routes[i].Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := DefaultConfig().AMQP
+	conf.Exchange = "gracc.osg.raw"
+	w := &AMQPWorker{
+		target: conf.defaultTarget(),
+		routes: newAMQPRoutes(routes, conf.defaultTarget()),
+	}
+
+	for _, tc := range []struct {
+		rec      gracc.Record
+		from     string
+		exchange string
+		key      string
+		format   string
+	}{
+		{ser, "hadoop", "gracc.osg.storage", "", "json"},
+		{jur, "transfer:host", "gracc.osg-transfer.raw", "", "raw"},
+		{jur, "condor:host", "gracc.osg.raw", "JobUsageRecord.Test_Site", "json"},
+	} {
+		w.Info = BundleInfo{From: tc.from}
+		rf := newRecordFields(tc.rec)
+		target := w.recordTarget(tc.rec, rf)
+		key, err := target.recordRoutingKey(tc.rec, rf)
+		if err != nil {
+			t.Error(err)
+		}
+		if target.Exchange != tc.exchange || key != tc.key || target.Format != tc.format {
+			t.Errorf("%s from %s: expected %s/%s/%s, got %s/%s/%s", tc.rec.Type(), tc.from,
+				tc.exchange, tc.key, tc.format, target.Exchange, key, target.Format)
+		}
+	}
+
+	for _, r := range []RouteConfig{
+		{Type: "JobUsageRecord"},
+		{Type: "[", Exchange: "x"},
+		{Exchange: "x", Format: "yaml"},
+	} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("expected error for invalid route %v", r)
+		}
+	}
+}
+
+func TestProbeDetailsRoute(t *testing.T) {
+	pd, err := gracc.ParseRecordXML([]byte(`<ProbeDetails>
+<ProbeName>condor:test.example.com</ProbeName>
+<Reporter version="1.16.3">condor_meter</Reporter>
+</ProbeDetails>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jur, err := gracc.ParseRecordXML([]byte(`<JobUsageRecord>
+<ProbeName>condor:test.example.com</ProbeName>
+</JobUsageRecord>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ProbeDetails have their own exchange by default, and are dropped if
+	// it is set empty, so they never go to the usage record exchange
+	for _, exchange := range []string{"gracc.probedetails", ""} {
+		conf := DefaultConfig()
+		conf.ProbeDetails.Exchange = exchange
+		oc := conf.OutputConfigs()
+		w := &AMQPWorker{
+			target: oc[0].AMQP.defaultTarget(),
+			routes: newAMQPRoutes(oc[0].AMQP.routes, oc[0].AMQP.defaultTarget()),
+		}
+		for _, tc := range []struct {
+			rec      gracc.Record
+			exchange string
+			optional bool
+			drop     bool
+		}{
+			{pd, exchange, true, exchange == ""},
+			{jur, "gracc", false, false},
+		} {
+			target := w.recordTarget(tc.rec, newRecordFields(tc.rec))
+			if tc.drop {
+				if !target.drop {
+					t.Errorf("%s: expected record to be dropped, got exchange %s", tc.rec.Type(), target.Exchange)
+				}
+				continue
+			}
+			if target.drop || target.Exchange != tc.exchange {
+				t.Errorf("%s: expected exchange %s, got %s (drop %v)", tc.rec.Type(), tc.exchange, target.Exchange, target.drop)
+			}
+			// ProbeDetails aren't returned if nothing is bound to their exchange
+			if target.optional != tc.optional {
+				t.Errorf("%s: expected optional %v", tc.rec.Type(), tc.optional)
+			}
+		}
+	}
+}
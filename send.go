@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+// runSend implements the send subcommand, which sends Gratia XML records
+// from files (or stdin) to a collector, as a Gratia probe would. Replication
+// bundles are sent as is with update; records and RecordEnvelope bundles are
+// rebundled into envelopes and sent with multiupdate, or into replication
+// bundles with -replicate. The exit status is non-zero if any could not be
+// sent.
+func runSend(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	hostname, _ := os.Hostname()
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	url := fs.String("url", "http://localhost:8080/gratia-servlets/rmi", "URL of the collector's rmi servlet")
+	from := fs.String("from", hostname, "sender name")
+	bundleSize := fs.Int("bundlesize", 100, "maximum number of records per bundle")
+	replicate := fs.Bool("replicate", false, "send records as replication bundles, as a Gratia collector would")
+	retries := fs.Int("retries", 3, "number of times to retry when the collector is unavailable")
+	retryWait := fs.Duration("retrywait", time.Second, "time to wait before the first retry, doubled for each retry")
+	ping := fs.Bool("ping", false, "only check that the collector is accepting requests")
+	maxBuffer := fs.Int("maxbuffer", DefaultConfig().MaxBufferSize, "maximum size of a record in a replication bundle")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: gracc-collector send [-url url] [-from name] [-bundlesize n] [file ...]\n\n")
+		fmt.Fprintf(stderr, "Sends Gratia XML records, RecordEnvelope bundles, or replication bundles\n")
+		fmt.Fprintf(stderr, "from files, or stdin if none are given or \"-\", to a collector.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *bundleSize < 1 {
+		fmt.Fprintf(stderr, "bundlesize must be at least 1\n")
+		return 2
+	}
+	c := gracc.NewClient(*url, *from)
+	c.Retries = *retries
+	c.RetryWait = *retryWait
+
+	if *ping {
+		if err := c.Ping(); err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "OK\n")
+		return 0
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var nrec, nsent, nerr int
+	for _, name := range files {
+		var data []byte
+		var err error
+		if name == "-" {
+			name = "<stdin>"
+			data, err = ioutil.ReadAll(stdin)
+		} else {
+			data, err = ioutil.ReadFile(name)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %s\n", name, err)
+			nerr++
+			continue
+		}
+		inputs, err := splitConvertInput(data, *maxBuffer)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %s\n", name, err)
+			nerr++
+			continue
+		}
+		nrec += len(inputs)
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("replication|")) {
+			if err := c.Update(string(data), len(inputs)); err != nil {
+				fmt.Fprintf(stderr, "%s: %s\n", name, err)
+				nerr++
+				continue
+			}
+			nsent += len(inputs)
+			continue
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+			if inputs, err = jsonToXML(inputs); err != nil {
+				fmt.Fprintf(stderr, "%s: %s\n", name, err)
+				nerr++
+				continue
+			}
+		}
+		for i := 0; i < len(inputs); i += *bundleSize {
+			j := i + *bundleSize
+			if j > len(inputs) {
+				j = len(inputs)
+			}
+			var err error
+			if *replicate {
+				err = sendReplicated(c, inputs[i:j])
+			} else {
+				err = c.MultiUpdate(recordEnvelope(inputs[i:j]))
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "%s: records %d-%d: %s\n", name, i+1, j, err)
+				nerr++
+				continue
+			}
+			nsent += j - i
+		}
+	}
+	fmt.Fprintf(stderr, "sent %d of %d records, %d errors\n", nsent, nrec, nerr)
+	if nerr > 0 {
+		return 1
+	}
+	return 0
+}
+
+// sendReplicated parses records recs and sends them as a replication bundle.
+func sendReplicated(c *gracc.Client, recs [][]byte) error {
+	var bun gracc.RecordBundle
+	for i, x := range recs {
+		rec, err := gracc.ParseRecordXML(x)
+		if err != nil {
+			return fmt.Errorf("record %d: %s", i+1, err)
+		}
+		bun.AddRecord(rec)
+	}
+	return c.UpdateRecords(&bun)
+}
+
+// jsonToXML converts JSON raw records js to record XML.
+func jsonToXML(js [][]byte) ([][]byte, error) {
+	xs := make([][]byte, len(js))
+	for i, j := range js {
+		rec, err := gracc.RecordFromJSON(j)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %s", i+1, err)
+		}
+		if xs[i], err = gracc.MarshalRecordXML(rec); err != nil {
+			return nil, fmt.Errorf("record %d: %s", i+1, err)
+		}
+	}
+	return xs, nil
+}
+
+// recordEnvelope returns a RecordEnvelope bundle containing records recs.
+func recordEnvelope(recs [][]byte) string {
+	var b bytes.Buffer
+	b.WriteString("<RecordEnvelope>\n")
+	for _, r := range recs {
+		b.Write(bytes.TrimSpace(r))
+		b.WriteByte('\n')
+	}
+	b.WriteString("</RecordEnvelope>\n")
+	return b.String()
+}
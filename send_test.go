@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+func TestSend(t *testing.T) {
+	var reqs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		reqs = append(reqs, r.PostForm.Get("command")+" "+r.PostForm.Get("bundlesize"))
+		if r.PostForm.Get("command") == "update" {
+			rrs, err := gracc.ScanReplicationBundle(strings.NewReader(r.PostForm.Get("arg1")), 1024, 1024*1024)
+			if err != nil || strconv.Itoa(len(rrs)) != r.PostForm.Get("bundlesize") {
+				http.Error(w, "bad bundle", http.StatusBadRequest)
+				return
+			}
+		}
+		if r.PostForm.Get("command") == "multiupdate" {
+			inputs, err := splitConvertInput([]byte(r.PostForm.Get("arg1")), 1024)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			reqs[len(reqs)-1] += fmt.Sprint(len(inputs))
+		}
+		fmt.Fprint(w, "OK")
+	}))
+	defer srv.Close()
+
+	for _, st := range []struct {
+		input string
+		flags []string
+		reqs  []string
+	}{
+		{testBundleXML, nil, []string{"multiupdate 5", "multiupdate 5", "multiupdate 1"}},
+		{testBundleXML, []string{"-replicate"}, []string{"update 5", "update 5", "update 1"}},
+		{testBundle, nil, []string{"update 15"}},
+		{`{"type":"JobUsageRecord","RecordId":"r1"} {"type":"JobUsageRecord","RecordId":"r2"}`, nil, []string{"multiupdate 2"}},
+	} {
+		reqs = nil
+		var stdout, stderr bytes.Buffer
+		args := append([]string{"-url", srv.URL, "-bundlesize", "5"}, st.flags...)
+		status := runSend(args, strings.NewReader(st.input), &stdout, &stderr)
+		if status != 0 {
+			t.Errorf("expected status 0, got %d: %s", status, stderr.String())
+		}
+		if fmt.Sprint(reqs) != fmt.Sprint(st.reqs) {
+			t.Errorf("expected requests %v, got %v", st.reqs, reqs)
+		}
+	}
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opensciencegrid/gracc-collector/gracc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type SpoolConfig struct {
+	Dir            string        `env:"DIR"`
+	MaxSize        int64         `env:"MAXSIZE"`
+	MaxAge         string        `env:"MAXAGE"`
+	MaxAgeDuration time.Duration `env:"-"`
+	Retry          string        `env:"RETRY"`
+	RetryDuration  time.Duration `env:"-"`
+}
+
+// Enabled returns true if a spool directory has been configured.
+func (c *SpoolConfig) Enabled() bool {
+	return c.Dir != ""
+}
+
+func (c *SpoolConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	var err error
+	c.MaxAgeDuration, err = time.ParseDuration(c.MaxAge)
+	if err != nil {
+		return fmt.Errorf("error parsing Spool MaxAge: %s", err)
+	}
+	c.RetryDuration, err = time.ParseDuration(c.Retry)
+	if err != nil {
+		return fmt.Errorf("error parsing Spool Retry: %s", err)
+	}
+	if c.RetryDuration <= 0 {
+		return fmt.Errorf("Spool Retry must be positive")
+	}
+	return nil
+}
+
+// Spool segments are named by the time they were written and a sequence
+// number, so that sorting the names sorts the segments oldest first.
+const (
+	spoolMagic     = "GRACCSPOOL1\n"
+	spoolSegSuffix = ".seg"
+	spoolTmpSuffix = ".tmp"
+	spoolBadSuffix = ".corrupt"
+)
+
+var spoolTable = crc32.MakeTable(crc32.Castagnoli)
+
+// spoolHeader is the first entry in each segment.
+type spoolHeader struct {
+	Created time.Time  `json:"created"`
+	Records int        `json:"records"`
+	Info    BundleInfo `json:"info"`
+	// Duplicates are the positions of the records that deduplication
+	// marked as duplicates, which are marked again when they are sent.
+	Duplicates []int `json:"duplicates,omitempty"`
+}
+
+type spoolSegment struct {
+	name    string
+	size    int64
+	created time.Time
+	records int
+}
+
+// Spool is a write-ahead spool of record bundles that could not be sent to
+// an output. Each bundle is written to its own segment file, which is
+// fsync'd before the bundle is acknowledged, and removed once the
+// forwarder has successfully sent all of its records.
+//
+// A segment is a magic string followed by a sequence of entries, each
+// consisting of a big-endian uint32 length, a CRC-32C (Castagnoli) checksum
+// of the payload, and the payload itself. The first entry is a JSON-encoded
+// spoolHeader, and the remaining entries are the raw XML of each record.
+type Spool struct {
+	Name    string
+	Dir     string
+	Config  SpoolConfig
+	Output  Output
+	Timeout time.Duration
+	// Generic is true if records of unknown types are forwarded as
+	// GenericRecords.
+	Generic bool
+	// Reject handles records that the output rejects as invalid while they
+	// are being forwarded, according to the acceptance policy.
+	Reject func(dls []DeadLetter, info BundleInfo) error
+
+	m        sync.Mutex
+	segments []spoolSegment
+	size     int64
+	seq      uint64
+	expired  uint64
+	kick     chan struct{}
+	// done is closed to stop the forwarder, and wg waits for it to stop.
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	SegmentsDesc *prometheus.Desc
+	RecordsDesc  *prometheus.Desc
+	BytesDesc    *prometheus.Desc
+	OldestDesc   *prometheus.Desc
+	ExpiredDesc  *prometheus.Desc
+}
+
+// NewSpool opens the spool directory for the output called name, recovers
+// any segments left from a previous run, and starts the forwarder that
+// drains the spool to out. timeout is how long to wait for the output to
+// confirm each segment, generic is true if generic records are enabled, and
+// reject handles records that the output rejects.
+func NewSpool(name string, conf SpoolConfig, out Output, timeout time.Duration, generic bool, reject func([]DeadLetter, BundleInfo) error) (*Spool, error) {
+	s, err := openSpool(name, conf)
+	if err != nil {
+		return nil, err
+	}
+	s.Output = out
+	s.Timeout = timeout
+	s.Generic = generic
+	s.Reject = reject
+	s.wg.Add(1)
+	go s.forward()
+	return s, nil
+}
+
+// Close stops the forwarder, and waits for it to finish sending the current
+// segment. Segments that haven't been sent are left in the spool.
+func (s *Spool) Close() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// openSpool opens and recovers the spool, but does not start the forwarder.
+func openSpool(name string, conf SpoolConfig) (*Spool, error) {
+	s := &Spool{
+		Name:   name,
+		Dir:    filepath.Join(conf.Dir, name),
+		Config: conf,
+		kick:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	labels := prometheus.Labels{"output": name}
+	s.SegmentsDesc = prometheus.NewDesc(
+		"gracc_spool_segments",
+		"Number of bundles waiting in the spool.",
+		nil,
+		labels,
+	)
+	s.RecordsDesc = prometheus.NewDesc(
+		"gracc_spool_records",
+		"Number of records waiting in the spool.",
+		nil,
+		labels,
+	)
+	s.BytesDesc = prometheus.NewDesc(
+		"gracc_spool_bytes",
+		"Size of the spool on disk.",
+		nil,
+		labels,
+	)
+	s.OldestDesc = prometheus.NewDesc(
+		"gracc_spool_oldest_age_seconds",
+		"Age of the oldest bundle in the spool.",
+		nil,
+		labels,
+	)
+	s.ExpiredDesc = prometheus.NewDesc(
+		"gracc_spool_expired_total",
+		"Number of bundles discarded from the spool for exceeding the maximum age.",
+		nil,
+		labels,
+	)
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return nil, NewSpoolError(fmt.Sprintf("error creating spool directory: %s", err))
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover scans the spool directory for segments written by a previous run.
+// Incomplete (temporary) segments are removed, since they were never
+// acknowledged, and segments that fail their checksum are set aside.
+func (s *Spool) recover() error {
+	names, err := filepath.Glob(filepath.Join(s.Dir, "*"))
+	if err != nil {
+		return NewSpoolError(fmt.Sprintf("error reading spool directory: %s", err))
+	}
+	sort.Strings(names)
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, name := range names {
+		ll := log.WithField("segment", name)
+		switch {
+		case strings.HasSuffix(name, spoolTmpSuffix):
+			ll.Warning("spool: removing incomplete segment")
+			os.Remove(name)
+		case strings.HasSuffix(name, spoolSegSuffix):
+			hdr, _, err := readSegment(name)
+			if err != nil {
+				ll.WithField("error", err).Error("spool: corrupt segment, setting aside")
+				os.Rename(name, name+spoolBadSuffix)
+				continue
+			}
+			fi, err := os.Stat(name)
+			if err != nil {
+				return NewSpoolError(fmt.Sprintf("error reading spool segment: %s", err))
+			}
+			s.segments = append(s.segments, spoolSegment{
+				name:    name,
+				size:    fi.Size(),
+				created: hdr.Created,
+				records: hdr.Records,
+			})
+			s.size += fi.Size()
+		}
+	}
+	if len(s.segments) > 0 {
+		log.WithFields(log.Fields{
+			"segments": len(s.segments),
+			"bytes":    s.size,
+		}).Info("spool: recovered segments")
+	}
+	return nil
+}
+
+// Store durably writes records rs, described by info, to the spool.
+// When Store returns without error the bundle may be acknowledged to the
+// sender.
+func (s *Spool) Store(rs []gracc.Record, info BundleInfo) error {
+	var recs [][]byte
+	var dups []int
+	for i, rec := range rs {
+		recs = append(recs, rec.Raw())
+		if isDuplicate(rec) {
+			dups = append(dups, i)
+		}
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	now := time.Now()
+	hdr := spoolHeader{
+		Created:    now,
+		Records:    len(recs),
+		Info:       info,
+		Duplicates: dups,
+	}
+	var buf bytes.Buffer
+	if err := writeSegment(&buf, hdr, recs); err != nil {
+		return NewSpoolError(fmt.Sprintf("error encoding spool segment: %s", err))
+	}
+	size := int64(buf.Len())
+
+	s.m.Lock()
+	if s.Config.MaxSize > 0 && s.size+size > s.Config.MaxSize {
+		s.m.Unlock()
+		return NewSpoolError("spool is full")
+	}
+	// reserve the space now so concurrent writers can't overfill the spool
+	s.size += size
+	s.seq++
+	name := filepath.Join(s.Dir, fmt.Sprintf("%020d-%06d%s", now.UnixNano(), s.seq%1000000, spoolSegSuffix))
+	s.m.Unlock()
+
+	if err := writeFileSync(name, buf.Bytes()); err != nil {
+		s.m.Lock()
+		s.size -= size
+		s.m.Unlock()
+		log.WithFields(log.Fields{
+			"segment": name,
+			"error":   err,
+		}).Error("spool: error writing segment")
+		return NewSpoolError("error writing to spool")
+	}
+
+	s.m.Lock()
+	// concurrent writers may finish out of order, so keep the index sorted
+	i := sort.Search(len(s.segments), func(i int) bool {
+		return s.segments[i].name > name
+	})
+	s.segments = append(s.segments, spoolSegment{})
+	copy(s.segments[i+1:], s.segments[i:])
+	s.segments[i] = spoolSegment{
+		name:    name,
+		size:    size,
+		created: now,
+		records: len(recs),
+	}
+	s.m.Unlock()
+	log.WithFields(log.Fields{
+		"output":  s.Name,
+		"segment": name,
+		"records": len(recs),
+	}).Info("spool: stored bundle")
+
+	// wake up the forwarder, unless it has already been woken
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// forward periodically drains the spool to the output.
+func (s *Spool) forward() {
+	defer s.wg.Done()
+	t := time.NewTicker(s.Config.RetryDuration)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.kick:
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+		s.drain()
+	}
+}
+
+// drain sends segments, oldest first, until the spool is empty or an
+// error occurs.
+func (s *Spool) drain() {
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		s.m.Lock()
+		if len(s.segments) == 0 {
+			s.m.Unlock()
+			return
+		}
+		seg := s.segments[0]
+		s.m.Unlock()
+
+		ll := log.WithField("segment", seg.name)
+		if s.Config.MaxAgeDuration > 0 && time.Since(seg.created) > s.Config.MaxAgeDuration {
+			ll.WithFields(log.Fields{
+				"records": seg.records,
+				"created": seg.created,
+			}).Error("spool: discarding expired segment")
+			s.m.Lock()
+			s.expired++
+			s.m.Unlock()
+			s.remove(seg)
+			continue
+		}
+		if err := s.send(seg); err != nil {
+			ll.WithField("error", err).Warning("spool: unable to send segment, will retry")
+			return
+		}
+		ll.WithField("records", seg.records).Info("spool: sent segment")
+		s.remove(seg)
+	}
+}
+
+// send publishes all the records in seg and waits for confirmation.
+// Records that can't be parsed or that the output rejects as invalid are
+// handed to Reject, since retrying won't help; the segment is kept if that
+// fails.
+func (s *Spool) send(seg spoolSegment) error {
+	hdr, recs, err := readSegment(seg.name)
+	if err != nil {
+		// the segment was verified when written or recovered, so this is
+		// most likely a transient I/O error; try again later.
+		return err
+	}
+	w, err := s.Output.NewWorker(len(recs), hdr.Info)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	dups := make(map[int]bool, len(hdr.Duplicates))
+	for _, i := range hdr.Duplicates {
+		dups[i] = true
+	}
+	var rejected []DeadLetter
+	published := make([]gracc.Record, 0, len(recs))
+	for i, raw := range recs {
+		rec, err := s.parseRecord(raw)
+		if err != nil {
+			rejected = append(rejected, DeadLetter{
+				RawXML: string(raw),
+				Error:  err.Error(),
+			})
+			continue
+		}
+		if dups[i] {
+			rec = duplicateRecord{rec}
+		}
+		if err := w.PublishRecord(rec); err != nil {
+			if _, ok := err.(RecordError); ok {
+				rejected = append(rejected, rejectedDeadLetter(rec, err.Error()))
+				continue
+			}
+			return err
+		}
+		published = append(published, rec)
+	}
+	if len(published) > 0 {
+		if err := w.Wait(s.Timeout); err != nil {
+			rerr, ok := err.(RejectedError)
+			if !ok {
+				return err
+			}
+			for j, i := range rerr.Records {
+				if i < 0 || i >= len(published) {
+					// can't tell which record was rejected
+					return err
+				}
+				rejected = append(rejected, rejectedDeadLetter(published[i], rerr.Reasons[j]))
+			}
+		}
+	}
+	return s.reject(seg, rejected, hdr.Info)
+}
+
+// parseRecord parses spooled record XML x into a known record type, or if
+// generic records are enabled, a GenericRecord if it is of another type.
+func (s *Spool) parseRecord(x []byte) (gracc.Record, error) {
+	if s.Generic {
+		return gracc.ParseAnyRecordXML(x)
+	}
+	return gracc.ParseRecordXML(x)
+}
+
+// reject hands records in seg that were rejected to Reject, or if it isn't
+// set, logs each of them.
+func (s *Spool) reject(seg spoolSegment, dls []DeadLetter, info BundleInfo) error {
+	if len(dls) == 0 {
+		return nil
+	}
+	for i := range dls {
+		dls[i].Output = s.Name
+	}
+	if s.Reject != nil {
+		return s.Reject(dls, info)
+	}
+	for _, dl := range dls {
+		log.WithFields(log.Fields{
+			"segment": seg.name,
+			"type":    dl.Type,
+			"error":   dl.Error,
+			"rec":     dl.RawXML,
+		}).Error("spool: spooled record rejected; dropping")
+	}
+	return nil
+}
+
+// remove deletes seg from disk and from the spool index.
+func (s *Spool) remove(seg spoolSegment) {
+	if err := os.Remove(seg.name); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"segment": seg.name,
+			"error":   err,
+		}).Error("spool: error removing segment")
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	for i := range s.segments {
+		if s.segments[i].name == seg.name {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			s.size -= seg.size
+			break
+		}
+	}
+}
+
+func (s *Spool) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.SegmentsDesc
+	ch <- s.RecordsDesc
+	ch <- s.BytesDesc
+	ch <- s.OldestDesc
+	ch <- s.ExpiredDesc
+}
+
+func (s *Spool) Collect(ch chan<- prometheus.Metric) {
+	s.m.Lock()
+	var records int
+	var oldest float64
+	for _, seg := range s.segments {
+		records += seg.records
+	}
+	if len(s.segments) > 0 {
+		oldest = time.Since(s.segments[0].created).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(
+		s.SegmentsDesc,
+		prometheus.GaugeValue,
+		float64(len(s.segments)),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s.RecordsDesc,
+		prometheus.GaugeValue,
+		float64(records),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s.BytesDesc,
+		prometheus.GaugeValue,
+		float64(s.size),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s.OldestDesc,
+		prometheus.GaugeValue,
+		oldest,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s.ExpiredDesc,
+		prometheus.CounterValue,
+		float64(s.expired),
+	)
+	s.m.Unlock()
+}
+
+// writeSegment encodes a segment with header hdr and records recs to w.
+func writeSegment(w io.Writer, hdr spoolHeader, recs [][]byte) error {
+	if _, err := io.WriteString(w, spoolMagic); err != nil {
+		return err
+	}
+	h, err := json.Marshal(hdr)
+	if err != nil {
+		return err
+	}
+	if err := writeEntry(w, h); err != nil {
+		return err
+	}
+	for _, r := range recs {
+		if err := writeEntry(w, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeEntry(w io.Writer, p []byte) error {
+	var pre [8]byte
+	binary.BigEndian.PutUint32(pre[0:4], uint32(len(p)))
+	binary.BigEndian.PutUint32(pre[4:8], crc32.Checksum(p, spoolTable))
+	if _, err := w.Write(pre[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+// readSegment reads and verifies the segment in file name, returning
+// the header and the records.
+func readSegment(name string) (spoolHeader, [][]byte, error) {
+	var hdr spoolHeader
+	f, err := os.Open(name)
+	if err != nil {
+		return hdr, nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(spoolMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != spoolMagic {
+		return hdr, nil, fmt.Errorf("bad segment magic")
+	}
+	h, err := readEntry(r)
+	if err != nil {
+		return hdr, nil, fmt.Errorf("error reading segment header: %s", err)
+	}
+	if err := json.Unmarshal(h, &hdr); err != nil {
+		return hdr, nil, fmt.Errorf("error decoding segment header: %s", err)
+	}
+	recs := make([][]byte, 0, hdr.Records)
+	for {
+		p, err := readEntry(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return hdr, nil, fmt.Errorf("error reading record %d: %s", len(recs), err)
+		}
+		recs = append(recs, p)
+	}
+	if len(recs) != hdr.Records {
+		return hdr, nil, fmt.Errorf("segment has %d records, expected %d", len(recs), hdr.Records)
+	}
+	return hdr, recs, nil
+}
+
+func readEntry(r io.Reader) ([]byte, error) {
+	var pre [8]byte
+	if _, err := io.ReadFull(r, pre[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated entry")
+		}
+		return nil, err
+	}
+	p := make([]byte, binary.BigEndian.Uint32(pre[0:4]))
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, fmt.Errorf("truncated entry")
+	}
+	if crc32.Checksum(p, spoolTable) != binary.BigEndian.Uint32(pre[4:8]) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return p, nil
+}
+
+// writeFileSync atomically writes data to file name: it is first written
+// and fsync'd to a temporary file, which is then renamed, and finally the
+// directory is fsync'd so the rename is durable.
+func writeFileSync(name string, data []byte) error {
+	tmp := strings.TrimSuffix(name, spoolSegSuffix) + spoolTmpSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	d, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opensciencegrid/gracc-collector/gracc"
+)
+
+func testSpoolConfig(t *testing.T) SpoolConfig {
+	dir, err := ioutil.TempDir("", "gracc-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := SpoolConfig{
+		Dir:     dir,
+		MaxSize: 1024 * 1024,
+		MaxAge:  "1h",
+		Retry:   "1s",
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func TestSpoolStoreRecover(t *testing.T) {
+	conf := testSpoolConfig(t)
+	defer os.RemoveAll(conf.Dir)
+
+	var bun gracc.RecordBundle
+	if err := xml.Unmarshal([]byte(testBundleXML), &bun); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openSpool("test", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(bundleRecords(&bun), BundleInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(bundleRecords(&bun), BundleInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.segments) != 2 {
+		t.Fatalf("expected 2 segments, got %d", len(s.segments))
+	}
+
+	// spooled records should parse back into the same records
+	_, recs, err := readSegment(s.segments[0].name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for rec := range bun.Records() {
+		r, err := gracc.ParseRecordXML(recs[n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Id() != rec.Id() || r.Type() != rec.Type() {
+			t.Errorf("record %d: expected %s %s, got %s %s", n, rec.Type(), rec.Id(), r.Type(), r.Id())
+		}
+		n++
+	}
+	if n != len(recs) {
+		t.Errorf("expected %d records in segment, got %d", n, len(recs))
+	}
+
+	// corrupt the second segment and leave an incomplete one behind
+	bad := s.segments[1].name
+	buf, err := ioutil.ReadFile(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-1] ^= 0xff
+	if err := ioutil.WriteFile(bad, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(conf.Dir, "test", "00000000000000000000-000000"+spoolTmpSuffix)
+	if err := ioutil.WriteFile(tmp, []byte(spoolMagic), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openSpool("test", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.segments) != 1 || r.segments[0].name != s.segments[0].name {
+		t.Errorf("expected to recover only %s, got %v", s.segments[0].name, r.segments)
+	}
+	if r.segments[0].records != n {
+		t.Errorf("expected %d records in recovered segment, got %d", n, r.segments[0].records)
+	}
+	if _, err := os.Stat(bad + spoolBadSuffix); err != nil {
+		t.Errorf("corrupt segment was not set aside: %s", err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("incomplete segment was not removed")
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	conf := testSpoolConfig(t)
+	defer os.RemoveAll(conf.Dir)
+	conf.MaxSize = 1024
+
+	var bun gracc.RecordBundle
+	if err := xml.Unmarshal([]byte(testBundleXML), &bun); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openSpool("test", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(bundleRecords(&bun), BundleInfo{}); err == nil {
+		t.Error("expected error storing bundle larger than spool")
+	} else if _, ok := err.(SpoolError); !ok {
+		t.Errorf("expected SpoolError, got %T: %s", err, err)
+	}
+	if len(s.segments) != 0 || s.size != 0 {
+		t.Errorf("rejected bundle was left in spool")
+	}
+}
+
+// memOutput is an Output that keeps the records published to it. Wait
+// returns err.
+type memOutput struct {
+	recs []gracc.Record
+	err  error
+}
+
+func (o *memOutput) NewWorker(bundleSize int, info BundleInfo) (Worker, error) {
+	return &memWorker{output: o}, nil
+}
+
+func (o *memOutput) Close() error {
+	return nil
+}
+
+type memWorker struct {
+	output *memOutput
+}
+
+func (w *memWorker) PublishRecord(rec gracc.Record) error {
+	w.output.recs = append(w.output.recs, rec)
+	return nil
+}
+
+func (w *memWorker) Wait(timeout time.Duration) error {
+	return w.output.err
+}
+
+func (w *memWorker) Close() error {
+	return nil
+}
+
+func TestSpoolDuplicates(t *testing.T) {
+	conf := testSpoolConfig(t)
+	defer os.RemoveAll(conf.Dir)
+
+	var bun gracc.RecordBundle
+	if err := xml.Unmarshal([]byte(testBundleXML), &bun); err != nil {
+		t.Fatal(err)
+	}
+	recs := bundleRecords(&bun)[:2]
+	recs[1] = duplicateRecord{recs[1]}
+	s, err := openSpool("test", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(recs, BundleInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	out := &memOutput{}
+	s.Output = out
+	if err := s.send(s.segments[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.recs) != 2 {
+		t.Fatalf("expected 2 records sent, got %d", len(out.recs))
+	}
+
+	// duplicates are still tagged, and routed to the dedup exchange
+	dc := DedupConfig{File: "x", Policy: "route", Exchange: "gracc.dups"}
+	route := dc.route()
+	for i, rec := range out.recs {
+		f, err := flattenRecord(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dup := i == 1
+		if (f["Duplicate"] == true) != dup {
+			t.Errorf("record %d: expected Duplicate %v, got %v", i, dup, f["Duplicate"])
+		}
+		if route.match(rec, BundleInfo{}, newRecordFields(rec)) != dup {
+			t.Errorf("record %d: expected dedup route match %v", i, dup)
+		}
+	}
+}
+
+func TestSpoolRejected(t *testing.T) {
+	conf := testSpoolConfig(t)
+	defer os.RemoveAll(conf.Dir)
+
+	var bun gracc.RecordBundle
+	if err := xml.Unmarshal([]byte(testBundleXML), &bun); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openSpool("test", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(bundleRecords(&bun)[:3], BundleInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	var rejected []DeadLetter
+	var rejectErr error
+	s.Reject = func(dls []DeadLetter, info BundleInfo) error {
+		rejected = append(rejected, dls...)
+		return rejectErr
+	}
+
+	// returns and other errors that may succeed later keep the segment
+	s.Output = &memOutput{err: NewAMQPError("1 messages were returned")}
+	if err := s.send(s.segments[0]); err == nil {
+		t.Error("expected error when output is unavailable")
+	}
+	if len(rejected) != 0 {
+		t.Errorf("expected no rejected records, got %d", len(rejected))
+	}
+
+	// records rejected as invalid are handed to Reject
+	s.Output = &memOutput{err: RejectedError{
+		Message: "1 records were rejected",
+		Records: []int{1},
+		Reasons: []string{"mapping error"},
+	}}
+	if err := s.send(s.segments[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 1 {
+		t.Fatalf("expected 1 rejected record, got %d", len(rejected))
+	}
+	if dl := rejected[0]; dl.Error != "mapping error" || dl.Output != "test" || dl.RawXML == "" {
+		t.Errorf("unexpected dead letter %+v", dl)
+	}
+
+	// the segment is kept if they can't be handled
+	rejectErr = NewOutputError("dead letters unavailable")
+	if err := s.send(s.segments[0]); err == nil {
+		t.Error("expected error when rejected records can't be handled")
+	}
+}
+
+func TestSpoolGeneric(t *testing.T) {
+	conf := testSpoolConfig(t)
+	defer os.RemoveAll(conf.Dir)
+
+	env := `<RecordEnvelope xmlns:ex="http://example.org/ex">
+<NewRecord xmlns="http://example.org/new" ex:version="2"><RecordIdentity recordId="r1"/><Site>X</Site></NewRecord>
+</RecordEnvelope>`
+	var bun gracc.RecordBundle
+	if err := xml.Unmarshal([]byte(env), &bun); err != nil {
+		t.Fatal(err)
+	}
+	bun.ParseOtherRecords()
+	recs := bundleRecords(&bun)
+	if len(recs) != 1 {
+		t.Fatalf("expected 1 generic record, got %d", len(recs))
+	}
+	s, err := openSpool("test", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Generic = true
+	if err := s.Store(recs, BundleInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	var rejected []DeadLetter
+	s.Reject = func(dls []DeadLetter, info BundleInfo) error {
+		rejected = append(rejected, dls...)
+		return nil
+	}
+	out := &memOutput{}
+	s.Output = out
+	if err := s.send(s.segments[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.recs) != 1 || len(rejected) != 0 {
+		t.Fatalf("expected 1 record sent and none rejected, got %d and %d", len(out.recs), len(rejected))
+	}
+	rec := out.recs[0]
+	if _, ok := rec.(*gracc.GenericRecord); !ok || rec.Id() != "r1" || rec.Fingerprint() != recs[0].Fingerprint() {
+		t.Errorf("expected generic record r1 %s, got %T %s %s", recs[0].Fingerprint(), rec, rec.Id(), rec.Fingerprint())
+	}
+}
+
+func TestSpoolClose(t *testing.T) {
+	conf := testSpoolConfig(t)
+	defer os.RemoveAll(conf.Dir)
+
+	var bun gracc.RecordBundle
+	if err := xml.Unmarshal([]byte(testBundleXML), &bun); err != nil {
+		t.Fatal(err)
+	}
+	out := &memOutput{}
+	s, err := NewSpool("test", conf, out, time.Second, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// the forwarder has stopped, so stored bundles stay in the spool
+	if err := s.Store(bundleRecords(&bun), BundleInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(out.recs) != 0 || len(s.segments) != 1 {
+		t.Errorf("expected segment to stay in spool after Close, sent %d records", len(out.recs))
+	}
+}
+
+// bundleRecords returns the records in bun as a slice.
+func bundleRecords(bun *gracc.RecordBundle) []gracc.Record {
+	var recs []gracc.Record
+	for rec := range bun.Records() {
+		recs = append(recs, rec)
+	}
+	return recs
+}